@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxDimensionCm bounds each dimension; anything larger is a typo in
+// millimetres rather than a piece of furniture.
+const maxDimensionCm = 1000
+
+// Conditions a listing can be described with, from best to worst.
+const (
+	ConditionNew       = "new"
+	ConditionLikeNew   = "like_new"
+	ConditionGood      = "good"
+	ConditionFair      = "fair"
+	ConditionForRepair = "for_repair"
+)
+
+var conditions = []string{ConditionNew, ConditionLikeNew, ConditionGood, ConditionFair, ConditionForRepair}
+
+var materials = []string{
+	"wood", "veneer", "particleboard", "mdf", "metal", "glass", "plastic",
+	"fabric", "leather", "faux_leather", "rattan", "stone", "other",
+}
+
+var colors = []string{
+	"white", "black", "grey", "beige", "brown", "natural_wood", "red", "orange", "yellow",
+	"green", "blue", "purple", "pink", "gold", "silver", "multicolor", "other",
+}
+
+// attributeAliases maps common spellings onto the values above.
+var attributeAliases = map[string]string{
+	"used":         ConditionGood,
+	"damaged":      ConditionForRepair,
+	"solid_wood":   "wood",
+	"chipboard":    "particleboard",
+	"eco_leather":  "faux_leather",
+	"gray":         "grey",
+	"multicolour":  "multicolor",
+	"multicolored": "multicolor",
+}
+
+// Dimensions are in centimetres. Any of them may be unknown.
+type Dimensions struct {
+	WidthCm  *float64 `json:"widthCm,omitempty"`
+	DepthCm  *float64 `json:"depthCm,omitempty"`
+	HeightCm *float64 `json:"heightCm,omitempty"`
+}
+
+// PhysicalAttributes describe the item itself. Empty values are unknown.
+type PhysicalAttributes struct {
+	Dimensions *Dimensions `json:"dimensions,omitempty"`
+	Condition  string      `json:"condition,omitempty"`
+	Material   string      `json:"material,omitempty"`
+	Color      string      `json:"color,omitempty"`
+}
+
+type AttributeOptionsResponse struct {
+	Conditions []string `json:"conditions"`
+	Materials  []string `json:"materials"`
+	Colors     []string `json:"colors"`
+}
+
+func initAttributeTables() error {
+	alterFurnitureAttributesSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS width_cm DECIMAL(6, 1);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS depth_cm DECIMAL(6, 1);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS height_cm DECIMAL(6, 1);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS condition VARCHAR(20);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS material VARCHAR(30);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS color VARCHAR(30);`
+
+	if _, err := db.Exec(alterFurnitureAttributesSQL); err != nil {
+		return fmt.Errorf("failed to add furniture attribute columns: %w", err)
+	}
+
+	return nil
+}
+
+// attributeColumns is the select list understood by attributesFrom.
+const attributeColumns = "width_cm, depth_cm, height_cm, COALESCE(condition, ''), COALESCE(material, ''), COALESCE(color, '')"
+
+// attributesFrom assembles attributes from values selected with
+// attributeColumns.
+func attributesFrom(widthCm, depthCm, heightCm *float64, condition, material, color string) PhysicalAttributes {
+	attributes := PhysicalAttributes{Condition: condition, Material: material, Color: color}
+	if widthCm != nil || depthCm != nil || heightCm != nil {
+		attributes.Dimensions = &Dimensions{WidthCm: widthCm, DepthCm: depthCm, HeightCm: heightCm}
+	}
+	return attributes
+}
+
+// columnValues returns the attributes in the order of attributeColumns.
+func (a PhysicalAttributes) columnValues() []interface{} {
+	var widthCm, depthCm, heightCm *float64
+	if a.Dimensions != nil {
+		widthCm, depthCm, heightCm = a.Dimensions.WidthCm, a.Dimensions.DepthCm, a.Dimensions.HeightCm
+	}
+	return []interface{}{widthCm, depthCm, heightCm, nullIfEmpty(a.Condition), nullIfEmpty(a.Material), nullIfEmpty(a.Color)}
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// normalize maps condition, material and color onto their canonical
+// values, leaving unknown ones for validate to report.
+func (a *PhysicalAttributes) normalize() {
+	a.Condition = normalizeAttribute(a.Condition)
+	a.Material = normalizeAttribute(a.Material)
+	a.Color = normalizeAttribute(a.Color)
+	if d := a.Dimensions; d != nil && d.WidthCm == nil && d.DepthCm == nil && d.HeightCm == nil {
+		a.Dimensions = nil
+	}
+}
+
+func normalizeAttribute(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.NewReplacer(" ", "_", "-", "_").Replace(value)
+	if alias, ok := attributeAliases[value]; ok {
+		return alias
+	}
+	return value
+}
+
+// validate returns the first problem with the attributes, named after the
+// field it concerns.
+func (a PhysicalAttributes) validate() *FieldError {
+	if d := a.Dimensions; d != nil {
+		for _, dimension := range []struct {
+			field string
+			value *float64
+		}{{"widthCm", d.WidthCm}, {"depthCm", d.DepthCm}, {"heightCm", d.HeightCm}} {
+			if dimension.value != nil && (*dimension.value <= 0 || *dimension.value > maxDimensionCm) {
+				return &FieldError{dimension.field, fmt.Sprintf("must be between 0 and %d cm", maxDimensionCm)}
+			}
+		}
+	}
+	if a.Condition != "" && !isOneOf(a.Condition, conditions) {
+		return &FieldError{"condition", "must be one of " + strings.Join(conditions, ", ")}
+	}
+	if a.Material != "" && !isOneOf(a.Material, materials) {
+		return &FieldError{"material", "must be one of " + strings.Join(materials, ", ")}
+	}
+	if a.Color != "" && !isOneOf(a.Color, colors) {
+		return &FieldError{"color", "must be one of " + strings.Join(colors, ", ")}
+	}
+	return nil
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// lengthUnits converts each accepted unit to centimetres.
+var lengthUnits = []struct {
+	suffix string
+	cm     float64
+}{
+	// Longer suffixes first so "cm" and "mm" are not read as "m"
+	{"mm", 0.1},
+	{"cm", 1},
+	{"in", 2.54},
+	{`"`, 2.54},
+	{"m", 100},
+}
+
+// parseLengthCm reads a length such as "180", "180 cm", "1,8 m",
+// "1800mm" or `70"`. Plain numbers are centimetres.
+func parseLengthCm(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	factor := 1.0
+	for _, unit := range lengthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, factor = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.cm
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+	// ParseFloat also accepts "NaN" and "Inf", which are not lengths
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n <= 0 {
+		return 0, fmt.Errorf("must be a positive length, e.g. 180 cm")
+	}
+	return n * factor, nil
+}
+
+// parseDimensionsCm reads "W×D×H" such as "180x90x75" or "1.8 x 0.9 x 0.75 m".
+// A unit after the last number applies to all three.
+func parseDimensionsCm(value string) (width, depth, height float64, err error) {
+	parts := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool { return r == 'x' || r == '×' || r == '*' })
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("must be width x depth x height, e.g. 180x90x75 cm")
+	}
+
+	// Carry a trailing unit over to the first two numbers
+	last := strings.TrimSpace(parts[2])
+	unit := strings.TrimLeft(last, "0123456789., ")
+	var cm [3]float64
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if i < 2 && unit != "" && strings.TrimLeft(part, "0123456789., ") == "" {
+			part += unit
+		}
+		if cm[i], err = parseLengthCm(part); err != nil {
+			return 0, 0, 0, fmt.Errorf("must be width x depth x height, e.g. 180x90x75 cm")
+		}
+	}
+	return cm[0], cm[1], cm[2], nil
+}
+
+// Query parameters of the dimension range filters and their columns.
+var dimensionFilters = []struct {
+	param  string
+	column string
+	op     string
+}{
+	{"minWidthCm", "width_cm", ">="},
+	{"maxWidthCm", "width_cm", "<="},
+	{"minDepthCm", "depth_cm", ">="},
+	{"maxDepthCm", "depth_cm", "<="},
+	{"minHeightCm", "height_cm", ">="},
+	{"maxHeightCm", "height_cm", "<="},
+}
+
+// attributeFilter adds the dimension ranges, the "fits in W×D×H" space and
+// the condition, material and color filters to q. Listings whose relevant
+// attribute is unknown never match.
+func attributeFilter(q *furnitureQuery, r *http.Request, skip string) error {
+	params := r.URL.Query()
+
+	for _, f := range dimensionFilters {
+		value := params.Get(f.param)
+		if value == "" {
+			continue
+		}
+		cm, err := parseLengthCm(value)
+		if err != nil {
+			return fmt.Errorf("%s %v", f.param, err)
+		}
+		q.where(f.column + " " + f.op + " " + q.arg(cm))
+	}
+
+	// The item may be turned around so its width runs along the space's depth
+	if fitsIn := params.Get("fitsIn"); fitsIn != "" {
+		width, depth, height, err := parseDimensionsCm(fitsIn)
+		if err != nil {
+			return fmt.Errorf("fitsIn %v", err)
+		}
+		w, d := q.arg(width), q.arg(depth)
+		q.where(fmt.Sprintf("height_cm <= %s AND ((width_cm <= %s AND depth_cm <= %s) OR (width_cm <= %s AND depth_cm <= %s))",
+			q.arg(height), w, d, d, w))
+	}
+
+	for _, f := range []struct {
+		param, column, dimension string
+		values                   []string
+	}{
+		{"condition", "condition", filterCondition, conditions},
+		{"material", "material", filterMaterial, materials},
+		{"color", "color", filterColor, colors},
+	} {
+		if skip == f.dimension || len(params[f.param]) == 0 {
+			continue
+		}
+		var selected []string
+		for _, value := range params[f.param] {
+			for _, part := range strings.Split(value, ",") {
+				if part = normalizeAttribute(part); part == "" {
+					continue
+				}
+				if !isOneOf(part, f.values) {
+					return fmt.Errorf("%s must be one of %s", f.param, strings.Join(f.values, ", "))
+				}
+				selected = append(selected, part)
+			}
+		}
+		if len(selected) > 0 {
+			q.where(f.column + " = ANY(" + q.arg(pq.Array(selected)) + ")")
+		}
+	}
+
+	return nil
+}
+
+// attributeOptionsHandler lists the accepted condition, material and color
+// values for forms and filters.
+func attributeOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respondWithJSON(w, AttributeOptionsResponse{
+		Conditions: conditions,
+		Materials:  materials,
+		Colors:     colors,
+	}, http.StatusOK)
+}
+
+// furnitureAttributesHandler lets a seller replace the physical attributes
+// of their listing.
+func furnitureAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	var sellerID *int
+	err = db.QueryRow("SELECT user_id FROM furniture WHERE id = $1", id).Scan(&sellerID)
+	if err == sql.ErrNoRows || (err == nil && (sellerID == nil || *sellerID != userID)) {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+
+	var req PhysicalAttributes
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.normalize()
+	if fieldErr := req.validate(); fieldErr != nil {
+		respondWithError(w, fieldErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := append([]interface{}{id}, req.columnValues()...)
+	err = withRevisionActor(r.Context(), userID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE furniture SET width_cm = $2, depth_cm = $3, height_cm = $4, condition = $5, material = $6, color = $7,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`, args...); err != nil {
+			return err
+		}
+		return dispatchListingUpdated(r.Context(), tx, id)
+	})
+	if err != nil {
+		respondWithError(w, "Error updating furniture", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, req, http.StatusOK)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLengthCm(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"180", 180},
+		{"180 cm", 180},
+		{" 180 CM ", 180},
+		{"1,8 m", 180},
+		{"1.8m", 180},
+		{"1800mm", 180},
+		{`70"`, 177.8},
+		{"27 in", 68.58},
+		{"0.5", 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseLengthCm(tt.value)
+			if err != nil {
+				t.Fatalf("parseLengthCm(%q) error: %v", tt.value, err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("parseLengthCm(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLengthCmErrors(t *testing.T) {
+	for _, value := range []string{"", "cm", "abc", "0", "-5 cm", "1e400", "NaN", "nan cm", "Inf", "-inf", "+Infinity m"} {
+		t.Run(value, func(t *testing.T) {
+			if got, err := parseLengthCm(value); err == nil {
+				t.Errorf("parseLengthCm(%q) = %v, want an error", value, got)
+			}
+		})
+	}
+}
+
+func TestParseDimensionsCm(t *testing.T) {
+	tests := []struct {
+		value                string
+		width, depth, height float64
+	}{
+		{"180x90x75", 180, 90, 75},
+		{"180 x 90 x 75 cm", 180, 90, 75},
+		{"180×90×75", 180, 90, 75},
+		{"180*90*75", 180, 90, 75},
+		{"1.8 x 0.9 x 0.75 m", 180, 90, 75},
+		{"1,8X0,9X0,75M", 180, 90, 75},
+		{"2 m x 90 x 75", 200, 90, 75},
+		{"1800mm x 90cm x 0.75m", 180, 90, 75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			width, depth, height, err := parseDimensionsCm(tt.value)
+			if err != nil {
+				t.Fatalf("parseDimensionsCm(%q) error: %v", tt.value, err)
+			}
+			for _, c := range []struct {
+				name      string
+				got, want float64
+			}{{"width", width, tt.width}, {"depth", depth, tt.depth}, {"height", height, tt.height}} {
+				if math.Abs(c.got-c.want) > 1e-9 {
+					t.Errorf("parseDimensionsCm(%q) %s = %v, want %v", tt.value, c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDimensionsCmErrors(t *testing.T) {
+	for _, value := range []string{"", "180", "180x90", "180x90x75x10", "180xx75", "180x0x75", "180xNaNx75", "180x90xinf", "ax b x c"} {
+		t.Run(value, func(t *testing.T) {
+			if w, d, h, err := parseDimensionsCm(value); err == nil {
+				t.Errorf("parseDimensionsCm(%q) = %v, %v, %v, want an error", value, w, d, h)
+			}
+		})
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Auction statuses. Open auctions accept bids until they end; the worker
+// then closes them and determines the winner.
+const (
+	AuctionOpen   = "open"
+	AuctionClosed = "closed"
+)
+
+const (
+	defaultBidIncrement = 5
+	minAuctionDuration  = time.Hour
+	maxAuctionDuration  = 30 * 24 * time.Hour
+	// auctionExtension is the anti-sniping rule: a bid in the last minutes
+	// pushes the end back so others can respond.
+	auctionExtension    = 2 * time.Minute
+	auctionPollInterval = 15 * time.Second
+	maxAuctionBidsShown = 50
+)
+
+// runningAuctionSQL is true for a furniture row whose auction is still
+// open; the import keeps such a listing's offer type and current bid.
+const runningAuctionSQL = "EXISTS (SELECT 1 FROM auctions WHERE auctions.furniture_id = furniture.id AND auctions.status = 'open')"
+
+type AuctionSettings struct {
+	StartPrice   float64   `json:"startPrice"`
+	ReservePrice *float64  `json:"reservePrice,omitempty"`
+	BidIncrement float64   `json:"bidIncrement"`
+	EndsAt       time.Time `json:"endsAt"`
+}
+
+type AuctionBid struct {
+	Amount float64 `json:"amount"`
+	// Bidder is "Bidder 1", "Bidder 2", ... in order of their first bid, so
+	// the history can be followed without revealing who bid
+	Bidder    string    `json:"bidder"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type Auction struct {
+	FurnitureID  int       `json:"furnitureId"`
+	StartPrice   float64   `json:"startPrice"`
+	BidIncrement float64   `json:"bidIncrement"`
+	CurrentBid   *float64  `json:"currentBid,omitempty"`
+	MinimumBid   float64   `json:"minimumBid"`
+	BidCount     int       `json:"bidCount"`
+	HasReserve   bool      `json:"hasReserve"`
+	ReserveMet   bool      `json:"reserveMet"`
+	EndsAt       time.Time `json:"endsAt"`
+	// Extended is set once late bids have pushed EndsAt back
+	Extended bool         `json:"extended"`
+	Status   string       `json:"status"`
+	Sold     bool         `json:"sold"`
+	Bids     []AuctionBid `json:"bids"`
+
+	sellerID      *int
+	reservePrice  *float64
+	highBidderID  *int
+	winnerID      *int
+	originalEndAt time.Time
+}
+
+type BidRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+func initAuctionTables() error {
+	createAuctionTablesSQL := `
+	CREATE TABLE IF NOT EXISTS auctions (
+		furniture_id INTEGER PRIMARY KEY REFERENCES furniture(id) ON DELETE CASCADE,
+		start_price DECIMAL(10, 2) NOT NULL,
+		reserve_price DECIMAL(10, 2),
+		bid_increment DECIMAL(10, 2) NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		original_ends_at TIMESTAMPTZ NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		winner_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		closed_at TIMESTAMPTZ,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS auctions_open_idx ON auctions (ends_at) WHERE status = 'open';
+	CREATE TABLE IF NOT EXISTS auction_bids (
+		id SERIAL PRIMARY KEY,
+		furniture_id INTEGER NOT NULL REFERENCES auctions(furniture_id) ON DELETE CASCADE,
+		bidder_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount DECIMAL(10, 2) NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS auction_bids_furniture_idx ON auction_bids (furniture_id, amount DESC);`
+
+	if _, err := db.Exec(createAuctionTablesSQL); err != nil {
+		return fmt.Errorf("failed to create auction tables: %w", err)
+	}
+
+	return nil
+}
+
+// loadAuction reads an auction and its highest bid. Pass a transaction and
+// forUpdate to lock the auction while bidding or closing it.
+func loadAuction(ctx context.Context, q querier, furnitureID int, forUpdate bool) (Auction, error) {
+	a := Auction{FurnitureID: furnitureID}
+	query := `
+		SELECT f.user_id, a.start_price, a.reserve_price, a.bid_increment, a.ends_at, a.original_ends_at, a.status, a.winner_id,
+			(SELECT COUNT(*) FROM auction_bids WHERE furniture_id = a.furniture_id)
+		FROM auctions a JOIN furniture f ON f.id = a.furniture_id
+		WHERE a.furniture_id = $1`
+	if forUpdate {
+		query += " FOR UPDATE OF a"
+	}
+	err := q.QueryRowContext(ctx, query, furnitureID).Scan(&a.sellerID, &a.StartPrice, &a.reservePrice, &a.BidIncrement,
+		&a.EndsAt, &a.originalEndAt, &a.Status, &a.winnerID, &a.BidCount)
+	if err != nil {
+		return a, err
+	}
+
+	var amount float64
+	var bidderID int
+	err = q.QueryRowContext(ctx, `
+		SELECT amount, bidder_id FROM auction_bids WHERE furniture_id = $1 ORDER BY amount DESC, id LIMIT 1`, furnitureID).
+		Scan(&amount, &bidderID)
+	if err != nil && err != sql.ErrNoRows {
+		return a, err
+	}
+	if err == nil {
+		a.CurrentBid, a.highBidderID = &amount, &bidderID
+	}
+
+	a.HasReserve = a.reservePrice != nil
+	a.ReserveMet = !a.HasReserve || (a.CurrentBid != nil && *a.CurrentBid >= *a.reservePrice)
+	a.Sold = a.winnerID != nil
+	a.Extended = a.EndsAt.After(a.originalEndAt)
+	a.MinimumBid = a.StartPrice
+	if a.CurrentBid != nil {
+		a.MinimumBid = math.Round((*a.CurrentBid+a.BidIncrement)*100) / 100
+	}
+	return a, nil
+}
+
+// loadAuctionBids fills in the most recent bids with anonymous bidder names.
+func (a *Auction) loadAuctionBids(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT bidder_id, amount, created_at FROM auction_bids WHERE furniture_id = $1 ORDER BY id`, a.FurnitureID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	aliases := make(map[int]string)
+	var bids []AuctionBid
+	for rows.Next() {
+		var bidderID int
+		var bid AuctionBid
+		if err := rows.Scan(&bidderID, &bid.Amount, &bid.CreatedAt); err != nil {
+			return err
+		}
+		if _, ok := aliases[bidderID]; !ok {
+			aliases[bidderID] = fmt.Sprintf("Bidder %d", len(aliases)+1)
+		}
+		bid.Bidder = aliases[bidderID]
+		bids = append(bids, bid)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Newest first
+	a.Bids = []AuctionBid{}
+	for i := len(bids) - 1; i >= 0 && len(a.Bids) < maxAuctionBidsShown; i-- {
+		a.Bids = append(a.Bids, bids[i])
+	}
+	return nil
+}
+
+// auctionHandler shows an auction (GET). The listing's seller starts or
+// reschedules it (PUT) and cancels it while nobody has bid (DELETE).
+func auctionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		auction, err := loadAuction(r.Context(), db, id, false)
+		if err == sql.ErrNoRows {
+			respondWithError(w, "Auction not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = auction.loadAuctionBids(r.Context())
+		}
+		if err != nil {
+			respondWithError(w, "Error fetching auction", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, auction, http.StatusOK)
+
+	case "PUT", "DELETE":
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			manageAuction(w, r, id)
+		})(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func manageAuction(w http.ResponseWriter, r *http.Request, id int) {
+	userID := r.Context().Value(userIDKey).(int)
+	ctx := r.Context()
+
+	var req AuctionSettings
+	if r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.BidIncrement == 0 {
+			req.BidIncrement = defaultBidIncrement
+		}
+		now := time.Now()
+		switch {
+		case req.StartPrice <= 0 || req.StartPrice > maxListingPrice:
+			respondWithError(w, fmt.Sprintf("startPrice must be between 0 and %.2f", maxListingPrice), http.StatusBadRequest)
+			return
+		case req.ReservePrice != nil && *req.ReservePrice < req.StartPrice:
+			respondWithError(w, "reservePrice must not be below startPrice", http.StatusBadRequest)
+			return
+		case req.ReservePrice != nil && *req.ReservePrice > maxListingPrice:
+			respondWithError(w, fmt.Sprintf("reservePrice must be at most %.2f", maxListingPrice), http.StatusBadRequest)
+			return
+		case req.BidIncrement < 0 || req.BidIncrement > maxListingPrice:
+			respondWithError(w, fmt.Sprintf("bidIncrement must be between 0 and %.2f", maxListingPrice), http.StatusBadRequest)
+			return
+		case req.EndsAt.Before(now.Add(minAuctionDuration)) || req.EndsAt.After(now.Add(maxAuctionDuration)):
+			respondWithError(w, "endsAt must be between 1 hour and 30 days from now", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(w, "Error updating auction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := setRevisionActor(ctx, tx, userID); err != nil {
+		respondWithError(w, "Error updating auction", http.StatusInternalServerError)
+		return
+	}
+
+	var sellerID *int
+	var offerType string
+	var removed bool
+	err = tx.QueryRowContext(ctx, "SELECT user_id, offer_type, removed_at IS NOT NULL FROM furniture WHERE id = $1 FOR UPDATE", id).
+		Scan(&sellerID, &offerType, &removed)
+	if err == sql.ErrNoRows || (err == nil && (sellerID == nil || *sellerID != userID)) {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	if removed {
+		respondWithError(w, "Listings removed by moderators cannot be auctioned", http.StatusConflict)
+		return
+	}
+
+	auction, err := loadAuction(ctx, tx, id, true)
+	hasAuction := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, "Error fetching auction", http.StatusInternalServerError)
+		return
+	}
+	// Bids bind the seller while the auction runs, but one that ended
+	// without a winner can be restarted or cancelled
+	if hasAuction && auction.winnerID != nil {
+		respondWithError(w, "A sold auction cannot be changed", http.StatusConflict)
+		return
+	}
+	if hasAuction && auction.Status == AuctionOpen && auction.BidCount > 0 {
+		respondWithError(w, "An auction cannot be changed once bidding has started", http.StatusConflict)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if !hasAuction {
+			respondWithError(w, "Auction not found", http.StatusNotFound)
+			return
+		}
+		// The listing goes back to a fixed price at the start price, not at
+		// the highest bid it tracked during the auction
+		_, err = tx.ExecContext(ctx, "DELETE FROM auctions WHERE furniture_id = $1", id)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE furniture SET offer_type = $2, price = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+				id, OfferTypeSell, auction.StartPrice)
+		}
+		if err == nil {
+			err = dispatchListingUpdated(ctx, tx, id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			respondWithError(w, "Error cancelling auction", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, Response{Message: "Auction cancelled"}, http.StatusOK)
+		return
+	}
+
+	if !hasAuction {
+		var busy bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM furniture_reservations WHERE furniture_id = $1 AND status IN ($2, $3))
+				OR EXISTS (SELECT 1 FROM bundle_items bi JOIN bundles b ON b.id = bi.bundle_id WHERE bi.furniture_id = $1 AND b.status = $4)`,
+			id, ReservationPending, ReservationAccepted, BundleActive).Scan(&busy)
+		if err != nil {
+			respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+			return
+		}
+		if busy {
+			respondWithError(w, "Listings with reservations or in a bundle cannot be auctioned", http.StatusConflict)
+			return
+		}
+	}
+
+	// A restarted auction starts over without the bids of the last one
+	if hasAuction {
+		_, err = tx.ExecContext(ctx, "DELETE FROM auction_bids WHERE furniture_id = $1", id)
+		if err != nil {
+			respondWithError(w, "Error updating auction", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO auctions (furniture_id, start_price, reserve_price, bid_increment, ends_at, original_ends_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (furniture_id) DO UPDATE SET
+			start_price = EXCLUDED.start_price,
+			reserve_price = EXCLUDED.reserve_price,
+			bid_increment = EXCLUDED.bid_increment,
+			ends_at = EXCLUDED.ends_at,
+			original_ends_at = EXCLUDED.original_ends_at,
+			status = 'open',
+			winner_id = NULL,
+			closed_at = NULL`,
+		id, req.StartPrice, req.ReservePrice, req.BidIncrement, req.EndsAt)
+	if err == nil {
+		// The listing price tracks the current bid, starting at the start
+		// price, and the listing stays up at least until the auction ends
+		_, err = tx.ExecContext(ctx, `
+			UPDATE furniture SET offer_type = $2, price = $3, expires_at = GREATEST(expires_at, $4), archived_at = NULL,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			id, OfferTypeAuction, req.StartPrice, req.EndsAt)
+	}
+	if err == nil {
+		err = dispatchListingUpdated(ctx, tx, id)
+	}
+	if err == nil {
+		auction, err = loadAuction(ctx, tx, id, false)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, "Error updating auction", http.StatusInternalServerError)
+		return
+	}
+
+	auction.Bids = []AuctionBid{}
+	status := http.StatusOK
+	if !hasAuction {
+		status = http.StatusCreated
+	}
+	respondWithJSON(w, auction, status)
+}
+
+// auctionBidsHandler lists an auction's bids (GET) and places a bid (POST).
+func auctionBidsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+			return
+		}
+		auction := Auction{FurnitureID: id}
+		if err := auction.loadAuctionBids(r.Context()); err != nil {
+			respondWithError(w, "Error fetching bids", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, map[string]interface{}{"bids": auction.Bids, "total": len(auction.Bids)}, http.StatusOK)
+
+	case "POST":
+		authMiddleware(placeBidHandler)(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// placeBidHandler places a bid. The auction row is locked for the whole
+// check-and-insert, so concurrent bids are applied one at a time and each
+// is validated against the bid before it.
+func placeBidHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	ctx := r.Context()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	var req BidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Amount = math.Round(req.Amount*100) / 100
+	if req.Amount > maxListingPrice {
+		respondWithError(w, fmt.Sprintf("amount must be at most %.2f", maxListingPrice), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	auction, err := loadAuction(ctx, tx, id, true)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Auction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching auction", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case auction.Status != AuctionOpen || !now.Before(auction.EndsAt):
+		respondWithError(w, "This auction has ended", http.StatusConflict)
+		return
+	case auction.sellerID != nil && *auction.sellerID == userID:
+		respondWithError(w, "You cannot bid on your own auction", http.StatusBadRequest)
+		return
+	case auction.highBidderID != nil && *auction.highBidderID == userID:
+		respondWithError(w, "You already have the highest bid", http.StatusConflict)
+		return
+	case req.Amount < auction.MinimumBid:
+		respondWithError(w, fmt.Sprintf("Bid must be at least %.2f", auction.MinimumBid), http.StatusConflict)
+		return
+	}
+
+	previousBidderID := auction.highBidderID
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO auction_bids (furniture_id, bidder_id, amount) VALUES ($1, $2, $3)`, id, userID, req.Amount); err != nil {
+		respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+		return
+	}
+
+	if auction.EndsAt.Sub(now) < auctionExtension {
+		auction.EndsAt = now.Add(auctionExtension)
+		if _, err := tx.ExecContext(ctx, "UPDATE auctions SET ends_at = $2 WHERE furniture_id = $1", id, auction.EndsAt); err != nil {
+			respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE furniture SET price = $2, expires_at = GREATEST(expires_at, $3), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, id, req.Amount, auction.EndsAt); err != nil {
+		respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+		return
+	}
+	if err := dispatchListingUpdated(ctx, tx, id); err != nil {
+		respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+		return
+	}
+
+	auction, err = loadAuction(ctx, tx, id, false)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, "Error placing bid", http.StatusInternalServerError)
+		return
+	}
+
+	var title string
+	if err := db.QueryRowContext(ctx, "SELECT title FROM furniture WHERE id = $1", id).Scan(&title); err != nil {
+		log.Printf("Error fetching furniture %d for bid notifications: %v", id, err)
+	}
+	data := map[string]interface{}{"furnitureId": id, "amount": req.Amount, "endsAt": auction.EndsAt}
+	if previousBidderID != nil {
+		notifyAuction(ctx, *previousBidderID, "You have been outbid",
+			fmt.Sprintf("Someone bid %.2f PLN on %s.", req.Amount, title), data)
+	}
+	if auction.sellerID != nil {
+		notifyAuction(ctx, *auction.sellerID, "New bid",
+			fmt.Sprintf("%s received a bid of %.2f PLN.", title, req.Amount), data)
+	}
+
+	if err := auction.loadAuctionBids(ctx); err != nil {
+		log.Printf("Error fetching bids of auction %d: %v", id, err)
+	}
+	respondWithJSON(w, auction, http.StatusCreated)
+}
+
+// notifyAuction sends an auction notification. Bids and results are
+// already saved, so failures are only logged.
+func notifyAuction(ctx context.Context, userID int, title, body string, data map[string]interface{}) {
+	err := Notify(ctx, userID, NotificationEvent{Type: NotificationAuction, Title: title, Body: body, Data: data})
+	if err != nil {
+		log.Printf("Error notifying user %d about auction %v: %v", userID, data["furnitureId"], err)
+	}
+}
+
+func runAuctionWorker(ctx context.Context) {
+	ticker := time.NewTicker(auctionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := closeEndedAuctions(ctx); err != nil {
+			log.Printf("Error closing auctions: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type auctionResult struct {
+	furnitureID int
+	title       string
+	sellerID    *int
+	winnerID    *int
+	amount      *float64
+	reserveMet  bool
+	broken      []brokenBundle
+}
+
+// closeEndedAuctions closes auctions past their end. The highest bid wins
+// if it meets the reserve, and the winner gets an accepted reservation so
+// the usual address sharing and pickup scheduling apply.
+func closeEndedAuctions(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED keeps the worker from waiting on a bid in progress
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.furniture_id, f.title FROM auctions a JOIN furniture f ON f.id = a.furniture_id
+		WHERE a.status = $1 AND a.ends_at <= CURRENT_TIMESTAMP
+		ORDER BY a.ends_at
+		LIMIT 50
+		FOR UPDATE OF a SKIP LOCKED`, AuctionOpen)
+	if err != nil {
+		return err
+	}
+	var results []auctionResult
+	for rows.Next() {
+		var result auctionResult
+		if err := rows.Scan(&result.furnitureID, &result.title); err != nil {
+			rows.Close()
+			return err
+		}
+		results = append(results, result)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range results {
+		result := &results[i]
+		auction, err := loadAuction(ctx, tx, result.furnitureID, false)
+		if err != nil {
+			return err
+		}
+		result.sellerID, result.amount, result.reserveMet = auction.sellerID, auction.CurrentBid, auction.ReserveMet
+		if auction.CurrentBid != nil && auction.ReserveMet {
+			result.winnerID = auction.highBidderID
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE auctions SET status = $2, winner_id = $3, closed_at = CURRENT_TIMESTAMP WHERE furniture_id = $1`,
+			result.furnitureID, AuctionClosed, result.winnerID); err != nil {
+			return err
+		}
+		if result.winnerID != nil {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO furniture_reservations (furniture_id, buyer_id, status, message) VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING`,
+				result.furnitureID, *result.winnerID, ReservationAccepted, "Won at auction"); err != nil {
+				return err
+			}
+			if err := dispatchListingSold(ctx, tx, result.furnitureID, SoldViaAuction); err != nil {
+				return err
+			}
+			if result.broken, err = breakBundles(ctx, tx, result.furnitureID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		for _, b := range result.broken {
+			notifyBundleCancelled(ctx, b.buyers, b.id, b.title)
+		}
+
+		data := map[string]interface{}{"furnitureId": result.furnitureID}
+		if result.amount != nil {
+			data["amount"] = *result.amount
+		}
+		switch {
+		case result.winnerID != nil:
+			notifyAuction(ctx, *result.winnerID, "You won the auction",
+				fmt.Sprintf("You won %s for %.2f PLN.", result.title, *result.amount), data)
+			if result.sellerID != nil {
+				notifyAuction(ctx, *result.sellerID, "Auction sold",
+					fmt.Sprintf("%s sold for %.2f PLN.", result.title, *result.amount), data)
+			}
+		case result.sellerID != nil && result.amount != nil:
+			notifyAuction(ctx, *result.sellerID, "Auction ended below reserve",
+				fmt.Sprintf("The highest bid on %s did not meet your reserve price.", result.title), data)
+		case result.sellerID != nil:
+			notifyAuction(ctx, *result.sellerID, "Auction ended without bids",
+				fmt.Sprintf("Nobody bid on %s.", result.title), data)
+		}
+	}
+
+	return nil
+}
@@ -14,6 +14,7 @@ type SignupRequest struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Locale   string `json:"locale,omitempty"`
 }
 
 type LoginRequest struct {
@@ -76,15 +77,34 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert new user
+	// Insert new user and queue the welcome email atomically
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	locale := normalizeLocale(req.Locale)
 	var userID int
-	err = db.QueryRow("INSERT INTO users (email, password, name) VALUES ($1, $2, $3) RETURNING id", 
-		req.Email, string(hashedPassword), req.Name).Scan(&userID)
+	err = tx.QueryRow("INSERT INTO users (email, password, name, locale) VALUES ($1, $2, $3, $4) RETURNING id",
+		req.Email, string(hashedPassword), req.Name, locale).Scan(&userID)
 	if err != nil {
 		respondWithError(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
+	welcome := map[string]string{"Name": req.Name, "Email": req.Email}
+	if err = enqueueEmail(r.Context(), tx, req.Email, "welcome", locale, welcome); err != nil {
+		respondWithError(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondWithError(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
 	// Generate JWT token
 	token, err := generateToken(userID, req.Email)
 	if err != nil {
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Bundle statuses. A bundle breaks for good once one of its items is sold
+// on its own; the items stay listed individually either way.
+const (
+	BundleActive = "active"
+	BundleBroken = "broken"
+)
+
+const (
+	minBundleItems = 2
+	maxBundleItems = 20
+)
+
+type Bundle struct {
+	ID          int     `json:"id"`
+	SellerID    int     `json:"sellerId"`
+	Seller      string  `json:"seller"`
+	Title       string  `json:"title"`
+	Description string  `json:"description,omitempty"`
+	Price       float64 `json:"price"`
+	// ItemsTotal is what the items cost separately; it is omitted when an
+	// item has no price yet, and so is Savings
+	ItemsTotal *float64    `json:"itemsTotal,omitempty"`
+	Savings    *float64    `json:"savings,omitempty"`
+	Status     string      `json:"status"`
+	Items      []Furniture `json:"items"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+
+	itemIDs []int64
+}
+
+type BundleRequest struct {
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	Price        float64 `json:"price"`
+	FurnitureIDs []int   `json:"furnitureIds"`
+}
+
+type UpdateBundleRequest struct {
+	Title       *string  `json:"title"`
+	Description *string  `json:"description"`
+	Price       *float64 `json:"price"`
+}
+
+type BundleListResponse struct {
+	Bundles []Bundle `json:"bundles"`
+	Total   int      `json:"total"`
+	Page    int      `json:"page"`
+	Limit   int      `json:"limit"`
+}
+
+func initBundleTables() error {
+	createBundleTablesSQL := `
+	CREATE TABLE IF NOT EXISTS bundles (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		price DECIMAL(10, 2) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS bundles_active_idx ON bundles (created_at DESC) WHERE status = 'active';
+	CREATE TABLE IF NOT EXISTS bundle_items (
+		bundle_id INTEGER NOT NULL REFERENCES bundles(id) ON DELETE CASCADE,
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		PRIMARY KEY (bundle_id, furniture_id)
+	);
+	CREATE INDEX IF NOT EXISTS bundle_items_furniture_idx ON bundle_items (furniture_id);
+	ALTER TABLE furniture_reservations ADD COLUMN IF NOT EXISTS bundle_id INTEGER REFERENCES bundles(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS furniture_reservations_bundle_idx ON furniture_reservations (bundle_id) WHERE bundle_id IS NOT NULL;`
+
+	if _, err := db.Exec(createBundleTablesSQL); err != nil {
+		return fmt.Errorf("failed to create bundle tables: %w", err)
+	}
+
+	return nil
+}
+
+// bundleIDColumn selects the active bundle a listing belongs to, if any.
+const bundleIDColumn = `(SELECT bi.bundle_id FROM bundle_items bi JOIN bundles b ON b.id = bi.bundle_id
+	WHERE bi.furniture_id = furniture.id AND b.status = 'active' LIMIT 1)`
+
+const bundleSelectSQL = `
+	SELECT b.id, b.user_id, u.name, b.title, b.description, b.price, b.status, b.created_at, b.updated_at,
+		ARRAY(SELECT furniture_id FROM bundle_items WHERE bundle_id = b.id ORDER BY furniture_id)
+	FROM bundles b
+	JOIN users u ON u.id = b.user_id`
+
+// queryBundles runs a bundleSelectSQL query and loads every bundle's items.
+func queryBundles(query string, args ...interface{}) ([]Bundle, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles := []Bundle{}
+	var ids []int64
+	for rows.Next() {
+		var b Bundle
+		if err := rows.Scan(&b.ID, &b.SellerID, &b.Seller, &b.Title, &b.Description, &b.Price, &b.Status,
+			&b.CreatedAt, &b.UpdatedAt, pq.Array(&b.itemIDs)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bundles = append(bundles, b)
+		ids = append(ids, b.itemIDs...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	items, err := furnitureByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bundles {
+		bundles[i].withItems(items)
+	}
+	return bundles, nil
+}
+
+// withItems attaches the bundle's listings and prices them separately.
+func (b *Bundle) withItems(items map[int]Furniture) {
+	b.Items = []Furniture{}
+	total, priced := 0.0, true
+	for _, id := range b.itemIDs {
+		item, ok := items[int(id)]
+		if !ok {
+			continue
+		}
+		b.Items = append(b.Items, item)
+		if item.OfferType == OfferTypeSell && item.Price == nil {
+			priced = false
+		}
+		total += listingPrice(item)
+	}
+	if priced {
+		total = math.Round(total*100) / 100
+		savings := math.Round((total-b.Price)*100) / 100
+		b.ItemsTotal, b.Savings = &total, &savings
+	}
+}
+
+// bundlesHandler lists active bundles, newest first (GET), optionally for
+// one seller with ?sellerId=, and creates a bundle (POST, authenticated).
+func bundlesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, limit := parsePagination(r)
+		query := bundleSelectSQL + " WHERE b.status = $1"
+		args := []interface{}{BundleActive}
+		if sellerID := r.URL.Query().Get("sellerId"); sellerID != "" {
+			id, err := strconv.Atoi(sellerID)
+			if err != nil {
+				respondWithError(w, "Invalid seller id", http.StatusBadRequest)
+				return
+			}
+			query += " AND b.user_id = $2"
+			args = append(args, id)
+		}
+
+		var total int
+		countQuery := "SELECT COUNT(*) FROM (" + query + ") AS matching"
+		if err := db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+			respondWithError(w, "Error counting bundles", http.StatusInternalServerError)
+			return
+		}
+
+		query += fmt.Sprintf(" ORDER BY b.created_at DESC, b.id DESC LIMIT %d OFFSET %d", limit, (page-1)*limit)
+		bundles, err := queryBundles(query, args...)
+		if err != nil {
+			respondWithError(w, "Error fetching bundles", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, BundleListResponse{Bundles: bundles, Total: total, Page: page, Limit: limit}, http.StatusOK)
+
+	case "POST":
+		authMiddleware(createBundleHandler)(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createBundleHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	var req BundleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	req.Description = strings.TrimSpace(req.Description)
+
+	ids := make([]int64, 0, len(req.FurnitureIDs))
+	seen := make(map[int]bool)
+	for _, id := range req.FurnitureIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, int64(id))
+		}
+	}
+
+	switch {
+	case req.Title == "":
+		respondWithError(w, "Title is required", http.StatusBadRequest)
+		return
+	case len(req.Title) > 255:
+		respondWithError(w, "Title must be at most 255 characters", http.StatusBadRequest)
+		return
+	case len(req.Description) > 2000:
+		respondWithError(w, "Description must be at most 2000 characters", http.StatusBadRequest)
+		return
+	case req.Price < 0:
+		respondWithError(w, "Price must not be negative", http.StatusBadRequest)
+		return
+	case len(ids) < minBundleItems || len(ids) > maxBundleItems:
+		respondWithError(w, fmt.Sprintf("A bundle must have between %d and %d items", minBundleItems, maxBundleItems), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, "Error creating bundle", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the items so a concurrent bundle or sale cannot take one of them
+	var owned, bundled, sold, auctioned int
+	err = tx.QueryRow(`
+		WITH items AS (
+			SELECT id, offer_type FROM furniture WHERE id = ANY($1) AND user_id = $2 FOR UPDATE
+		)
+		SELECT
+			(SELECT COUNT(*) FROM items),
+			(SELECT COUNT(*) FROM bundle_items bi JOIN bundles b ON b.id = bi.bundle_id
+				WHERE bi.furniture_id IN (SELECT id FROM items) AND b.status = $3),
+			(SELECT COUNT(*) FROM furniture_reservations
+				WHERE furniture_id IN (SELECT id FROM items) AND status = $4),
+			(SELECT COUNT(*) FROM items WHERE offer_type = $5)`,
+		pq.Array(ids), userID, BundleActive, ReservationAccepted, OfferTypeAuction).Scan(&owned, &bundled, &sold, &auctioned)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case owned != len(ids):
+		respondWithError(w, "A bundle can only contain your own listings", http.StatusBadRequest)
+		return
+	case bundled > 0:
+		respondWithError(w, "One of the listings already belongs to another bundle", http.StatusConflict)
+		return
+	case sold > 0:
+		respondWithError(w, "One of the listings is already reserved by a buyer", http.StatusConflict)
+		return
+	case auctioned > 0:
+		respondWithError(w, "Auctioned listings cannot be bundled", http.StatusConflict)
+		return
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO bundles (user_id, title, description, price) VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, req.Title, req.Description, req.Price).Scan(&id)
+	if err != nil {
+		respondWithError(w, "Error creating bundle", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO bundle_items (bundle_id, furniture_id) SELECT $1, unnest($2::int[])", id, pq.Array(ids))
+	if err != nil {
+		respondWithError(w, "Error creating bundle", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, "Error creating bundle", http.StatusInternalServerError)
+		return
+	}
+
+	bundles, err := queryBundles(bundleSelectSQL+" WHERE b.id = $1", id)
+	if err != nil || len(bundles) == 0 {
+		respondWithError(w, "Error fetching bundle", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, bundles[0], http.StatusCreated)
+}
+
+// bundleHandler shows a bundle (GET) and lets its seller change the title,
+// description or price (PUT) or dissolve it (DELETE).
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid bundle id", http.StatusBadRequest)
+		return
+	}
+
+	bundles, err := queryBundles(bundleSelectSQL+" WHERE b.id = $1", id)
+	if err != nil {
+		respondWithError(w, "Error fetching bundle", http.StatusInternalServerError)
+		return
+	}
+	if len(bundles) == 0 {
+		respondWithError(w, "Bundle not found", http.StatusNotFound)
+		return
+	}
+	bundle := bundles[0]
+
+	switch r.Method {
+	case "GET":
+		respondWithJSON(w, bundle, http.StatusOK)
+
+	case "PUT", "DELETE":
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(userIDKey).(int) != bundle.SellerID {
+				respondWithError(w, "Bundle not found", http.StatusNotFound)
+				return
+			}
+			if r.Method == "PUT" {
+				updateBundle(w, r, bundle)
+			} else {
+				deleteBundle(w, r, bundle)
+			}
+		})(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func updateBundle(w http.ResponseWriter, r *http.Request, bundle Bundle) {
+	var req UpdateBundleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Title != nil {
+		bundle.Title = strings.TrimSpace(*req.Title)
+		if bundle.Title == "" || len(bundle.Title) > 255 {
+			respondWithError(w, "Title must be between 1 and 255 characters", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Description != nil {
+		bundle.Description = strings.TrimSpace(*req.Description)
+		if len(bundle.Description) > 2000 {
+			respondWithError(w, "Description must be at most 2000 characters", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Price != nil {
+		if *req.Price < 0 {
+			respondWithError(w, "Price must not be negative", http.StatusBadRequest)
+			return
+		}
+		bundle.Price = *req.Price
+	}
+
+	err := db.QueryRow(`
+		UPDATE bundles SET title = $2, description = $3, price = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 RETURNING updated_at`, bundle.ID, bundle.Title, bundle.Description, bundle.Price).Scan(&bundle.UpdatedAt)
+	if err != nil {
+		respondWithError(w, "Error updating bundle", http.StatusInternalServerError)
+		return
+	}
+
+	items := make(map[int]Furniture, len(bundle.Items))
+	for _, item := range bundle.Items {
+		items[item.ID] = item
+	}
+	bundle.withItems(items)
+	respondWithJSON(w, bundle, http.StatusOK)
+}
+
+// deleteBundle dissolves a bundle nobody has bought yet. Pending bundle
+// reservations are cancelled; the items stay listed.
+func deleteBundle(w http.ResponseWriter, r *http.Request, bundle Bundle) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, "Error deleting bundle", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var accepted bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM furniture_reservations WHERE bundle_id = $1 AND status = $2)`,
+		bundle.ID, ReservationAccepted).Scan(&accepted)
+	if err != nil {
+		respondWithError(w, "Error deleting bundle", http.StatusInternalServerError)
+		return
+	}
+	if accepted {
+		respondWithError(w, "A buyer's reservation of this bundle is accepted; cancel it first", http.StatusConflict)
+		return
+	}
+
+	buyers, err := cancelBundleReservations(r.Context(), tx, bundle.ID)
+	if err != nil {
+		respondWithError(w, "Error deleting bundle", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM bundles WHERE id = $1", bundle.ID); err != nil {
+		respondWithError(w, "Error deleting bundle", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, "Error deleting bundle", http.StatusInternalServerError)
+		return
+	}
+
+	notifyBundleCancelled(r.Context(), buyers, bundle.ID, bundle.Title)
+	respondWithJSON(w, Response{Message: "Bundle deleted"}, http.StatusOK)
+}
+
+// bundleReservationsHandler reserves every item of a bundle for the buyer
+// at once (POST) and lists the bundle's reservations for its seller (GET).
+func bundleReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid bundle id", http.StatusBadRequest)
+		return
+	}
+
+	bundles, err := queryBundles(bundleSelectSQL+" WHERE b.id = $1", id)
+	if err != nil {
+		respondWithError(w, "Error fetching bundle", http.StatusInternalServerError)
+		return
+	}
+	if len(bundles) == 0 {
+		respondWithError(w, "Bundle not found", http.StatusNotFound)
+		return
+	}
+	bundle := bundles[0]
+
+	switch r.Method {
+	case "GET":
+		if bundle.SellerID != userID {
+			respondWithError(w, "Bundle not found", http.StatusNotFound)
+			return
+		}
+		reservations, err := queryReservations(reservationSelectSQL+" WHERE r.bundle_id = $1 ORDER BY r.created_at DESC, r.id", id)
+		if err != nil {
+			respondWithError(w, "Error fetching reservations", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, ReservationListResponse{Reservations: reservations, Total: len(reservations)}, http.StatusOK)
+
+	case "POST":
+		if bundle.Status != BundleActive {
+			respondWithError(w, "This bundle is no longer available", http.StatusConflict)
+			return
+		}
+		if bundle.SellerID == userID {
+			respondWithError(w, "You cannot reserve your own bundle", http.StatusBadRequest)
+			return
+		}
+
+		var req ReservationRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				respondWithError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		req.Message = strings.TrimSpace(req.Message)
+		if len(req.Message) > 1000 {
+			respondWithError(w, "Message must be at most 1000 characters", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Re-check the status under lock; a sale may have broken the bundle
+		var status string
+		if err := tx.QueryRow("SELECT status FROM bundles WHERE id = $1 FOR UPDATE", id).Scan(&status); err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+		if status != BundleActive {
+			respondWithError(w, "This bundle is no longer available", http.StatusConflict)
+			return
+		}
+
+		// Every item must still be live; lock them so they cannot be removed
+		// or expire out from under the reservation
+		available, err := bundleItemsAvailable(r.Context(), tx, id)
+		if err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+		if !available {
+			respondWithError(w, "This bundle is no longer available", http.StatusConflict)
+			return
+		}
+
+		var reservationIDs []int
+		rows, err := tx.Query(`
+			INSERT INTO furniture_reservations (furniture_id, buyer_id, message, bundle_id)
+			SELECT furniture_id, $2, $3, $1 FROM bundle_items WHERE bundle_id = $1
+			RETURNING id`, id, userID, req.Message)
+		if err == nil {
+			for rows.Next() {
+				var reservationID int
+				if err = rows.Scan(&reservationID); err != nil {
+					break
+				}
+				reservationIDs = append(reservationIDs, reservationID)
+			}
+			rows.Close()
+			if err == nil {
+				err = rows.Err()
+			}
+		}
+		if isUniqueViolation(err) {
+			respondWithError(w, "You already have an active reservation for one of these items", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+		for _, reservationID := range reservationIDs {
+			if err := dispatchReservationCreated(r.Context(), tx, reservationID); err != nil {
+				respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+
+		reservations, err := queryReservations(reservationSelectSQL+" WHERE r.bundle_id = $1 AND r.buyer_id = $2 AND r.status = $3 ORDER BY r.id",
+			id, userID, ReservationPending)
+		if err != nil || len(reservations) == 0 {
+			respondWithError(w, "Error fetching reservations", http.StatusInternalServerError)
+			return
+		}
+
+		notifyReservation(r, bundle.SellerID, reservations[0], "New bundle reservation request",
+			fmt.Sprintf("%s would like to reserve the bundle %s.", reservations[0].BuyerName, bundle.Title))
+		respondWithJSON(w, ReservationListResponse{Reservations: reservations, Total: len(reservations)}, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cancelBundleReservations cancels the pending reservations of a bundle and
+// returns the buyers who held them.
+func cancelBundleReservations(ctx context.Context, q querier, bundleID int) ([]int, error) {
+	rows, err := q.QueryContext(ctx, `
+		UPDATE furniture_reservations SET status = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE bundle_id = $1 AND status = $3
+		RETURNING buyer_id`, bundleID, ReservationCancelled, ReservationPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buyers []int
+	seen := make(map[int]bool)
+	for rows.Next() {
+		var buyerID int
+		if err := rows.Scan(&buyerID); err != nil {
+			return nil, err
+		}
+		if !seen[buyerID] {
+			seen[buyerID] = true
+			buyers = append(buyers, buyerID)
+		}
+	}
+	return buyers, rows.Err()
+}
+
+type brokenBundle struct {
+	id     int
+	title  string
+	buyers []int
+}
+
+// breakBundles marks the active bundles containing a listing as broken once
+// the listing is sold on its own, and cancels their pending reservations.
+// It runs in the transaction that sells the listing, so a bundle can never
+// be reserved after its item is gone; the caller tells the buyers of the
+// returned bundles once that transaction commits.
+func breakBundles(ctx context.Context, q querier, furnitureID int) ([]brokenBundle, error) {
+	rows, err := q.QueryContext(ctx, `
+		UPDATE bundles SET status = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE status = $3 AND id IN (SELECT bundle_id FROM bundle_items WHERE furniture_id = $1)
+		RETURNING id, title`, furnitureID, BundleBroken, BundleActive)
+	if err != nil {
+		return nil, err
+	}
+	var broken []brokenBundle
+	for rows.Next() {
+		var b brokenBundle
+		if err := rows.Scan(&b.id, &b.title); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		broken = append(broken, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range broken {
+		if broken[i].buyers, err = cancelBundleReservations(ctx, q, broken[i].id); err != nil {
+			return nil, err
+		}
+	}
+	return broken, nil
+}
+
+// notifyBundleCancelled tells buyers their bundle reservation was cancelled
+// because the bundle is gone. Failures are only logged.
+func notifyBundleCancelled(ctx context.Context, buyers []int, bundleID int, title string) {
+	for _, buyerID := range buyers {
+		err := Notify(ctx, buyerID, NotificationEvent{
+			Type:  NotificationOffer,
+			Title: "Bundle no longer available",
+			Body:  fmt.Sprintf("The bundle %s is no longer available, so your reservation was cancelled.", title),
+			Data:  map[string]interface{}{"bundleId": bundleID, "status": ReservationCancelled},
+		})
+		if err != nil {
+			log.Printf("Error notifying user %d about bundle %d: %v", buyerID, bundleID, err)
+		}
+	}
+}
+
+// bundleItemsAvailable reports whether every listing in a bundle is live,
+// holding a share lock on them when q is a transaction.
+func bundleItemsAvailable(ctx context.Context, q querier, bundleID int) (bool, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT f.removed_at IS NULL AND f.expires_at > CURRENT_TIMESTAMP
+		FROM bundle_items bi JOIN furniture f ON f.id = bi.furniture_id
+		WHERE bi.bundle_id = $1
+		FOR SHARE OF f`, bundleID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	available := true
+	for rows.Next() {
+		var live bool
+		if err := rows.Scan(&live); err != nil {
+			return false, err
+		}
+		available = available && live
+	}
+	return available, rows.Err()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type Category struct {
+	ID       int         `json:"id"`
+	ParentID *int        `json:"parentId,omitempty"`
+	Slug     string      `json:"slug"`
+	NamePL   string      `json:"namePl"`
+	NameEN   string      `json:"nameEn"`
+	Count    int         `json:"count"`
+	Children []*Category `json:"children"`
+}
+
+type CategoriesResponse struct {
+	Categories []*Category `json:"categories"`
+}
+
+// fallbackCategory receives listings whose type cannot be inferred.
+const fallbackCategory = "other"
+
+// seedCategories is the managed taxonomy. Parents must precede children.
+var seedCategories = []struct {
+	slug, parent, namePL, nameEN string
+}{
+	{"seating", "", "Siedziska", "Seating"},
+	{"sofas", "seating", "Sofy", "Sofas"},
+	{"corner-sofas", "sofas", "Narożniki", "Corner sofas"},
+	{"armchairs", "seating", "Fotele", "Armchairs"},
+	{"chairs", "seating", "Krzesła", "Chairs"},
+	{"tables", "", "Stoły i biurka", "Tables and desks"},
+	{"dining-tables", "tables", "Stoły jadalniane", "Dining tables"},
+	{"coffee-tables", "tables", "Stoliki kawowe", "Coffee tables"},
+	{"bedside-tables", "tables", "Szafki nocne", "Bedside tables"},
+	{"desks", "tables", "Biurka", "Desks"},
+	{"storage", "", "Przechowywanie", "Storage"},
+	{"wardrobes", "storage", "Szafy", "Wardrobes"},
+	{"cabinets", "storage", "Szafki i komody", "Cabinets and dressers"},
+	{"kitchen-cabinets", "cabinets", "Szafki kuchenne", "Kitchen cabinets"},
+	{"bookshelves", "storage", "Regały", "Bookshelves"},
+	{"bedroom", "", "Sypialnia", "Bedroom"},
+	{"beds", "bedroom", "Łóżka", "Beds"},
+	{"lighting", "", "Oświetlenie", "Lighting"},
+	{fallbackCategory, "", "Inne", "Other"},
+}
+
+// legacyTagCategories maps the item-type tags used before categories existed
+// onto categories, for backfilling existing listings.
+var legacyTagCategories = map[string]string{
+	"Sofa":     "sofas",
+	"Chair":    "chairs",
+	"Table":    "tables",
+	"Desk":     "desks",
+	"Bed":      "beds",
+	"Wardrobe": "wardrobes",
+	"Cabinet":  "cabinets",
+	"Lighting": "lighting",
+}
+
+func initCategoryTables() error {
+	createCategoriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS categories (
+		id SERIAL PRIMARY KEY,
+		parent_id INTEGER REFERENCES categories(id) ON DELETE RESTRICT,
+		slug VARCHAR(100) UNIQUE NOT NULL,
+		name_pl VARCHAR(255) NOT NULL,
+		name_en VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0
+	);`
+
+	if _, err := db.Exec(createCategoriesTableSQL); err != nil {
+		return fmt.Errorf("failed to create categories table: %w", err)
+	}
+
+	for position, c := range seedCategories {
+		_, err := db.Exec(`
+			INSERT INTO categories (parent_id, slug, name_pl, name_en, position)
+			VALUES ((SELECT id FROM categories WHERE slug = $1), $2, $3, $4, $5)
+			ON CONFLICT (slug) DO NOTHING`,
+			c.parent, c.slug, c.namePL, c.nameEN, position)
+		if err != nil {
+			return fmt.Errorf("failed to seed category %s: %w", c.slug, err)
+		}
+	}
+
+	if _, err := db.Exec("ALTER TABLE furniture ADD COLUMN IF NOT EXISTS category_id INTEGER REFERENCES categories(id)"); err != nil {
+		return fmt.Errorf("failed to add furniture category column: %w", err)
+	}
+
+	for tag, slug := range legacyTagCategories {
+		_, err := db.Exec(`
+			UPDATE furniture SET category_id = (SELECT id FROM categories WHERE slug = $2)
+			WHERE category_id IS NULL AND $1 = ANY(tags)`, tag, slug)
+		if err != nil {
+			return fmt.Errorf("failed to backfill furniture categories: %w", err)
+		}
+	}
+
+	backfillSQL := `
+	UPDATE furniture SET category_id = (SELECT id FROM categories WHERE slug = $1) WHERE category_id IS NULL;`
+
+	if _, err := db.Exec(backfillSQL, fallbackCategory); err != nil {
+		return fmt.Errorf("failed to backfill furniture categories: %w", err)
+	}
+
+	if _, err := db.Exec("ALTER TABLE furniture ALTER COLUMN category_id SET NOT NULL"); err != nil {
+		return fmt.Errorf("failed to require furniture category: %w", err)
+	}
+
+	return nil
+}
+
+// categoryFilter restricts q to listings in the category identified by slug
+// or any of its descendants.
+func categoryFilter(q *furnitureQuery, slug string) {
+	q.where(fmt.Sprintf(`category_id IN (
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE slug = %s
+			UNION ALL
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT id FROM subtree)`, q.arg(slug)))
+}
+
+// categoryIDsBySlug returns every category keyed by slug, for validating
+// listings that reference categories by name.
+func categoryIDsBySlug() (map[string]int, error) {
+	rows, err := db.Query("SELECT id, slug FROM categories")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var slug string
+		if err := rows.Scan(&id, &slug); err != nil {
+			return nil, err
+		}
+		ids[slug] = id
+	}
+	return ids, rows.Err()
+}
+
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Counts honour the same filters as the listing endpoint, so the tree
+	// reflects what the user would actually find.
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := `
+		SELECT c.id, c.parent_id, c.slug, c.name_pl, c.name_en, COALESCE(f.count, 0)
+		FROM categories c
+		LEFT JOIN (
+			SELECT category_id, COUNT(*) AS count FROM furniture` + q.whereClause() + `
+			GROUP BY category_id
+		) f ON f.category_id = c.id
+		ORDER BY c.position, c.id`
+
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		respondWithError(w, "Error fetching categories", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var all []*Category
+	byID := make(map[int]*Category)
+	for rows.Next() {
+		c := &Category{Children: []*Category{}}
+		var parentID *int
+		if err := rows.Scan(&c.ID, &parentID, &c.Slug, &c.NamePL, &c.NameEN, &c.Count); err != nil {
+			respondWithError(w, "Error scanning category data", http.StatusInternalServerError)
+			return
+		}
+		c.ParentID = parentID
+		all = append(all, c)
+		byID[c.ID] = c
+	}
+
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating category data", http.StatusInternalServerError)
+		return
+	}
+
+	roots := []*Category{}
+	for _, c := range all {
+		if c.ParentID == nil {
+			roots = append(roots, c)
+		} else if parent, ok := byID[*c.ParentID]; ok {
+			parent.Children = append(parent.Children, c)
+		}
+	}
+
+	for _, root := range roots {
+		sumCategoryCounts(root)
+	}
+
+	respondWithJSON(w, CategoriesResponse{Categories: roots}, http.StatusOK)
+}
+
+// sumCategoryCounts rolls descendant listing counts up into each parent.
+func sumCategoryCounts(c *Category) int {
+	for _, child := range c.Children {
+		c.Count += sumCategoryCounts(child)
+	}
+	return c.Count
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Delivery methods a seller can offer. Pickup is the buyer collecting the
+// item, own delivery is the seller driving it within a radius, and courier
+// ships anywhere in Poland.
+const (
+	DeliveryPickup  = "pickup"
+	DeliveryOwn     = "own"
+	DeliveryCourier = "courier"
+)
+
+const (
+	maxDeliveryRadiusKm = 500
+	// maxDeliveryFeePerKm is the largest fee delivery_fee_per_km holds
+	maxDeliveryFeePerKm = 999999.99
+)
+
+type DeliveryOptions struct {
+	Pickup      bool             `json:"pickup"`
+	OwnDelivery *OwnDelivery     `json:"ownDelivery,omitempty"`
+	Courier     *CourierDelivery `json:"courier,omitempty"`
+}
+
+type OwnDelivery struct {
+	RadiusKm float64 `json:"radiusKm"`
+	FeePerKm float64 `json:"feePerKm"`
+}
+
+type CourierDelivery struct {
+	// Fee is nil when the seller quotes courier costs on request.
+	Fee *float64 `json:"fee,omitempty"`
+}
+
+type DeliveryEstimate struct {
+	Method string   `json:"method"`
+	Cost   *float64 `json:"cost,omitempty"`
+}
+
+type DeliveryEstimateResponse struct {
+	FurnitureID int                `json:"furnitureId"`
+	DistanceKm  float64            `json:"distanceKm"`
+	Options     []DeliveryEstimate `json:"options"`
+}
+
+// pickupOnly is what listings offer until their seller says otherwise.
+var pickupOnly = DeliveryOptions{Pickup: true}
+
+func initDeliveryTables() error {
+	alterFurnitureDeliverySQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS pickup BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS delivery_radius_km DECIMAL(6, 1);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS delivery_fee_per_km DECIMAL(8, 2);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS courier BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS courier_fee DECIMAL(10, 2);`
+
+	if _, err := db.Exec(alterFurnitureDeliverySQL); err != nil {
+		return fmt.Errorf("failed to add furniture delivery columns: %w", err)
+	}
+
+	return nil
+}
+
+// deliveryColumns is the select list understood by deliveryOptionsFrom.
+const deliveryColumns = "pickup, delivery_radius_km, delivery_fee_per_km, courier, courier_fee"
+
+// deliveryOptionsFrom assembles options from values selected with
+// deliveryColumns.
+func deliveryOptionsFrom(pickup bool, radiusKm, feePerKm *float64, courier bool, courierFee *float64) DeliveryOptions {
+	options := DeliveryOptions{Pickup: pickup}
+	if radiusKm != nil {
+		options.OwnDelivery = &OwnDelivery{RadiusKm: *radiusKm}
+		if feePerKm != nil {
+			options.OwnDelivery.FeePerKm = *feePerKm
+		}
+	}
+	if courier {
+		options.Courier = &CourierDelivery{Fee: courierFee}
+	}
+	return options
+}
+
+// columnValues returns the options in the order of deliveryColumns.
+func (o DeliveryOptions) columnValues() []interface{} {
+	var radiusKm, feePerKm, courierFee *float64
+	if o.OwnDelivery != nil {
+		radiusKm, feePerKm = &o.OwnDelivery.RadiusKm, &o.OwnDelivery.FeePerKm
+	}
+	if o.Courier != nil {
+		courierFee = o.Courier.Fee
+	}
+	return []interface{}{o.Pickup, radiusKm, feePerKm, o.Courier != nil, courierFee}
+}
+
+// validate returns the first problem with the options, named after the
+// field it concerns.
+func (o DeliveryOptions) validate() *FieldError {
+	if !o.Pickup && o.OwnDelivery == nil && o.Courier == nil {
+		return &FieldError{"delivery", "at least one delivery option is required"}
+	}
+	if o.OwnDelivery != nil {
+		if o.OwnDelivery.RadiusKm <= 0 || o.OwnDelivery.RadiusKm > maxDeliveryRadiusKm {
+			return &FieldError{"deliveryRadiusKm", fmt.Sprintf("must be between 0 and %d", maxDeliveryRadiusKm)}
+		}
+		if o.OwnDelivery.FeePerKm < 0 || o.OwnDelivery.FeePerKm > maxDeliveryFeePerKm {
+			return &FieldError{"deliveryFeePerKm", fmt.Sprintf("must be between 0 and %.2f", maxDeliveryFeePerKm)}
+		}
+	}
+	if o.Courier != nil && o.Courier.Fee != nil && (*o.Courier.Fee < 0 || *o.Courier.Fee > maxListingPrice) {
+		return &FieldError{"courierFee", fmt.Sprintf("must be between 0 and %.2f", maxListingPrice)}
+	}
+	return nil
+}
+
+// estimate prices each available method for a buyer distanceKm away.
+func (o DeliveryOptions) estimate(distanceKm float64) []DeliveryEstimate {
+	estimates := []DeliveryEstimate{}
+	if o.Pickup {
+		free := 0.0
+		estimates = append(estimates, DeliveryEstimate{Method: DeliveryPickup, Cost: &free})
+	}
+	if o.OwnDelivery != nil && distanceKm <= o.OwnDelivery.RadiusKm {
+		cost := math.Round(o.OwnDelivery.FeePerKm*distanceKm*100) / 100
+		estimates = append(estimates, DeliveryEstimate{Method: DeliveryOwn, Cost: &cost})
+	}
+	if o.Courier != nil {
+		estimates = append(estimates, DeliveryEstimate{Method: DeliveryCourier, Cost: o.Courier.Fee})
+	}
+	return estimates
+}
+
+// parseBuyerLocation reads a buyer's position given as "lat,lng" or as a
+// gazetteer place such as "Kraków" or "Kraków, Małopolskie".
+func parseBuyerLocation(value string) (float64, float64, error) {
+	if lat, lng, err := parseLatLng(value); err == nil {
+		return lat, lng, nil
+	}
+	city, voivodeship, _ := splitLocation(value)
+	place, _, err := resolveLocation(city, voivodeship, "")
+	if err != nil {
+		return 0, 0, fmt.Errorf("must be latitude,longitude or a known city")
+	}
+	return place.Latitude, place.Longitude, nil
+}
+
+// deliversToFilter restricts q to listings that can reach the buyer at
+// lat/lng by own delivery or courier, measured on the true coordinates.
+func deliversToFilter(q *furnitureQuery, lat, lng float64) {
+	distance := distanceKmSQL("latitude", "longitude", q.arg(lat), q.arg(lng))
+	q.where("(courier OR (delivery_radius_km IS NOT NULL AND latitude IS NOT NULL AND " +
+		distance + " <= delivery_radius_km))")
+}
+
+// loadDeliveryOptions returns a listing's seller, public coordinates and
+// delivery options.
+func loadDeliveryOptions(id int) (*int, *float64, *float64, DeliveryOptions, error) {
+	var sellerID *int
+	var lat, lng *float64
+	var pickup, courier bool
+	var radiusKm, feePerKm, courierFee *float64
+	err := db.QueryRow("SELECT user_id, public_latitude, public_longitude, "+deliveryColumns+" FROM furniture WHERE id = $1", id).
+		Scan(&sellerID, &lat, &lng, &pickup, &radiusKm, &feePerKm, &courier, &courierFee)
+	return sellerID, lat, lng, deliveryOptionsFrom(pickup, radiusKm, feePerKm, courier, courierFee), err
+}
+
+// deliveryEstimateHandler prices every delivery method available to a
+// buyer at ?to=, given as coordinates or a city.
+func deliveryEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+	buyerLat, buyerLng, err := parseBuyerLocation(r.URL.Query().Get("to"))
+	if err != nil {
+		respondWithError(w, "to "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, lat, lng, options, err := loadDeliveryOptions(id)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	if lat == nil || lng == nil {
+		respondWithError(w, "This listing has no location to estimate delivery from", http.StatusConflict)
+		return
+	}
+
+	distanceKm := math.Round(haversineKm(*lat, *lng, buyerLat, buyerLng)*10) / 10
+	respondWithJSON(w, DeliveryEstimateResponse{
+		FurnitureID: id,
+		DistanceKm:  distanceKm,
+		Options:     options.estimate(distanceKm),
+	}, http.StatusOK)
+}
+
+// furnitureDeliveryHandler lets a seller change the delivery options of
+// their listing.
+func furnitureDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	sellerID, _, _, _, err := loadDeliveryOptions(id)
+	if err == sql.ErrNoRows || (err == nil && (sellerID == nil || *sellerID != userID)) {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+
+	var req DeliveryOptions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if fieldErr := req.validate(); fieldErr != nil {
+		respondWithError(w, fieldErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := append([]interface{}{id}, req.columnValues()...)
+	err = withRevisionActor(r.Context(), userID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE furniture SET pickup = $2, delivery_radius_km = $3, delivery_fee_per_km = $4, courier = $5, courier_fee = $6,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`, args...); err != nil {
+			return err
+		}
+		return dispatchListingUpdated(r.Context(), tx, id)
+	})
+	if err != nil {
+		respondWithError(w, "Error updating furniture", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, req, http.StatusOK)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxDraftsPerUser  = 100
+	maxPublishDelay   = 60 * 24 * time.Hour
+	draftPollInterval = time.Minute
+	draftPublishBatch = 50
+)
+
+// ListingDraft is a listing being prepared over several sessions. Its
+// content uses the import format and is only fully validated when it is
+// published; drafts live apart from furniture so no public query can see
+// them.
+type ListingDraft struct {
+	ID      int       `json:"id"`
+	Listing ImportRow `json:"listing"`
+	// PublishAt schedules the draft to be published automatically
+	PublishAt *time.Time `json:"publishAt,omitempty"`
+	// LastError explains why a scheduled publish failed
+	LastError string    `json:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	userID int
+}
+
+type DraftListResponse struct {
+	Drafts []ListingDraft `json:"drafts"`
+	Total  int            `json:"total"`
+}
+
+type PublishDraftRequest struct {
+	PublishAt *time.Time `json:"publishAt"`
+}
+
+type DraftValidationResponse struct {
+	Error  string        `json:"error"`
+	Errors []ImportError `json:"errors"`
+}
+
+func initDraftTables() error {
+	createDraftTablesSQL := `
+	CREATE TABLE IF NOT EXISTS listing_drafts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		content JSONB NOT NULL DEFAULT '{}',
+		publish_at TIMESTAMPTZ,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS listing_drafts_user_idx ON listing_drafts (user_id);
+	CREATE INDEX IF NOT EXISTS listing_drafts_publish_at_idx ON listing_drafts (publish_at) WHERE publish_at IS NOT NULL;`
+
+	if _, err := db.Exec(createDraftTablesSQL); err != nil {
+		return fmt.Errorf("failed to create draft tables: %w", err)
+	}
+
+	return nil
+}
+
+const draftSelectSQL = "SELECT id, user_id, content, publish_at, last_error, created_at, updated_at FROM listing_drafts"
+
+func scanDraft(row interface{ Scan(...interface{}) error }) (ListingDraft, error) {
+	var d ListingDraft
+	var content []byte
+	if err := row.Scan(&d.ID, &d.userID, &content, &d.PublishAt, &d.LastError, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(content, &d.Listing); err != nil {
+		return d, fmt.Errorf("draft %d: %w", d.ID, err)
+	}
+	return d, nil
+}
+
+// checkDraft trims a draft and applies the few limits that hold even for
+// unfinished listings; everything else waits for publishing.
+func checkDraft(item *ImportRow) *FieldError {
+	item.SKU = strings.TrimSpace(item.SKU)
+	item.Title = strings.TrimSpace(item.Title)
+	switch {
+	case len(item.SKU) > 100:
+		return &FieldError{Field: "sku", Message: "must be at most 100 characters"}
+	case len(item.Title) > 255:
+		return &FieldError{Field: "title", Message: "must be at most 255 characters"}
+	case len(item.Address) > 255:
+		return &FieldError{Field: "address", Message: "must be at most 255 characters"}
+	}
+	return nil
+}
+
+// draftsHandler lists the caller's drafts (GET) and starts a new one (POST).
+func draftsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query(draftSelectSQL+" WHERE user_id = $1 ORDER BY updated_at DESC", userID)
+		if err != nil {
+			respondWithError(w, "Error fetching drafts", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		drafts := []ListingDraft{}
+		for rows.Next() {
+			d, err := scanDraft(rows)
+			if err != nil {
+				respondWithError(w, "Error scanning draft data", http.StatusInternalServerError)
+				return
+			}
+			drafts = append(drafts, d)
+		}
+		if err = rows.Err(); err != nil {
+			respondWithError(w, "Error iterating draft data", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, DraftListResponse{Drafts: drafts, Total: len(drafts)}, http.StatusOK)
+
+	case "POST":
+		var item ImportRow
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if fieldErr := checkDraft(&item); fieldErr != nil {
+			respondWithError(w, fieldErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM listing_drafts WHERE user_id = $1", userID).Scan(&count); err != nil {
+			respondWithError(w, "Error creating draft", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxDraftsPerUser {
+			respondWithError(w, fmt.Sprintf("You can keep at most %d drafts", maxDraftsPerUser), http.StatusConflict)
+			return
+		}
+
+		content, err := json.Marshal(item)
+		if err != nil {
+			respondWithError(w, "Error creating draft", http.StatusInternalServerError)
+			return
+		}
+		d, err := scanDraft(db.QueryRow(`
+			INSERT INTO listing_drafts (user_id, content) VALUES ($1, $2)
+			RETURNING id, user_id, content, publish_at, last_error, created_at, updated_at`, userID, content))
+		if err != nil {
+			respondWithError(w, "Error creating draft", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, d, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadDraft fetches the draft named in the path, responding 404 unless it
+// belongs to the caller.
+func loadDraft(w http.ResponseWriter, r *http.Request) (ListingDraft, bool) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid draft id", http.StatusBadRequest)
+		return ListingDraft{}, false
+	}
+
+	d, err := scanDraft(db.QueryRow(draftSelectSQL+" WHERE id = $1", id))
+	if err == sql.ErrNoRows || (err == nil && d.userID != userID) {
+		respondWithError(w, "Draft not found", http.StatusNotFound)
+		return d, false
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching draft", http.StatusInternalServerError)
+		return d, false
+	}
+	return d, true
+}
+
+// draftHandler shows (GET), replaces (PUT) and discards (DELETE) a draft.
+// A scheduled draft keeps its schedule when edited; the new content is
+// validated when it is published.
+func draftHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := loadDraft(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respondWithJSON(w, d, http.StatusOK)
+
+	case "PUT":
+		var item ImportRow
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if fieldErr := checkDraft(&item); fieldErr != nil {
+			respondWithError(w, fieldErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		content, err := json.Marshal(item)
+		if err != nil {
+			respondWithError(w, "Error updating draft", http.StatusInternalServerError)
+			return
+		}
+		d, err = scanDraft(db.QueryRow(`
+			UPDATE listing_drafts SET content = $2, last_error = '', updated_at = CURRENT_TIMESTAMP WHERE id = $1
+			RETURNING id, user_id, content, publish_at, last_error, created_at, updated_at`, d.ID, content))
+		if err != nil {
+			respondWithError(w, "Error updating draft", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, d, http.StatusOK)
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM listing_drafts WHERE id = $1", d.ID); err != nil {
+			respondWithError(w, "Error deleting draft", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, Response{Message: "Draft deleted"}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// draftPublishHandler publishes a draft now, or schedules it when publishAt
+// is in the future (POST), and cancels a schedule (DELETE). Scheduling runs
+// the full validation too, so problems show up while the seller is around.
+func draftPublishHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := loadDraft(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	switch r.Method {
+	case "POST":
+		var req PublishDraftRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				respondWithError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.PublishAt != nil && req.PublishAt.After(time.Now().Add(maxPublishDelay)) {
+			respondWithError(w, "publishAt must be within 60 days", http.StatusBadRequest)
+			return
+		}
+
+		categories, err := categoryIDsBySlug()
+		if err != nil {
+			respondWithError(w, "Error fetching categories", http.StatusInternalServerError)
+			return
+		}
+
+		if req.PublishAt != nil && req.PublishAt.After(time.Now()) {
+			if _, errs := validateDraft(d, categories); len(errs) > 0 {
+				respondWithJSON(w, DraftValidationResponse{Error: "Draft is not ready to publish", Errors: errs}, http.StatusBadRequest)
+				return
+			}
+			d, err = scanDraft(db.QueryRow(`
+				UPDATE listing_drafts SET publish_at = $2, last_error = '', updated_at = CURRENT_TIMESTAMP WHERE id = $1
+				RETURNING id, user_id, content, publish_at, last_error, created_at, updated_at`, d.ID, *req.PublishAt))
+			if err != nil {
+				respondWithError(w, "Error scheduling draft", http.StatusInternalServerError)
+				return
+			}
+			respondWithJSON(w, d, http.StatusAccepted)
+			return
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			respondWithError(w, "Error publishing draft", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Lock the draft so the scheduler cannot publish it at the same time
+		d, err = scanDraft(tx.QueryRowContext(ctx, draftSelectSQL+" WHERE id = $1 FOR UPDATE", d.ID))
+		if err == sql.ErrNoRows {
+			respondWithError(w, "Draft not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError(w, "Error fetching draft", http.StatusInternalServerError)
+			return
+		}
+
+		furnitureID, errs, err := publishDraft(ctx, tx, d, categories)
+		if err == nil && len(errs) == 0 {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error publishing draft %d: %v", d.ID, err)
+			respondWithError(w, "Error publishing draft", http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			respondWithJSON(w, DraftValidationResponse{Error: "Draft is not ready to publish", Errors: errs}, http.StatusBadRequest)
+			return
+		}
+
+		items, err := furnitureByIDs([]int64{int64(furnitureID)})
+		if err != nil {
+			respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, items[furnitureID], http.StatusCreated)
+
+	case "DELETE":
+		d, err := scanDraft(db.QueryRow(`
+			UPDATE listing_drafts SET publish_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1
+			RETURNING id, user_id, content, publish_at, last_error, created_at, updated_at`, d.ID))
+		if err != nil {
+			respondWithError(w, "Error unscheduling draft", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, d, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateDraft runs the import validation on a draft. Drafts without a
+// SKU get one from their id; a draft reusing the SKU of an existing
+// listing updates that listing when published.
+func validateDraft(d ListingDraft, categories map[string]int) (ImportRow, []ImportError) {
+	item := d.Listing
+	if item.SKU == "" {
+		item.SKU = fmt.Sprintf("draft-%d", d.ID)
+	}
+	records := []importRecord{{item: item}}
+	validateImportRecords(records, categories)
+	return records[0].item, records[0].errors
+}
+
+// publishDraft turns a locked draft into a listing and removes the draft.
+// Validation problems are returned as errs and leave the draft untouched.
+func publishDraft(ctx context.Context, tx *sql.Tx, d ListingDraft, categories map[string]int) (furnitureID int, errs []ImportError, err error) {
+	item, errs := validateDraft(d, categories)
+	if len(errs) > 0 {
+		return 0, errs, nil
+	}
+
+	var seller string
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM users WHERE id = $1", d.userID).Scan(&seller); err != nil {
+		return 0, nil, err
+	}
+
+	furniture, _, _, err := upsertImportRow(ctx, tx, d.userID, seller, item, categories[item.Category])
+	var duplicateErr *DuplicateError
+	if errors.As(err, &duplicateErr) {
+		return 0, []ImportError{{SKU: item.SKU, Field: "listing", Message: duplicateErr.Error()}}, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM listing_drafts WHERE id = $1", d.ID); err != nil {
+		return 0, nil, err
+	}
+	return furniture.ID, nil, nil
+}
+
+func runDraftPublishWorker(ctx context.Context) {
+	ticker := time.NewTicker(draftPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := publishScheduledDrafts(ctx); err != nil {
+			log.Printf("Error publishing scheduled drafts: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishScheduledDrafts publishes drafts whose time has come. A draft that
+// no longer validates, e.g. because its category was removed, or that fails
+// to save is unscheduled and its owner told why.
+func publishScheduledDrafts(ctx context.Context) error {
+	categories, err := categoryIDsBySlug()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, draftSelectSQL+`
+		WHERE publish_at <= CURRENT_TIMESTAMP
+		ORDER BY publish_at
+		LIMIT `+strconv.Itoa(draftPublishBatch)+`
+		FOR UPDATE SKIP LOCKED`)
+	if err != nil {
+		return err
+	}
+	var drafts []ListingDraft
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		drafts = append(drafts, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	type outcome struct {
+		draft       ListingDraft
+		furnitureID int
+		problem     string
+	}
+	var outcomes []outcome
+	for _, d := range drafts {
+		// Each draft is published under its own savepoint, so one that
+		// fails is rolled back and unscheduled without holding up the rest
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT publish_draft"); err != nil {
+			return err
+		}
+		furnitureID, errs, err := publishDraft(ctx, tx, d, categories)
+		if err != nil {
+			log.Printf("Error publishing draft %d: %v", d.ID, err)
+			errs = []ImportError{{Field: "listing", Message: "could not be published, please schedule it again"}}
+		}
+		if len(errs) > 0 {
+			problem := errs[0].Field + " " + errs[0].Message
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT publish_draft"); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE listing_drafts SET publish_at = NULL, last_error = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`,
+				d.ID, problem); err != nil {
+				return err
+			}
+			outcomes = append(outcomes, outcome{draft: d, problem: problem})
+		} else {
+			outcomes = append(outcomes, outcome{draft: d, furnitureID: furnitureID})
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT publish_draft"); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Listings are already published, so notification failures are only logged
+	for _, o := range outcomes {
+		event := NotificationEvent{
+			Type:  NotificationListing,
+			Title: "Your listing is live",
+			Body:  fmt.Sprintf("%s has been published as scheduled.", o.draft.Listing.Title),
+			Data:  map[string]interface{}{"draftId": o.draft.ID, "furnitureId": o.furnitureID},
+		}
+		if o.problem != "" {
+			event.Title = "Scheduled publishing failed"
+			event.Body = fmt.Sprintf("Your draft %s could not be published: %s.", o.draft.Listing.Title, o.problem)
+			event.Data = map[string]interface{}{"draftId": o.draft.ID}
+		}
+		if err := Notify(ctx, o.draft.userID, event); err != nil {
+			log.Printf("Error notifying user %d about draft %d: %v", o.draft.userID, o.draft.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// What happens when a new listing looks like a duplicate, set with
+// DUPLICATE_ACTION. Blocking only applies when the listing is created;
+// duplicates found later through image hashes are flagged instead.
+const (
+	DuplicateBlock = "block"
+	DuplicateWarn  = "warn"
+	DuplicateFlag  = "flag"
+)
+
+// Review statuses of a flagged duplicate.
+const (
+	DuplicateOpen      = "open"
+	DuplicateDismissed = "dismissed"
+	DuplicateConfirmed = "confirmed"
+)
+
+// Signals that two listings are the same item. Two of them must agree, so
+// for example the seed data's shared image URLs alone are not enough.
+const (
+	DuplicateTitle  = "title"
+	DuplicateImage  = "image"
+	DuplicateSeller = "seller"
+)
+
+const (
+	// maxImageHashDistance is how many of the 64 hash bits may differ for
+	// two images to count as the same photo, allowing for re-encoding and
+	// resizing
+	maxImageHashDistance   = 8
+	maxHashedImageBytes    = 10 << 20
+	maxHashedImagePixels   = 40_000_000
+	imageHashPollInterval  = time.Minute
+	imageHashBatchSize     = 20
+	duplicateRecheckWindow = "INTERVAL '30 days'"
+)
+
+var duplicateAction = DuplicateWarn
+
+var imageHashClient = newOutboundClient(10 * time.Second)
+
+// titleKeySQL normalizes a title the way normalizeTag does, so reposts
+// with different case, accents or punctuation compare equal.
+func titleKeySQL(title string) string {
+	return "btrim(regexp_replace(translate(lower(" + title + "), 'ąćęłńóśźż', 'acelnoszz'), '[^a-z0-9]+', '-', 'g'), '-')"
+}
+
+// listingImagesSQL is every image of a furniture row; older rows only have
+// the url column.
+const listingImagesSQL = "(furniture.images || furniture.url)"
+
+type DuplicateMatch struct {
+	DuplicateOf int      `json:"duplicateOf"`
+	Reasons     []string `json:"reasons"`
+}
+
+type DuplicateError struct {
+	DuplicateMatch
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("looks like a duplicate of listing %d (same %s)", e.DuplicateOf, strings.Join(e.Reasons, ", "))
+}
+
+type DuplicateFlagEntry struct {
+	ID          int        `json:"id"`
+	Furniture   Furniture  `json:"furniture"`
+	DuplicateOf *Furniture `json:"duplicateOf,omitempty"`
+	Reasons     []string   `json:"reasons"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"createdAt"`
+
+	furnitureID   int
+	duplicateOfID int
+}
+
+type ReviewDuplicateRequest struct {
+	Status string `json:"status"`
+}
+
+// duplicateActionFromEnv reads DUPLICATE_ACTION, defaulting to warn.
+func duplicateActionFromEnv() (string, error) {
+	switch action := os.Getenv("DUPLICATE_ACTION"); action {
+	case "":
+		return DuplicateWarn, nil
+	case DuplicateBlock, DuplicateWarn, DuplicateFlag:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown DUPLICATE_ACTION: %s", action)
+	}
+}
+
+func initDuplicateTables() error {
+	createDuplicateTablesSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS title_key TEXT GENERATED ALWAYS AS (` + titleKeySQL("title") + `) STORED;
+	CREATE INDEX IF NOT EXISTS furniture_title_key_idx ON furniture (title_key);
+	CREATE TABLE IF NOT EXISTS image_hashes (
+		url TEXT PRIMARY KEY,
+		hash BIGINT,
+		error TEXT NOT NULL DEFAULT '',
+		hashed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS duplicate_matches (
+		id SERIAL PRIMARY KEY,
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		duplicate_of INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		reasons TEXT[] NOT NULL,
+		action VARCHAR(10) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		notified_at TIMESTAMPTZ,
+		reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		reviewed_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (furniture_id, duplicate_of)
+	);
+	CREATE INDEX IF NOT EXISTS duplicate_matches_review_idx ON duplicate_matches (created_at) WHERE action = 'flag' AND status = 'open';`
+
+	if _, err := db.Exec(createDuplicateTablesSQL); err != nil {
+		return fmt.Errorf("failed to create duplicate tables: %w", err)
+	}
+
+	return nil
+}
+
+// duplicateCandidate describes a listing to compare with live listings.
+// ID is 0 for a listing that has not been inserted yet.
+type duplicateCandidate struct {
+	id      int
+	userID  int
+	title   string
+	images  []string
+	city    string
+	address string
+}
+
+// findDuplicates compares a listing with live listings on normalized
+// title, images (by URL or perceptual hash) and seller, where the same
+// private address and city counts as the same seller behind another
+// account.
+func findDuplicates(ctx context.Context, q querier, c duplicateCandidate) ([]DuplicateMatch, error) {
+	sameTitle := "title_key = " + titleKeySQL("$2::text")
+	sameSeller := "(user_id = $1 OR (address = NULLIF($5, '') AND city = $4))"
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, `+sameTitle+`,
+			`+listingImagesSQL+` && $3::text[] OR EXISTS (
+				SELECT 1 FROM image_hashes a, image_hashes b
+				WHERE a.url = ANY ($3::text[]) AND b.url = ANY `+listingImagesSQL+`
+					AND length(replace((a.hash # b.hash)::bit(64)::text, '0', '')) <= $6),
+			`+sameSeller+`
+		FROM furniture
+		WHERE id <> $7 AND expires_at > CURRENT_TIMESTAMP AND archived_at IS NULL
+			AND (`+sameTitle+` OR `+listingImagesSQL+` && $3::text[] OR `+sameSeller+`)
+		ORDER BY id DESC
+		LIMIT 200`,
+		c.userID, c.title, pq.Array(c.images), c.city, c.address, maxImageHashDistance, c.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []DuplicateMatch
+	for rows.Next() {
+		var id int
+		var title, image, seller bool
+		if err := rows.Scan(&id, &title, &image, &seller); err != nil {
+			return nil, err
+		}
+		var reasons []string
+		if title {
+			reasons = append(reasons, DuplicateTitle)
+		}
+		if image {
+			reasons = append(reasons, DuplicateImage)
+		}
+		if seller {
+			reasons = append(reasons, DuplicateSeller)
+		}
+		if len(reasons) >= 2 {
+			matches = append(matches, DuplicateMatch{DuplicateOf: id, Reasons: reasons})
+		}
+	}
+	return matches, rows.Err()
+}
+
+// recordDuplicates stores matches found for a listing. Flags wait for
+// moderators, and warnings are sent to the seller by runDuplicateWorker
+// once the listing's transaction has committed.
+func recordDuplicates(ctx context.Context, tx execer, furnitureID int, matches []DuplicateMatch, action string) error {
+	for _, m := range matches {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO duplicate_matches (furniture_id, duplicate_of, reasons, action) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (furniture_id, duplicate_of) DO NOTHING`,
+			furnitureID, m.DuplicateOf, pq.Array(m.Reasons), action)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runDuplicateWorker(ctx context.Context) {
+	ticker := time.NewTicker(imageHashPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := hashListingImages(ctx); err != nil {
+			log.Printf("Error hashing listing images: %v", err)
+		}
+		if err := notifyDuplicateWarnings(ctx); err != nil {
+			log.Printf("Error sending duplicate warnings: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// hashListingImages computes perceptual hashes of images not seen before,
+// then re-checks recent listings using them, since a copied photo at a new
+// URL is only recognizable once both images are hashed.
+func hashListingImages(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT u FROM furniture, unnest(`+listingImagesSQL+`) AS u
+		WHERE u <> '' AND NOT EXISTS (SELECT 1 FROM image_hashes h WHERE h.url = u)
+		LIMIT $1`, imageHashBatchSize)
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range urls {
+		var hash *int64
+		var hashErr string
+		if h, err := fetchImageHash(ctx, u); err != nil {
+			hashErr = err.Error()
+		} else {
+			v := int64(h)
+			hash = &v
+		}
+		// Several instances may hash the same URL; the first one wins
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO image_hashes (url, hash, error) VALUES ($1, $2, $3) ON CONFLICT (url) DO NOTHING`,
+			u, hash, hashErr); err != nil {
+			return err
+		}
+		if hash == nil {
+			continue
+		}
+		if err := recheckListingsWithImage(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recheckListingsWithImage looks for duplicates of recent listings showing
+// imageURL. It cannot block them any more, so they are flagged instead.
+func recheckListingsWithImage(ctx context.Context, imageURL string) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, title, `+listingImagesSQL+`, COALESCE(city, ''), COALESCE(address, '') FROM furniture
+		WHERE $1 = ANY `+listingImagesSQL+` AND user_id IS NOT NULL
+			AND created_at > CURRENT_TIMESTAMP - `+duplicateRecheckWindow, imageURL)
+	if err != nil {
+		return err
+	}
+	var candidates []duplicateCandidate
+	for rows.Next() {
+		var c duplicateCandidate
+		if err := rows.Scan(&c.id, &c.userID, &c.title, pq.Array(&c.images), &c.city, &c.address); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	action := duplicateAction
+	if action == DuplicateBlock {
+		action = DuplicateFlag
+	}
+	for _, c := range candidates {
+		matches, err := findDuplicates(ctx, db, c)
+		if err != nil {
+			return err
+		}
+		// Only the newer listing of a pair is the repost
+		var newer []DuplicateMatch
+		for _, m := range matches {
+			if m.DuplicateOf < c.id {
+				newer = append(newer, m)
+			}
+		}
+		if err := recordDuplicates(ctx, db, c.id, newer, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchImageHash downloads an image and returns its difference hash.
+func fetchImageHash(ctx context.Context, imageURL string) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := imageHashClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHashedImageBytes))
+	if err != nil {
+		return 0, err
+	}
+
+	// Decoding allocates for the size declared in the header, which a small
+	// file can set to gigabytes, so the size is checked first
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxHashedImagePixels {
+		return 0, fmt.Errorf("image of %dx%d pixels is too large to hash", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return differenceHash(img), nil
+}
+
+// differenceHash is a 64-bit perceptual hash: the image is shrunk to 9x8
+// grey cells and each bit says whether a cell is brighter than its right
+// neighbour. Resizing, recompression and small edits change few bits.
+func differenceHash(img image.Image) uint64 {
+	const cols, rows = 9, 8
+	bounds := img.Bounds()
+	var cells [rows][cols]float64
+	for y := 0; y < rows; y++ {
+		// Images smaller than the grid repeat their pixels
+		y0 := bounds.Min.Y + y*bounds.Dy()/rows
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/rows, y0+1)
+		for x := 0; x < cols; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/cols
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/cols, x0+1)
+			var sum float64
+			var n int
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			cells[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+type pendingDuplicateWarning struct {
+	id          int
+	sellerID    int
+	title       string
+	furnitureID int
+	duplicateOf int
+}
+
+// notifyDuplicateWarnings tells sellers about listings that look like
+// duplicates when DUPLICATE_ACTION is warn.
+func notifyDuplicateWarnings(ctx context.Context) error {
+	claim := func(tx *sql.Tx) ([]pendingDuplicateWarning, error) {
+		rows, err := tx.QueryContext(ctx, `
+			UPDATE duplicate_matches d SET notified_at = CURRENT_TIMESTAMP
+			FROM furniture f
+			WHERE f.id = d.furniture_id AND d.id IN (
+				SELECT d.id FROM duplicate_matches d JOIN furniture f ON f.id = d.furniture_id
+				WHERE d.action = $1 AND d.notified_at IS NULL AND f.user_id IS NOT NULL
+				ORDER BY d.created_at
+				LIMIT 50
+				FOR UPDATE OF d SKIP LOCKED)
+			RETURNING d.id, f.user_id, f.title, d.furniture_id, d.duplicate_of`, DuplicateWarn)
+		if err != nil {
+			return nil, err
+		}
+		var warnings []pendingDuplicateWarning
+		for rows.Next() {
+			var p pendingDuplicateWarning
+			if err := rows.Scan(&p.id, &p.sellerID, &p.title, &p.furnitureID, &p.duplicateOf); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			warnings = append(warnings, p)
+		}
+		rows.Close()
+		return warnings, rows.Err()
+	}
+
+	return claimAndNotify(ctx, claim, func(p pendingDuplicateWarning) error {
+		return Notify(ctx, p.sellerID, NotificationEvent{
+			Type:  NotificationModeration,
+			Title: "Possible duplicate listing",
+			Body:  fmt.Sprintf("%s looks like a repost of another listing. Please renew listings instead of posting them again.", p.title),
+			Data:  map[string]interface{}{"furnitureId": p.furnitureID, "duplicateOf": p.duplicateOf},
+		})
+	})
+}
+
+// adminDuplicatesHandler lists flagged duplicates awaiting review, oldest
+// first.
+func adminDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, limit := parsePagination(r)
+	rows, err := db.Query(`
+		SELECT id, furniture_id, duplicate_of, reasons, status, created_at FROM duplicate_matches
+		WHERE action = $1 AND status = $2
+		ORDER BY created_at, id
+		LIMIT $3 OFFSET $4`, DuplicateFlag, DuplicateOpen, limit, (page-1)*limit)
+	if err != nil {
+		respondWithError(w, "Error fetching duplicates", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var flags []DuplicateFlagEntry
+	var ids []int64
+	for rows.Next() {
+		var f DuplicateFlagEntry
+		if err := rows.Scan(&f.ID, &f.furnitureID, &f.duplicateOfID, pq.Array(&f.Reasons), &f.Status, &f.CreatedAt); err != nil {
+			respondWithError(w, "Error scanning duplicate data", http.StatusInternalServerError)
+			return
+		}
+		flags = append(flags, f)
+		ids = append(ids, int64(f.furnitureID), int64(f.duplicateOfID))
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating duplicate data", http.StatusInternalServerError)
+		return
+	}
+
+	items, err := furnitureByIDs(ids)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	entries := []DuplicateFlagEntry{}
+	for _, f := range flags {
+		f.Furniture = items[f.furnitureID]
+		if original, ok := items[f.duplicateOfID]; ok {
+			f.DuplicateOf = &original
+		}
+		entries = append(entries, f)
+	}
+
+	respondWithJSON(w, map[string]interface{}{"duplicates": entries, "page": page, "limit": limit}, http.StatusOK)
+}
+
+// adminDuplicateHandler records a moderator's decision on a flagged
+// duplicate. Confirming removes the repost for good, closing any auction on
+// it, and tells its seller.
+func adminDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid duplicate id", http.StatusBadRequest)
+		return
+	}
+
+	var req ReviewDuplicateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Status != DuplicateDismissed && req.Status != DuplicateConfirmed {
+		respondWithError(w, "status must be dismissed or confirmed", http.StatusBadRequest)
+		return
+	}
+
+	var furnitureID int
+	var sellerID *int
+	var title string
+	err = withRevisionActor(r.Context(), userID, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`
+			UPDATE duplicate_matches SET status = $2, reviewed_by = $3, reviewed_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status = $4
+			RETURNING furniture_id`, id, req.Status, userID, DuplicateOpen).Scan(&furnitureID)
+		if err != nil || req.Status != DuplicateConfirmed {
+			return err
+		}
+		err = tx.QueryRow(`
+			UPDATE furniture SET removed_at = CURRENT_TIMESTAMP, archived_at = CURRENT_TIMESTAMP,
+				expires_at = LEAST(expires_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING user_id, title`, furnitureID).Scan(&sellerID, &title)
+		if err != nil {
+			return err
+		}
+		// Late bids would otherwise push the expiry back and relist it
+		_, err = tx.Exec(`
+			UPDATE auctions SET status = $2, closed_at = CURRENT_TIMESTAMP WHERE furniture_id = $1 AND status = $3`,
+			furnitureID, AuctionClosed, AuctionOpen)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Duplicate not found or already reviewed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error reviewing duplicate", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Status == DuplicateConfirmed && sellerID != nil {
+		err := Notify(r.Context(), *sellerID, NotificationEvent{
+			Type:  NotificationModeration,
+			Title: "Listing removed as a duplicate",
+			Body:  fmt.Sprintf("%s was removed because it duplicates another listing.", title),
+			Data:  map[string]interface{}{"furnitureId": furnitureID},
+		})
+		if err != nil {
+			log.Printf("Error notifying user %d about duplicate %d: %v", *sellerID, id, err)
+		}
+	}
+
+	respondWithJSON(w, Response{Message: "Duplicate " + req.Status}, http.StatusOK)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+const (
+	EmailStatusPending = "pending"
+	EmailStatusSending = "sending"
+	EmailStatusSent    = "sent"
+	EmailStatusDead    = "dead"
+)
+
+const (
+	defaultLocale       = "pl"
+	emailBatchSize      = 20
+	emailPollInterval   = 10 * time.Second
+	emailBaseBackoff    = 30 * time.Second
+	emailMaxBackoff     = 6 * time.Hour
+	emailMaxAttempts    = 8
+	emailLastErrorLimit = 1000
+	// emailLease is how long a claimed message stays with one worker. It is
+	// well above smtpTimeout, so only a crashed worker's messages are reclaimed.
+	emailLease = 5 * time.Minute
+)
+
+var supportedLocales = []string{"pl", "en"}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so callers can enqueue
+// email inside the transaction that performs the business change.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type OutboxEmail struct {
+	ID        int
+	Recipient string
+	Subject   string
+	HTMLBody  string
+	Attempts  int
+}
+
+func initEmailTables() error {
+	alterUsersSQL := `ALTER TABLE users ADD COLUMN IF NOT EXISTS locale VARCHAR(5) NOT NULL DEFAULT 'pl';`
+
+	if _, err := db.Exec(alterUsersSQL); err != nil {
+		return fmt.Errorf("failed to add users locale column: %w", err)
+	}
+
+	createOutboxTableSQL := `
+	CREATE TABLE IF NOT EXISTS email_outbox (
+		id SERIAL PRIMARY KEY,
+		recipient VARCHAR(255) NOT NULL,
+		template VARCHAR(100) NOT NULL,
+		locale VARCHAR(5) NOT NULL,
+		subject TEXT NOT NULL,
+		html_body TEXT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS email_outbox_pending_idx ON email_outbox (next_attempt_at) WHERE status = 'pending';
+	ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS email_outbox_sending_idx ON email_outbox (lease_until) WHERE status = 'sending';`
+
+	if _, err := db.Exec(createOutboxTableSQL); err != nil {
+		return fmt.Errorf("failed to create email outbox table: %w", err)
+	}
+
+	return nil
+}
+
+// enqueueEmail renders a template and stores the result in the outbox using
+// the given executor. Rendering happens up front so a broken template fails
+// the business transaction instead of dead-lettering later.
+func enqueueEmail(ctx context.Context, ex execer, recipient, templateName, locale string, data interface{}) error {
+	locale = normalizeLocale(locale)
+
+	subject, body, err := renderEmail(templateName, locale, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.ExecContext(ctx,
+		"INSERT INTO email_outbox (recipient, template, locale, subject, html_body) VALUES ($1, $2, $3, $4, $5)",
+		recipient, templateName, locale, subject, body)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue email: %w", err)
+	}
+
+	return nil
+}
+
+func renderEmail(templateName, locale string, data interface{}) (subject, body string, err error) {
+	path := fmt.Sprintf("templates/email/%s/%s.html", locale, templateName)
+	tmpl, err := template.ParseFS(emailTemplateFS, path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse email template %s: %w", path, err)
+	}
+
+	var subjectBuf, bodyBuf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subjectBuf, "subject", data); err != nil {
+		return "", "", fmt.Errorf("failed to render email subject: %w", err)
+	}
+	if err := tmpl.ExecuteTemplate(&bodyBuf, "body", data); err != nil {
+		return "", "", fmt.Errorf("failed to render email body: %w", err)
+	}
+
+	// The subject is a header, not HTML, so undo the escaping html/template applied.
+	return html.UnescapeString(strings.TrimSpace(subjectBuf.String())), bodyBuf.String(), nil
+}
+
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	for _, supported := range supportedLocales {
+		if locale == supported {
+			return locale
+		}
+	}
+	return defaultLocale
+}
+
+// isDeliverableEmail reports whether an address belongs to a real account
+// rather than a guest created by temporaryUserHandler.
+func isDeliverableEmail(email string) bool {
+	return !strings.HasSuffix(email, "@temporary.local")
+}
+
+// runEmailWorker polls the outbox and delivers due messages until ctx is done.
+func runEmailWorker(ctx context.Context, mailer Mailer) {
+	ticker := time.NewTicker(emailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := deliverPendingEmails(ctx, mailer); err != nil {
+			log.Printf("Error delivering emails: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverPendingEmails claims due messages and sends them one by one. No
+// transaction is held while sending, and each result is recorded on its
+// own, so a failure further down the batch cannot put sent mail back in the
+// queue.
+func deliverPendingEmails(ctx context.Context, mailer Mailer) error {
+	emails, err := claimPendingEmails(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		sendErr := mailer.Send(email)
+		if sendErr == nil {
+			_, err = db.ExecContext(ctx,
+				"UPDATE email_outbox SET status = 'sent', lease_until = NULL, sent_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1",
+				email.ID)
+		} else {
+			err = recordEmailFailure(ctx, email, sendErr)
+		}
+		if err != nil {
+			log.Printf("Error recording delivery of email %d: %v", email.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// claimPendingEmails marks a batch of due messages as sending for
+// emailLease and counts the attempt up front, so a message whose worker
+// died is retried after the lease and still dead-letters eventually.
+func claimPendingEmails(ctx context.Context) ([]OutboxEmail, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE email_outbox SET status = 'sending', attempts = attempts + 1, lease_until = $2
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE (status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP)
+				OR (status = 'sending' AND lease_until <= CURRENT_TIMESTAMP)
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, recipient, subject, html_body, attempts`, emailBatchSize, time.Now().Add(emailLease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []OutboxEmail
+	for rows.Next() {
+		var email OutboxEmail
+		if err := rows.Scan(&email.ID, &email.Recipient, &email.Subject, &email.HTMLBody, &email.Attempts); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+func recordEmailFailure(ctx context.Context, email OutboxEmail, sendErr error) error {
+	lastError := sendErr.Error()
+	if len(lastError) > emailLastErrorLimit {
+		lastError = lastError[:emailLastErrorLimit]
+	}
+
+	if email.Attempts >= emailMaxAttempts {
+		log.Printf("Email %d dead-lettered after %d attempts: %v", email.ID, email.Attempts, sendErr)
+		_, err := db.ExecContext(ctx,
+			"UPDATE email_outbox SET status = 'dead', lease_until = NULL, last_error = $2 WHERE id = $1",
+			email.ID, lastError)
+		return err
+	}
+
+	_, err := db.ExecContext(ctx,
+		"UPDATE email_outbox SET status = 'pending', lease_until = NULL, last_error = $2, next_attempt_at = $3 WHERE id = $1",
+		email.ID, lastError, time.Now().Add(retryBackoff(email.Attempts, emailBaseBackoff, emailMaxBackoff)))
+	return err
+}
+
+// retryBackoff doubles the delay for every attempt already made, capped at max.
+func retryBackoff(attempts int, base, max time.Duration) time.Duration {
+	delay := time.Duration(float64(base) * math.Pow(2, float64(attempts-1)))
+	if delay <= 0 || delay > max {
+		return max
+	}
+	return delay
+}
+
+// newMailerFromEnv selects the delivery transport. It must be chosen
+// explicitly, so a server that was never configured for SMTP fails to start
+// instead of quietly writing every message to disk.
+func newMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("EMAIL_FROM")
+	if from == "" {
+		from = "FurnitureHub <no-reply@furniturehub.local>"
+	}
+
+	switch os.Getenv("EMAIL_TRANSPORT") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST environment variable is required for smtp transport")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "":
+		return nil, fmt.Errorf("EMAIL_TRANSPORT environment variable is required (smtp or file)")
+	case "file":
+		dir := os.Getenv("EMAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "mail_outbox"
+		}
+		return &FileMailer{Dir: dir, From: from}, nil
+	default:
+		return nil, fmt.Errorf("unknown EMAIL_TRANSPORT: %s", os.Getenv("EMAIL_TRANSPORT"))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// listingLifetimeSQL is how long a listing stays up after being
+	// published or renewed.
+	listingLifetimeSQL    = "INTERVAL '30 days'"
+	expiryReminderLeadSQL = "INTERVAL '3 days'"
+	expiryPollInterval    = 10 * time.Minute
+	expiryBatchSize       = 100
+)
+
+type ListingExpiry struct {
+	FurnitureID int       `json:"furnitureId"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func initExpiryTables() error {
+	createExpiryColumnsSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NOT NULL DEFAULT (CURRENT_TIMESTAMP + ` + listingLifetimeSQL + `);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS expiry_reminded_at TIMESTAMPTZ;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS removed_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS furniture_expires_at_idx ON furniture (expires_at);`
+
+	if _, err := db.Exec(createExpiryColumnsSQL); err != nil {
+		return fmt.Errorf("failed to create expiry columns: %w", err)
+	}
+
+	return nil
+}
+
+// renewListingHandler lets the owner extend a listing for another full
+// lifetime, bringing it back if it has already expired or been archived.
+// Listings removed by moderators stay down.
+func renewListingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	// GREATEST keeps a later expiry, e.g. one pushed back by a running auction
+	expiry := ListingExpiry{FurnitureID: id}
+	var removed bool
+	err = withRevisionActor(r.Context(), userID, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(r.Context(), `
+			UPDATE furniture SET
+				expires_at = GREATEST(expires_at, CURRENT_TIMESTAMP + `+listingLifetimeSQL+`),
+				expiry_reminded_at = NULL,
+				archived_at = NULL,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND user_id = $2 AND removed_at IS NULL
+			RETURNING expires_at`, id, userID).Scan(&expiry.ExpiresAt)
+		if err == sql.ErrNoRows {
+			if err := tx.QueryRowContext(r.Context(), `
+				SELECT EXISTS (SELECT 1 FROM furniture WHERE id = $1 AND user_id = $2)`, id, userID).Scan(&removed); err != nil {
+				return err
+			}
+			return sql.ErrNoRows
+		}
+		if err != nil {
+			return err
+		}
+		return dispatchListingUpdated(r.Context(), tx, id)
+	})
+	if removed {
+		respondWithError(w, "Listings removed by moderators cannot be renewed", http.StatusConflict)
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error renewing listing", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, expiry, http.StatusOK)
+}
+
+func runListingExpiryWorker(ctx context.Context) {
+	ticker := time.NewTicker(expiryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sendExpiryReminders(ctx); err != nil {
+			log.Printf("Error sending listing expiry reminders: %v", err)
+		}
+		if err := archiveExpiredListings(ctx); err != nil {
+			log.Printf("Error archiving expired listings: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type expiringListing struct {
+	id        int
+	title     string
+	userID    int
+	expiresAt time.Time
+}
+
+// claimExpiringListings sets column to the current time on owned listings
+// matching condition and returns them, for use as a claimAndNotify claim.
+func claimExpiringListings(ctx context.Context, tx *sql.Tx, column, condition string) ([]expiringListing, error) {
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE furniture SET `+column+` = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM furniture
+			WHERE user_id IS NOT NULL AND `+condition+`
+			ORDER BY expires_at
+			LIMIT `+strconv.Itoa(expiryBatchSize)+`
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, title, user_id, expires_at`)
+	if err != nil {
+		return nil, err
+	}
+	var listings []expiringListing
+	for rows.Next() {
+		var l expiringListing
+		if err := rows.Scan(&l.id, &l.title, &l.userID, &l.expiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		listings = append(listings, l)
+	}
+	rows.Close()
+	return listings, rows.Err()
+}
+
+// sendExpiryReminders warns owners once when a listing is about to expire.
+func sendExpiryReminders(ctx context.Context) error {
+	claim := func(tx *sql.Tx) ([]expiringListing, error) {
+		return claimExpiringListings(ctx, tx, "expiry_reminded_at", `expiry_reminded_at IS NULL AND archived_at IS NULL
+			AND expires_at > CURRENT_TIMESTAMP AND expires_at <= CURRENT_TIMESTAMP + `+expiryReminderLeadSQL)
+	}
+
+	return claimAndNotify(ctx, claim, func(l expiringListing) error {
+		return Notify(ctx, l.userID, NotificationEvent{
+			Type:  NotificationListing,
+			Title: "Your listing expires soon",
+			Body:  fmt.Sprintf("%s expires on %s. Renew it to keep it visible.", l.title, l.expiresAt.Format("2 Jan 2006")),
+			Data:  map[string]interface{}{"furnitureId": l.id, "expiresAt": l.expiresAt},
+		})
+	})
+}
+
+// archiveExpiredListings archives listings past their expiry. Listings
+// with a running auction wait until it has closed.
+func archiveExpiredListings(ctx context.Context) error {
+	claim := func(tx *sql.Tx) ([]expiringListing, error) {
+		return claimExpiringListings(ctx, tx, "archived_at", `archived_at IS NULL AND expires_at <= CURRENT_TIMESTAMP
+			AND NOT `+runningAuctionSQL)
+	}
+
+	return claimAndNotify(ctx, claim, func(l expiringListing) error {
+		return Notify(ctx, l.userID, NotificationEvent{
+			Type:  NotificationListing,
+			Title: "Your listing has expired",
+			Body:  fmt.Sprintf("%s is no longer shown to buyers. Renew it to publish it again.", l.title),
+			Data:  map[string]interface{}{"furnitureId": l.id},
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type PriceBucketCount struct {
+	Key   string   `json:"key"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+type FurnitureFacets struct {
+	Tags         []FacetCount       `json:"tags"`
+	OfferTypes   []FacetCount       `json:"offerTypes"`
+	Voivodeships []FacetCount       `json:"voivodeships"`
+	Conditions   []FacetCount       `json:"conditions"`
+	Materials    []FacetCount       `json:"materials"`
+	Colors       []FacetCount       `json:"colors"`
+	PriceBuckets []PriceBucketCount `json:"priceBuckets"`
+}
+
+// unpricedBucket collects Sell listings that have no price yet.
+const unpricedBucket = "unpriced"
+
+// priceBuckets are half-open ranges [min, max) in PLN, in display order.
+var priceBuckets = []struct {
+	key      string
+	min, max float64
+}{
+	{"free", 0, 0},
+	{"0-100", 0, 100},
+	{"100-250", 100, 250},
+	{"250-500", 250, 500},
+	{"500-1000", 500, 1000},
+	{"1000-2500", 1000, 2500},
+	{"2500+", 2500, 0},
+}
+
+// priceBucketSQL classifies effectivePriceSQL into the keys of priceBuckets.
+func priceBucketSQL() string {
+	var b strings.Builder
+	b.WriteString("CASE WHEN " + effectivePriceSQL + " IS NULL THEN '" + unpricedBucket + "'")
+	for _, bucket := range priceBuckets {
+		switch {
+		case bucket.key == "free":
+			b.WriteString(fmt.Sprintf(" WHEN %s = 0 THEN '%s'", effectivePriceSQL, bucket.key))
+		case bucket.max == 0:
+			b.WriteString(fmt.Sprintf(" WHEN %s >= %g THEN '%s'", effectivePriceSQL, bucket.min, bucket.key))
+		default:
+			b.WriteString(fmt.Sprintf(" WHEN %s < %g THEN '%s'", effectivePriceSQL, bucket.max, bucket.key))
+		}
+	}
+	b.WriteString(" END")
+	return b.String()
+}
+
+// furnitureFacets counts listings per facet value. Each facet is computed
+// with every request filter except its own, so users can see how many items
+// they would get by changing that one filter.
+func furnitureFacets(r *http.Request) (*FurnitureFacets, error) {
+	facets := &FurnitureFacets{}
+	var err error
+
+	facets.Tags, err = facetCounts(r, filterTags, "tag", "FROM furniture, unnest(tags) AS tag")
+	if err != nil {
+		return nil, fmt.Errorf("tag facet: %w", err)
+	}
+
+	facets.OfferTypes, err = facetCounts(r, filterOfferType, "offer_type", "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("offer type facet: %w", err)
+	}
+
+	facets.Voivodeships, err = facetCounts(r, filterVoivodeship, "voivodeship", "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("voivodeship facet: %w", err)
+	}
+
+	facets.Conditions, err = facetCounts(r, filterCondition, "condition", "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("condition facet: %w", err)
+	}
+
+	facets.Materials, err = facetCounts(r, filterMaterial, "material", "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("material facet: %w", err)
+	}
+
+	facets.Colors, err = facetCounts(r, filterColor, "color", "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("color facet: %w", err)
+	}
+
+	priceCounts, err := facetCounts(r, filterPrice, priceBucketSQL(), "FROM furniture")
+	if err != nil {
+		return nil, fmt.Errorf("price facet: %w", err)
+	}
+	counts := make(map[string]int, len(priceCounts))
+	for _, c := range priceCounts {
+		counts[c.Value] = c.Count
+	}
+	facets.PriceBuckets = []PriceBucketCount{}
+	for _, bucket := range priceBuckets {
+		if counts[bucket.key] == 0 {
+			continue
+		}
+		b := PriceBucketCount{Key: bucket.key, Count: counts[bucket.key]}
+		if bucket.key != "free" {
+			min := bucket.min
+			b.Min = &min
+			if bucket.max != 0 {
+				max := bucket.max
+				b.Max = &max
+			}
+		}
+		facets.PriceBuckets = append(facets.PriceBuckets, b)
+	}
+	if counts[unpricedBucket] > 0 {
+		facets.PriceBuckets = append(facets.PriceBuckets, PriceBucketCount{Key: unpricedBucket, Count: counts[unpricedBucket]})
+	}
+
+	return facets, nil
+}
+
+// facetCounts groups the listings matching the request, minus the skipped
+// filter dimension, by valueSQL. Values with no listings are omitted.
+func facetCounts(r *http.Request, skip, valueSQL, from string) ([]FacetCount, error) {
+	q, err := furnitureFilterExcept(r, skip)
+	if err != nil {
+		return nil, err
+	}
+	q.where(valueSQL + " IS NOT NULL")
+
+	query := fmt.Sprintf("SELECT %s AS value, COUNT(*) %s%s GROUP BY 1 ORDER BY 2 DESC, 1",
+		valueSQL, from, q.whereClause())
+
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []FacetCount{}
+	for rows.Next() {
+		var c FacetCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -1,120 +1,329 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type Furniture struct {
-	ID        int      `json:"id"`
-	Title     string   `json:"title"`
-	URL       string   `json:"url"`
-	Tags      []string `json:"tags"`
-	Seller    string   `json:"seller"`
-	Location  string   `json:"location"`
-	OfferType string   `json:"offerType"`
-	Latitude  *float64 `json:"latitude,omitempty"`
-	Longitude *float64 `json:"longitude,omitempty"`
+	ID          int      `json:"id"`
+	Title       string   `json:"title"`
+	URL         string   `json:"url"`
+	Tags        []string `json:"tags"`
+	Seller      string   `json:"seller"`
+	Location    string   `json:"location"`
+	City        string   `json:"city"`
+	Voivodeship string   `json:"voivodeship"`
+	PostalCode  string   `json:"postalCode,omitempty"`
+	OfferType   string   `json:"offerType"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+	// LocationPrecision says how far Latitude/Longitude may be from the
+	// listing's true position; see fuzzCoordinates
+	LocationPrecision string          `json:"locationPrecision"`
+	Price             *float64        `json:"price,omitempty"`
+	CategoryID        int             `json:"categoryId"`
+	Delivery          DeliveryOptions `json:"delivery"`
+	// BundleID is the active bundle the listing is also sold in, if any
+	BundleID  *int      `json:"bundleId,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	PhysicalAttributes
 }
 
+// Offer types a listing can be published with.
+const (
+	OfferTypeSell     = "Sell"
+	OfferTypeGiveaway = "Giveaway"
+	OfferTypeFree     = "Free"
+	// OfferTypeAuction listings are sold to the highest bidder; their price
+	// is the current bid, see auctions.go
+	OfferTypeAuction = "Auction"
+)
+
+var offerTypes = []string{OfferTypeSell, OfferTypeGiveaway, OfferTypeFree, OfferTypeAuction}
+
 type FurnitureResponse struct {
-	Furniture []Furniture `json:"furniture"`
-	Total     int         `json:"total"`
+	Furniture []Furniture      `json:"furniture"`
+	Total     int              `json:"total"`
+	Facets    *FurnitureFacets `json:"facets,omitempty"`
+	// DidYouMean suggests a close known term when a q search found nothing
+	DidYouMean string `json:"didYouMean,omitempty"`
 }
 
-func furnitureHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// furnitureColumns is the select list understood by scanFurniture.
+// Coordinates are the public, possibly fuzzed ones. Filters and rankings
+// that measure distance on the server use the true latitude and longitude
+// columns; only values returned to clients, such as delivery estimates and
+// map clusters, are computed from the public ones.
+const furnitureColumns = "id, title, url, tags, seller, location, offer_type, public_latitude, public_longitude, price, category_id, " +
+	"COALESCE(city, ''), COALESCE(voivodeship, ''), COALESCE(postal_code, ''), location_precision, " + deliveryColumns + ", " + attributeColumns + ", " + bundleIDColumn + ", expires_at"
+
+// furnitureQuery accumulates WHERE conditions and their positional
+// arguments so every endpoint listing furniture filters the same way.
+type furnitureQuery struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg registers a query argument and returns its placeholder.
+func (q *furnitureQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *furnitureQuery) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+func (q *furnitureQuery) whereClause() string {
+	if len(q.conditions) == 0 {
+		return " WHERE 1=1"
 	}
+	return " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// Filter dimensions. Facets rebuild the filter without their own dimension
+// so that, for example, tag counts are not narrowed by the selected tags.
+const (
+	filterTags        = "tags"
+	filterOfferType   = "offerType"
+	filterCategory    = "category"
+	filterPrice       = "price"
+	filterVoivodeship = "voivodeship"
+	filterCity        = "city"
+	filterCondition   = "condition"
+	filterMaterial    = "material"
+	filterColor       = "color"
+)
+
+// maxListingPrice is the largest amount the DECIMAL(10, 2) price columns hold.
+const maxListingPrice = 99999999.99
+
+// effectivePriceSQL is what a buyer pays: giveaways and free items cost
+// nothing, Sell listings without a price are unknown and auctions cost the
+// current bid.
+const effectivePriceSQL = "(CASE WHEN offer_type IN ('Sell', 'Auction') THEN price ELSE 0 END)"
+
+// furnitureFilterFromRequest builds the filter shared by the listing,
+// export and feed endpoints from the request's query parameters.
+// The returned error is meant for the client, e.g. a malformed tag query.
+func furnitureFilterFromRequest(r *http.Request) (*furnitureQuery, error) {
+	return furnitureFilterExcept(r, "")
+}
 
-	// Get tags and offer type from query parameters
+// furnitureFilterExcept builds the request filter leaving out one dimension.
+func furnitureFilterExcept(r *http.Request, skip string) (*furnitureQuery, error) {
+	q := &furnitureQuery{}
+
+	// Get search text, tags, offer type, category and price range from query parameters
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
 	tags := r.URL.Query()["tags"]
+	tagMode := r.URL.Query().Get("tagMode")
+	excludeTags := r.URL.Query()["excludeTags"]
+	tagQuery := r.URL.Query().Get("tagQuery")
 	offerType := r.URL.Query().Get("offerType")
-	
-	// Build the query
-	query := `
-		SELECT id, title, url, tags, seller, location, offer_type, latitude, longitude
-		FROM furniture 
-		WHERE 1=1
-	`
-	
-	var args []interface{}
-	argIndex := 1
-	
+	category := r.URL.Query().Get("category")
+	minPrice, minErr := strconv.ParseFloat(r.URL.Query().Get("minPrice"), 64)
+	maxPrice, maxErr := strconv.ParseFloat(r.URL.Query().Get("maxPrice"), 64)
+
+	// Add free-text search over title, tags, category and location
+	if search != "" {
+		searchFilter(q, search)
+	}
+
 	// Add tag filtering if tags are provided
-	if len(tags) > 0 {
-		// Create placeholders for the IN clause
-		placeholders := make([]string, len(tags))
-		for i := range tags {
-			placeholders[i] = fmt.Sprintf("$%d", argIndex)
-			args = append(args, tags[i])
-			argIndex++
+	if slugs := normalizeTags(tags); len(slugs) > 0 {
+		switch tagMode {
+		case "", "any":
+			// Use array overlap operator to check if any of the furniture tags match the
+			// requested tags, after mapping synonyms onto their canonical slugs
+			if skip != filterTags {
+				q.where("tags && " + canonicalTagsSQL(q.arg(pq.Array(slugs))))
+			}
+		case "all":
+			// Containment requires every requested tag; this narrows rather than
+			// widens, so it also applies when computing the tag facet
+			q.where("tags @> " + canonicalTagsSQL(q.arg(pq.Array(slugs))))
+		default:
+			return nil, fmt.Errorf("tagMode must be all or any")
 		}
-		
-		// Use array overlap operator to check if any of the furniture tags match the requested tags
-		query += fmt.Sprintf(" AND tags && ARRAY[%s]", strings.Join(placeholders, ","))
 	}
-	
+
+	// Exclude listings carrying any of the excluded tags
+	if slugs := normalizeTags(excludeTags); len(slugs) > 0 {
+		q.where("NOT (tags && " + canonicalTagsSQL(q.arg(pq.Array(slugs))) + ")")
+	}
+
+	// Add the boolean tag expression if provided
+	if tagQuery != "" {
+		condition, err := compileTagQuery(q, tagQuery)
+		if err != nil {
+			return nil, err
+		}
+		q.where(condition)
+	}
+
 	// Add offer type filtering if provided
-	if offerType != "" {
-		query += fmt.Sprintf(" AND offer_type = $%d", argIndex)
-		args = append(args, offerType)
-		argIndex++
-	}
-	
-	query += " ORDER BY id"
-	
+	if offerType != "" && skip != filterOfferType {
+		q.where("offer_type = " + q.arg(offerType))
+	}
+
+	// Add category filtering, including all descendant categories
+	if category != "" && skip != filterCategory {
+		categoryFilter(q, category)
+	}
+
+	// Add voivodeship and city filtering if provided
+	if err := locationFilter(q, r, skip); err != nil {
+		return nil, err
+	}
+
+	// Add dimension, condition, material and color filtering if provided
+	if err := attributeFilter(q, r, skip); err != nil {
+		return nil, err
+	}
+
+	// Add radius search around a point, measured on the true coordinates
+	if near := r.URL.Query().Get("near"); near != "" {
+		lat, lng, err := parseLatLng(near)
+		if err != nil {
+			return nil, fmt.Errorf("near %v", err)
+		}
+		radiusKm, err := strconv.ParseFloat(r.URL.Query().Get("radiusKm"), 64)
+		if err != nil || radiusKm <= 0 {
+			return nil, fmt.Errorf("radiusKm must be a positive number")
+		}
+		q.where("latitude IS NOT NULL AND " + distanceKmSQL("latitude", "longitude", q.arg(lat), q.arg(lng)) + " <= " + q.arg(radiusKm))
+	}
+
+	// Add "delivers to me" filtering for a buyer location
+	if deliversTo := r.URL.Query().Get("deliversTo"); deliversTo != "" {
+		lat, lng, err := parseBuyerLocation(deliversTo)
+		if err != nil {
+			return nil, fmt.Errorf("deliversTo %v", err)
+		}
+		deliversToFilter(q, lat, lng)
+	}
+
+	// Leave out expired listings unless they are asked for explicitly.
+	// Listings removed by moderators are never shown.
+	q.where("removed_at IS NULL")
+	if r.URL.Query().Get("includeExpired") != "true" {
+		q.where("expires_at > CURRENT_TIMESTAMP")
+	}
+
+	// Add price range filtering if provided
+	if skip != filterPrice {
+		if minErr == nil {
+			q.where(effectivePriceSQL + " >= " + q.arg(minPrice))
+		}
+		if maxErr == nil {
+			q.where(effectivePriceSQL + " <= " + q.arg(maxPrice))
+		}
+	}
+
+	return q, nil
+}
+
+func furnitureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := "SELECT " + furnitureColumns + " FROM furniture" + q.whereClause() + " ORDER BY id"
+
 	// Execute the query
-	rows, err := db.Query(query, args...)
+	rows, err := db.Query(query, q.args...)
 	if err != nil {
 		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
-	
+
 	var furniture []Furniture
 	for rows.Next() {
-		var item Furniture
-		var tagsStr string
-		var lat, lng *float64
-		err := rows.Scan(&item.ID, &item.Title, &item.URL, &tagsStr, &item.Seller, &item.Location, &item.OfferType, &lat, &lng)
+		item, err := scanFurniture(rows)
 		if err != nil {
 			respondWithError(w, "Error scanning furniture data", http.StatusInternalServerError)
 			return
 		}
-		
-		// Parse tags string to array
-		item.Tags = parseTags(tagsStr)
-		
-		// Set coordinates if they exist
-		if lat != nil {
-			item.Latitude = lat
-		}
-		if lng != nil {
-			item.Longitude = lng
-		}
-		
 		furniture = append(furniture, item)
 	}
-	
+
 	if err = rows.Err(); err != nil {
 		respondWithError(w, "Error iterating furniture data", http.StatusInternalServerError)
 		return
 	}
-	
+
+	// Facets are opt-in because they cost several extra aggregate queries
+	var facets *FurnitureFacets
+	if r.URL.Query().Get("facets") == "true" {
+		facets, err = furnitureFacets(r)
+		if err != nil {
+			log.Printf("Error computing furniture facets: %v", err)
+			respondWithError(w, "Error computing furniture facets", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Suggest a correction for searches that found nothing; a failure here
+	// should not hide the (empty) results
+	var suggestion string
+	if search := strings.TrimSpace(r.URL.Query().Get("q")); search != "" && len(furniture) == 0 {
+		suggestion, err = didYouMean(r.Context(), search)
+		if err != nil {
+			log.Printf("Error computing search suggestion: %v", err)
+		}
+	}
+
 	respondWithJSON(w, FurnitureResponse{
-		Furniture: furniture,
-		Total:     len(furniture),
+		Furniture:  furniture,
+		Total:      len(furniture),
+		Facets:     facets,
+		DidYouMean: suggestion,
 	}, http.StatusOK)
 }
 
-func parseTags(tagsStr string) []string {
-	// Remove curly braces and split by comma
-	tagsStr = strings.Trim(tagsStr, "{}")
-	if tagsStr == "" {
-		return []string{}
+// scanFurniture reads one row selected with furnitureColumns. Callers that
+// select additional columns after those pass their destinations as extra.
+func scanFurniture(rows *sql.Rows, extra ...interface{}) (Furniture, error) {
+	var item Furniture
+	var lat, lng, price *float64
+	var pickup, courier bool
+	var radiusKm, feePerKm, courierFee *float64
+	var widthCm, depthCm, heightCm *float64
+	var condition, material, color string
+	dest := []interface{}{&item.ID, &item.Title, &item.URL, pq.Array(&item.Tags), &item.Seller, &item.Location, &item.OfferType, &lat, &lng, &price, &item.CategoryID, &item.City, &item.Voivodeship, &item.PostalCode, &item.LocationPrecision,
+		&pickup, &radiusKm, &feePerKm, &courier, &courierFee,
+		&widthCm, &depthCm, &heightCm, &condition, &material, &color, &item.BundleID, &item.ExpiresAt}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return item, err
 	}
-	return strings.Split(tagsStr, ",")
-} 
\ No newline at end of file
+	item.Delivery = deliveryOptionsFrom(pickup, radiusKm, feePerKm, courier, courierFee)
+	item.PhysicalAttributes = attributesFrom(widthCm, depthCm, heightCm, condition, material, color)
+
+	// Set coordinates if they exist
+	if lat != nil {
+		item.Latitude = lat
+	}
+	if lng != nil {
+		item.Longitude = lng
+	}
+	item.Price = price
+
+	return item, nil
+}
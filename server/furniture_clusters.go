@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxMapZoom = 22
+	// pointsZoom is the zoom from which listings are sent individually.
+	pointsZoom = 15
+	// clusterCellsPerTile sets the grid density: a 256px map tile is split
+	// into this many cells per side, i.e. roughly 64px per cluster.
+	clusterCellsPerTile = 4
+	// clusterSampleSize is how many representative listings each cluster
+	// carries for previews.
+	clusterSampleSize = 3
+	maxMapPoints      = 1000
+)
+
+type MapCluster struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+	// Bounds is [minLng, minLat, maxLng, maxLat] of the clustered listings,
+	// for zooming the map onto a cluster.
+	Bounds []float64   `json:"bounds"`
+	Items  []Furniture `json:"items"`
+}
+
+type FurnitureClustersResponse struct {
+	Zoom      int          `json:"zoom"`
+	Clusters  []MapCluster `json:"clusters"`
+	Points    []Furniture  `json:"points"`
+	Total     int          `json:"total"`
+	Truncated bool         `json:"truncated,omitempty"`
+}
+
+// parseBBox reads "minLng,minLat,maxLng,maxLat".
+func parseBBox(value string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return bbox, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+		}
+		bbox[i] = n
+	}
+	if bbox[0] < -180 || bbox[2] > 180 || bbox[1] < -90 || bbox[3] > 90 || bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return bbox, fmt.Errorf("bbox is out of range")
+	}
+	return bbox, nil
+}
+
+// clusterCellSize is the grid cell width in degrees at a zoom level.
+func clusterCellSize(zoom int) float64 {
+	return 360 / math.Pow(2, float64(zoom)) / clusterCellsPerTile
+}
+
+func furnitureClustersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bbox, err := parseBBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 || zoom > maxMapZoom {
+		respondWithError(w, fmt.Sprintf("zoom must be between 0 and %d", maxMapZoom), http.StatusBadRequest)
+		return
+	}
+
+	// Clusters honour the same filters as the listing endpoint
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The map only ever sees public coordinates, so clusters cannot reveal
+	// a private seller's true position through their bounds or centroid
+	q.where("public_latitude IS NOT NULL AND public_longitude IS NOT NULL")
+	q.where("public_longitude BETWEEN " + q.arg(bbox[0]) + " AND " + q.arg(bbox[2]))
+	q.where("public_latitude BETWEEN " + q.arg(bbox[1]) + " AND " + q.arg(bbox[3]))
+
+	response := FurnitureClustersResponse{Zoom: zoom, Clusters: []MapCluster{}, Points: []Furniture{}}
+
+	if zoom >= pointsZoom {
+		response.Points, response.Truncated, err = mapPoints(q)
+		if err != nil {
+			respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+			return
+		}
+		response.Total = len(response.Points)
+		respondWithJSON(w, response, http.StatusOK)
+		return
+	}
+
+	cell := q.arg(clusterCellSize(zoom))
+	query := fmt.Sprintf(`
+		SELECT COUNT(*), AVG(public_latitude), AVG(public_longitude),
+			MIN(public_longitude), MIN(public_latitude), MAX(public_longitude), MAX(public_latitude),
+			(array_agg(id ORDER BY id DESC))[1:%d]
+		FROM furniture%s
+		GROUP BY floor(public_longitude / %s), floor(public_latitude / %s)
+		ORDER BY 1 DESC`, clusterSampleSize, q.whereClause(), cell, cell)
+
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		respondWithError(w, "Error fetching clusters", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Single-listing cells are sent as points; the rest become clusters
+	// whose sample listings are loaded in one follow-up query.
+	var sampleIDs []int64
+	var clusterSamples [][]int64
+	var pointIDs []int64
+	for rows.Next() {
+		var c MapCluster
+		var minLng, minLat, maxLng, maxLat float64
+		var ids []int64
+		if err := rows.Scan(&c.Count, &c.Latitude, &c.Longitude, &minLng, &minLat, &maxLng, &maxLat, pq.Array(&ids)); err != nil {
+			respondWithError(w, "Error scanning cluster data", http.StatusInternalServerError)
+			return
+		}
+		response.Total += c.Count
+		if c.Count == 1 {
+			pointIDs = append(pointIDs, ids...)
+			continue
+		}
+		c.Bounds = []float64{minLng, minLat, maxLng, maxLat}
+		c.Items = []Furniture{}
+		response.Clusters = append(response.Clusters, c)
+		clusterSamples = append(clusterSamples, ids)
+		sampleIDs = append(sampleIDs, ids...)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating cluster data", http.StatusInternalServerError)
+		return
+	}
+
+	items, err := furnitureByIDs(append(sampleIDs, pointIDs...))
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	for i, ids := range clusterSamples {
+		for _, id := range ids {
+			if item, ok := items[int(id)]; ok {
+				response.Clusters[i].Items = append(response.Clusters[i].Items, item)
+			}
+		}
+	}
+	for _, id := range pointIDs {
+		if item, ok := items[int(id)]; ok {
+			response.Points = append(response.Points, item)
+		}
+	}
+
+	respondWithJSON(w, response, http.StatusOK)
+}
+
+// mapPoints returns the individual listings matching q, reporting whether
+// there were more than maxMapPoints.
+func mapPoints(q *furnitureQuery) ([]Furniture, bool, error) {
+	query := "SELECT " + furnitureColumns + " FROM furniture" + q.whereClause() +
+		" ORDER BY id DESC LIMIT " + strconv.Itoa(maxMapPoints+1)
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	points := []Furniture{}
+	for rows.Next() {
+		item, err := scanFurniture(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		points = append(points, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(points) > maxMapPoints {
+		return points[:maxMapPoints], true, nil
+	}
+	return points, false, nil
+}
+
+// furnitureByIDs loads listings keyed by id.
+func furnitureByIDs(ids []int64) (map[int]Furniture, error) {
+	items := make(map[int]Furniture, len(ids))
+	if len(ids) == 0 {
+		return items, nil
+	}
+
+	rows, err := db.Query("SELECT "+furnitureColumns+" FROM furniture WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanFurniture(rows)
+		if err != nil {
+			return nil, err
+		}
+		items[item.ID] = item
+	}
+	return items, rows.Err()
+}
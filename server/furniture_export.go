@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const feedCacheMaxAge = 15 * time.Minute
+
+// exportColumns mirrors the import format so a backup can be re-imported.
+var exportColumns = []string{"id", "sku", "title", "tags", "category", "location", "city", "voivodeship", "postalCode", "address", "locationPrecision", "offerType", "latitude", "longitude", "price", "imageUrls",
+	"pickup", "deliveryRadiusKm", "deliveryFeePerKm", "courier", "courierFee",
+	"widthCm", "depthCm", "heightCm", "condition", "material", "color"}
+
+// exportedFurniture is a listing together with the seller-only fields
+// included in exports and feeds.
+type exportedFurniture struct {
+	Furniture
+	SKU       string   `json:"sku,omitempty"`
+	Category  string   `json:"category"`
+	ImageURLs []string `json:"imageUrls"`
+	Address   string   `json:"address,omitempty"`
+
+	// The seller's true coordinates, which only their own export may show.
+	exactLatitude  *float64
+	exactLongitude *float64
+}
+
+// withExactLocation replaces the public coordinates with the true ones.
+func (item exportedFurniture) withExactLocation() exportedFurniture {
+	item.Latitude = item.exactLatitude
+	item.Longitude = item.exactLongitude
+	return item
+}
+
+type merchantItem struct {
+	XMLName              xml.Name `xml:"item"`
+	ID                   string   `xml:"g:id"`
+	Title                string   `xml:"title"`
+	Description          string   `xml:"description"`
+	Link                 string   `xml:"link"`
+	ImageLink            string   `xml:"g:image_link"`
+	AdditionalImageLinks []string `xml:"g:additional_image_link"`
+	Availability         string   `xml:"g:availability"`
+	Condition            string   `xml:"g:condition"`
+	Price                string   `xml:"g:price"`
+	ProductType          string   `xml:"g:product_type,omitempty"`
+}
+
+type feedItem struct {
+	ID          int      `json:"id"`
+	Title       string   `json:"title"`
+	Link        string   `json:"link"`
+	ImageURLs   []string `json:"imageUrls"`
+	Tags        []string `json:"tags"`
+	Category    string   `json:"category"`
+	Seller      string   `json:"seller"`
+	Location    string   `json:"location"`
+	City        string   `json:"city"`
+	Voivodeship string   `json:"voivodeship"`
+	OfferType   string   `json:"offerType"`
+	Price       float64  `json:"price"`
+	Currency    string   `json:"currency"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+}
+
+func furnitureExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		respondWithError(w, "Export format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.where("user_id = " + q.arg(userID))
+
+	rows, err := queryExportedFurniture(q)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("furniture-export-%s.%s", time.Now().Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = streamFurnitureCSV(w, rows)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = streamFurnitureJSON(w, rows, func(item exportedFurniture) interface{} { return item.withExactLocation() }, "")
+	}
+	if err != nil {
+		// Headers are already sent, so the best we can do is log and cut the stream.
+		log.Printf("Error streaming furniture export: %v", err)
+	}
+}
+
+func productFeedXMLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Merchant feeds require a price; Sell listings without one are left out.
+	q.where(fmt.Sprintf("(price IS NOT NULL OR offer_type <> %s)", q.arg(OfferTypeSell)))
+
+	if notModified := writeFeedCacheHeaders(w, r, q); notModified {
+		return
+	}
+
+	rows, err := queryExportedFurniture(q)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	if err := streamMerchantFeed(w, rows); err != nil {
+		log.Printf("Error streaming XML product feed: %v", err)
+	}
+}
+
+func productFeedJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := furnitureFilterFromRequest(r)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if notModified := writeFeedCacheHeaders(w, r, q); notModified {
+		return
+	}
+
+	rows, err := queryExportedFurniture(q)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	header := fmt.Sprintf(`"title":"FurnitureHub","link":%q,"generatedAt":%q,`,
+		publicURL(), time.Now().UTC().Format(time.RFC3339))
+	if err := streamFurnitureJSON(w, rows, toFeedItem, header); err != nil {
+		log.Printf("Error streaming JSON product feed: %v", err)
+	}
+}
+
+func queryExportedFurniture(q *furnitureQuery) (*sql.Rows, error) {
+	query := "SELECT " + furnitureColumns + ", COALESCE(external_sku, ''), images, " +
+		"(SELECT slug FROM categories WHERE categories.id = furniture.category_id), latitude, longitude, COALESCE(address, '') FROM furniture" +
+		q.whereClause() + " ORDER BY id"
+	return db.Query(query, q.args...)
+}
+
+func scanExportedFurniture(rows *sql.Rows) (exportedFurniture, error) {
+	var item exportedFurniture
+	var images []string
+	furniture, err := scanFurniture(rows, &item.SKU, pq.Array(&images), &item.Category, &item.exactLatitude, &item.exactLongitude, &item.Address)
+	if err != nil {
+		return item, err
+	}
+	item.Furniture = furniture
+
+	// Older listings only have the primary url.
+	item.ImageURLs = images
+	if len(item.ImageURLs) == 0 {
+		item.ImageURLs = []string{item.URL}
+	}
+
+	return item, nil
+}
+
+// writeFeedCacheHeaders sets validators for the public feeds and reports
+// whether the client's cached copy is still current. The ETag hashes the id
+// and last change of every listing in the feed, so it also changes when a
+// listing leaves the feed by expiring or being removed, which a maximum of
+// updated_at would not show.
+func writeFeedCacheHeaders(w http.ResponseWriter, r *http.Request, q *furnitureQuery) bool {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(feedCacheMaxAge.Seconds())))
+
+	var digest string
+	query := "SELECT md5(COALESCE(string_agg(id || ':' || COALESCE(updated_at, created_at), ',' ORDER BY id), '')) FROM furniture" +
+		q.whereClause()
+	if err := db.QueryRow(query, q.args...).Scan(&digest); err != nil {
+		return false
+	}
+
+	etag := `"` + digest + `"`
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/"); candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamFurnitureJSON writes {<header>"items":[...],"total":n} one item at a
+// time so large catalogs are never held in memory.
+func streamFurnitureJSON[T any](w io.Writer, rows *sql.Rows, convert func(exportedFurniture) T, header string) error {
+	if _, err := io.WriteString(w, "{"+header+`"items":[`); err != nil {
+		return err
+	}
+
+	total := 0
+	for rows.Next() {
+		item, err := scanExportedFurniture(rows)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(convert(item))
+		if err != nil {
+			return err
+		}
+		if total > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		total++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, `],"total":%d}`, total)
+	return err
+}
+
+func streamFurnitureCSV(w io.Writer, rows *sql.Rows) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		item, err := scanExportedFurniture(rows)
+		if err != nil {
+			return err
+		}
+		item = item.withExactLocation()
+
+		var radiusKm, feePerKm, courierFee *float64
+		var widthCm, depthCm, heightCm *float64
+		if d := item.Dimensions; d != nil {
+			widthCm, depthCm, heightCm = d.WidthCm, d.DepthCm, d.HeightCm
+		}
+		if own := item.Delivery.OwnDelivery; own != nil {
+			radiusKm, feePerKm = &own.RadiusKm, &own.FeePerKm
+		}
+		if item.Delivery.Courier != nil {
+			courierFee = item.Delivery.Courier.Fee
+		}
+
+		err = writer.Write([]string{
+			strconv.Itoa(item.ID),
+			item.SKU,
+			item.Title,
+			strings.Join(item.Tags, "|"),
+			item.Category,
+			item.Location,
+			item.City,
+			item.Voivodeship,
+			item.PostalCode,
+			item.Address,
+			item.LocationPrecision,
+			item.OfferType,
+			formatOptionalFloat(item.Latitude),
+			formatOptionalFloat(item.Longitude),
+			formatOptionalFloat(item.Price),
+			strings.Join(item.ImageURLs, "|"),
+			strconv.FormatBool(item.Delivery.Pickup),
+			formatOptionalFloat(radiusKm),
+			formatOptionalFloat(feePerKm),
+			strconv.FormatBool(item.Delivery.Courier != nil),
+			formatOptionalFloat(courierFee),
+			formatOptionalFloat(widthCm),
+			formatOptionalFloat(depthCm),
+			formatOptionalFloat(heightCm),
+			item.Condition,
+			item.Material,
+			item.Color,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func streamMerchantFeed(w io.Writer, rows *sql.Rows) error {
+	header := xml.Header + `<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0"><channel>`
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	channel := []struct {
+		name, value string
+	}{
+		{"title", "FurnitureHub"},
+		{"link", publicURL()},
+		{"description", "Furniture listings from across Poland"},
+	}
+	for _, element := range channel {
+		if err := encoder.EncodeElement(element.value, xml.StartElement{Name: xml.Name{Local: element.name}}); err != nil {
+			return err
+		}
+	}
+
+	for rows.Next() {
+		item, err := scanExportedFurniture(rows)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(toMerchantItem(item)); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</channel></rss>")
+	return err
+}
+
+func toMerchantItem(item exportedFurniture) merchantItem {
+	return merchantItem{
+		ID:                   strconv.Itoa(item.ID),
+		Title:                item.Title,
+		Description:          fmt.Sprintf("%s - %s", item.Title, item.Location),
+		Link:                 listingURL(item.ID),
+		ImageLink:            item.ImageURLs[0],
+		AdditionalImageLinks: item.ImageURLs[1:],
+		Availability:         "in_stock",
+		Condition:            merchantCondition(item.Condition),
+		Price:                fmt.Sprintf("%.2f PLN", listingPrice(item.Furniture)),
+		ProductType:          item.Category,
+	}
+}
+
+// merchantCondition maps a listing condition onto the feed's new or used;
+// listings without one are second-hand like most of the catalog.
+func merchantCondition(condition string) string {
+	if condition == ConditionNew {
+		return "new"
+	}
+	return "used"
+}
+
+func toFeedItem(item exportedFurniture) feedItem {
+	return feedItem{
+		ID:          item.ID,
+		Title:       item.Title,
+		Link:        listingURL(item.ID),
+		ImageURLs:   item.ImageURLs,
+		Tags:        item.Tags,
+		Category:    item.Category,
+		Seller:      item.Seller,
+		Location:    item.Location,
+		City:        item.City,
+		Voivodeship: item.Voivodeship,
+		OfferType:   item.OfferType,
+		Price:       listingPrice(item.Furniture),
+		Currency:    "PLN",
+		Latitude:    item.Latitude,
+		Longitude:   item.Longitude,
+	}
+}
+
+// listingPrice treats giveaways and free items as costing nothing; an
+// auction's price is its current bid.
+func listingPrice(item Furniture) float64 {
+	if (item.OfferType != OfferTypeSell && item.OfferType != OfferTypeAuction) || item.Price == nil {
+		return 0
+	}
+	return *item.Price
+}
+
+func formatOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// publicURL is the address of the client application used in links that
+// leave the API, such as feeds and emails.
+func publicURL() string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:3000"
+}
+
+func listingURL(id int) string {
+	return fmt.Sprintf("%s/furniture/%d", publicURL(), id)
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 5000
+)
+
+// ImportRow is one listing in a bulk import. SKU is the seller's own
+// identifier and is what makes re-importing the same file an update.
+type ImportRow struct {
+	SKU      string   `json:"sku"`
+	Title    string   `json:"title"`
+	Tags     []string `json:"tags"`
+	Category string   `json:"category"`
+	Location string   `json:"location"`
+	// City, Voivodeship and PostalCode take precedence over Location, which
+	// is still accepted as "City, Voivodeship" for older files
+	City        string `json:"city"`
+	Voivodeship string `json:"voivodeship"`
+	PostalCode  string `json:"postalCode"`
+	// Address is only shown to buyers with an accepted reservation, and
+	// LocationPrecision controls how much the public coordinates are fuzzed
+	Address           string   `json:"address"`
+	LocationPrecision string   `json:"locationPrecision"`
+	OfferType         string   `json:"offerType"`
+	Latitude          *float64 `json:"latitude,omitempty"`
+	Longitude         *float64 `json:"longitude,omitempty"`
+	Price             *float64 `json:"price,omitempty"`
+	ImageURLs         []string `json:"imageUrls"`
+	// Delivery defaults to pickup only
+	Delivery *DeliveryOptions `json:"delivery,omitempty"`
+	PhysicalAttributes
+}
+
+type ImportError struct {
+	Row     int    `json:"row,omitempty"`
+	SKU     string `json:"sku,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	DryRun  bool          `json:"dryRun"`
+	Total   int           `json:"total"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors"`
+	// Warnings lists new listings that look like duplicates of live ones
+	Warnings []ImportError `json:"warnings"`
+}
+
+type importRecord struct {
+	row    int
+	item   ImportRow
+	errors []ImportError
+}
+
+// importColumns maps normalized CSV headers onto ImportRow fields. The id
+// column is accepted and ignored so exported catalogs can be re-imported.
+var importColumns = map[string]string{
+	"id":                "",
+	"sku":               "sku",
+	"externalsku":       "sku",
+	"title":             "title",
+	"tags":              "tags",
+	"category":          "category",
+	"location":          "location",
+	"city":              "city",
+	"voivodeship":       "voivodeship",
+	"province":          "voivodeship",
+	"postalcode":        "postalCode",
+	"postcode":          "postalCode",
+	"zipcode":           "postalCode",
+	"address":           "address",
+	"street":            "address",
+	"locationprecision": "locationPrecision",
+	"offertype":         "offerType",
+	"latitude":          "latitude",
+	"lat":               "latitude",
+	"longitude":         "longitude",
+	"lng":               "longitude",
+	"lon":               "longitude",
+	"imageurls":         "imageUrls",
+	"imageurl":          "imageUrls",
+	"images":            "imageUrls",
+	"url":               "imageUrls",
+	"pickup":            "pickup",
+	"deliveryradiuskm":  "deliveryRadiusKm",
+	"deliveryfeeperkm":  "deliveryFeePerKm",
+	"courier":           "courier",
+	"courierfee":        "courierFee",
+	"dimensions":        "dimensions",
+	"size":              "dimensions",
+	"widthcm":           "widthCm",
+	"width":             "widthCm",
+	"depthcm":           "depthCm",
+	"depth":             "depthCm",
+	"heightcm":          "heightCm",
+	"height":            "heightCm",
+	"condition":         "condition",
+	"material":          "material",
+	"color":             "color",
+	"colour":            "color",
+	"price":             "price",
+}
+
+func furnitureImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/json":
+			format = "json"
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var records []importRecord
+	var err error
+	switch format {
+	case "csv":
+		records, err = parseImportCSV(body)
+	case "json":
+		records, err = parseImportJSON(body)
+	default:
+		respondWithError(w, "Import format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(records) == 0 {
+		respondWithError(w, "Import contains no rows", http.StatusBadRequest)
+		return
+	}
+	if len(records) > maxImportRows {
+		respondWithError(w, fmt.Sprintf("Import is limited to %d rows", maxImportRows), http.StatusBadRequest)
+		return
+	}
+
+	categories, err := categoryIDsBySlug()
+	if err != nil {
+		respondWithError(w, "Error fetching categories", http.StatusInternalServerError)
+		return
+	}
+
+	validateImportRecords(records, categories)
+
+	var seller string
+	if err := db.QueryRow("SELECT name FROM users WHERE id = $1", userID).Scan(&seller); err != nil {
+		respondWithError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := importFurniture(r.Context(), userID, seller, records, categories, dryRun)
+	if err != nil {
+		log.Printf("Error importing furniture: %v", err)
+		respondWithError(w, "Error importing furniture", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, result, http.StatusOK)
+}
+
+// importFurniture upserts every valid record in a single transaction, each
+// under its own savepoint so a failing row only fails itself. A dry run
+// performs the same statements and rolls back, so the reported counts match
+// what a real import would do.
+func importFurniture(ctx context.Context, userID int, seller string, records []importRecord, categories map[string]int, dryRun bool) (ImportResult, error) {
+	result := ImportResult{DryRun: dryRun, Total: len(records), Errors: []ImportError{}, Warnings: []ImportError{}}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for _, record := range records {
+		if len(record.errors) > 0 {
+			result.Failed++
+			result.Errors = append(result.Errors, record.errors...)
+			continue
+		}
+
+		// A row the database rejects is rolled back to its savepoint and
+		// reported, so the rest of the file is still imported
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+			return result, err
+		}
+		_, inserted, duplicates, err := upsertImportRow(ctx, tx, userID, seller, record.item, categories[record.item.Category])
+		if err != nil {
+			if _, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_row"); rollbackErr != nil {
+				return result, rollbackErr
+			}
+			result.Failed++
+			var duplicateErr *DuplicateError
+			if errors.As(err, &duplicateErr) {
+				result.Errors = append(result.Errors, duplicateImportError(record, duplicateErr.DuplicateMatch))
+			} else {
+				log.Printf("Error importing row %d for user %d: %v", record.row, userID, err)
+				result.Errors = append(result.Errors, ImportError{
+					Row: record.row, SKU: record.item.SKU, Field: "listing", Message: "could not be saved",
+				})
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT import_row"); err != nil {
+			return result, err
+		}
+		// Flagged duplicates are for moderators, not the seller
+		if duplicateAction == DuplicateWarn {
+			for _, m := range duplicates {
+				result.Warnings = append(result.Warnings, duplicateImportError(record, m))
+			}
+		}
+		if inserted {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	return result, tx.Commit()
+}
+
+// upsertImportRow inserts a validated listing, or updates the seller's
+// listing with the same SKU, and announces it to webhooks and matching
+// wanted posts. New listings are checked for duplicates first: depending
+// on duplicateAction a *DuplicateError is returned, or the listing is
+// created and the duplicates it resembles are returned and recorded.
+func upsertImportRow(ctx context.Context, tx *sql.Tx, userID int, seller string, item ImportRow, categoryID int) (Furniture, bool, []DuplicateMatch, error) {
+	if err := setRevisionActor(ctx, tx, userID); err != nil {
+		return Furniture{}, false, nil, err
+	}
+
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM furniture WHERE user_id = $1 AND external_sku = $2)",
+		userID, item.SKU).Scan(&exists)
+	if err != nil {
+		return Furniture{}, false, nil, err
+	}
+	var duplicates []DuplicateMatch
+	if !exists {
+		duplicates, err = findDuplicates(ctx, tx, duplicateCandidate{
+			userID:  userID,
+			title:   item.Title,
+			images:  item.ImageURLs,
+			city:    item.City,
+			address: item.Address,
+		})
+		if err != nil {
+			return Furniture{}, false, nil, err
+		}
+		if len(duplicates) > 0 && duplicateAction == DuplicateBlock {
+			return Furniture{}, false, nil, &DuplicateError{duplicates[0]}
+		}
+	}
+
+	item.Tags, err = resolveTags(ctx, tx, item.Tags)
+	if err != nil {
+		return Furniture{}, false, nil, err
+	}
+
+	furniture := Furniture{
+		Title:       item.Title,
+		URL:         item.ImageURLs[0],
+		Tags:        item.Tags,
+		Seller:      seller,
+		Location:    item.Location,
+		City:        item.City,
+		Voivodeship: item.Voivodeship,
+		PostalCode:  item.PostalCode,
+		OfferType:   item.OfferType,
+		Latitude:    item.Latitude,
+		Longitude:   item.Longitude,
+		Price:       item.Price,
+		CategoryID:  categoryID,
+
+		LocationPrecision:  item.LocationPrecision,
+		Delivery:           *item.Delivery,
+		PhysicalAttributes: item.PhysicalAttributes,
+	}
+	publicLat, publicLng := fuzzCoordinates(item.Latitude, item.Longitude, item.LocationPrecision, item.City, item.Voivodeship)
+
+	args := append([]interface{}{
+		userID, item.SKU, item.Title, furniture.URL, pq.Array(item.ImageURLs), pq.Array(item.Tags),
+		seller, item.Location, item.City, item.Voivodeship, item.PostalCode, item.Address, item.LocationPrecision,
+		item.OfferType, item.Latitude, item.Longitude, publicLat, publicLng, item.Price, furniture.CategoryID,
+	}, item.Delivery.columnValues()...)
+	args = append(args, item.PhysicalAttributes.columnValues()...)
+
+	var inserted bool
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO furniture (user_id, external_sku, title, url, images, tags, seller, location, city, voivodeship, postal_code,
+			address, location_precision, offer_type, latitude, longitude, public_latitude, public_longitude, price, category_id,
+			`+deliveryColumns+`, width_cm, depth_cm, height_cm, condition, material, color)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''), $13, $14, $15, $16, $17, $18, $19, $20,
+			$21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31)
+		ON CONFLICT (user_id, external_sku) DO UPDATE SET
+			title = EXCLUDED.title,
+			url = EXCLUDED.url,
+			images = EXCLUDED.images,
+			tags = EXCLUDED.tags,
+			seller = EXCLUDED.seller,
+			location = EXCLUDED.location,
+			city = EXCLUDED.city,
+			voivodeship = EXCLUDED.voivodeship,
+			postal_code = EXCLUDED.postal_code,
+			address = EXCLUDED.address,
+			location_precision = EXCLUDED.location_precision,
+			offer_type = CASE WHEN `+runningAuctionSQL+` THEN furniture.offer_type ELSE EXCLUDED.offer_type END,
+			latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude,
+			public_latitude = EXCLUDED.public_latitude,
+			public_longitude = EXCLUDED.public_longitude,
+			price = CASE WHEN `+runningAuctionSQL+` THEN furniture.price ELSE EXCLUDED.price END,
+			category_id = EXCLUDED.category_id,
+			pickup = EXCLUDED.pickup,
+			delivery_radius_km = EXCLUDED.delivery_radius_km,
+			delivery_fee_per_km = EXCLUDED.delivery_fee_per_km,
+			courier = EXCLUDED.courier,
+			courier_fee = EXCLUDED.courier_fee,
+			width_cm = EXCLUDED.width_cm,
+			depth_cm = EXCLUDED.depth_cm,
+			height_cm = EXCLUDED.height_cm,
+			condition = EXCLUDED.condition,
+			material = EXCLUDED.material,
+			color = EXCLUDED.color,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id, (xmax = 0)`, args...).Scan(&furniture.ID, &inserted)
+	if err != nil {
+		return furniture, false, nil, err
+	}
+
+	eventType := WebhookListingUpdated
+	if inserted {
+		eventType = WebhookListingCreated
+		if err := matchWantedPosts(ctx, tx, furniture.ID); err != nil {
+			return furniture, inserted, nil, err
+		}
+		if err := recordDuplicates(ctx, tx, furniture.ID, duplicates, duplicateAction); err != nil {
+			return furniture, inserted, nil, err
+		}
+	} else {
+		duplicates = nil
+	}
+
+	err = dispatchWebhookEvent(ctx, tx, userID, eventType, furniture)
+	return furniture, inserted, duplicates, err
+}
+
+func duplicateImportError(record importRecord, m DuplicateMatch) ImportError {
+	return ImportError{Row: record.row, SKU: record.item.SKU, Field: "listing", Message: (&DuplicateError{m}).Error()}
+}
+
+func parseImportJSON(body io.Reader) ([]importRecord, error) {
+	var items []ImportRow
+	if err := json.NewDecoder(body).Decode(&items); err != nil {
+		return nil, fmt.Errorf("Invalid JSON import: expected an array of listings")
+	}
+
+	records := make([]importRecord, len(items))
+	for i, item := range items {
+		records[i] = importRecord{row: i + 1, item: item}
+	}
+	return records, nil
+}
+
+func parseImportCSV(body io.Reader) ([]importRecord, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSV header: %v", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		field, ok := importColumns[normalizeImportColumn(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown CSV column: %s", name)
+		}
+		columns[i] = field
+	}
+
+	var records []importRecord
+	for row := 1; ; row++ {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV on row %d: %v", row, err)
+		}
+
+		record := importRecord{row: row}
+		delivery := pickupOnly
+		var hasDelivery bool
+		var radiusKm, feePerKm *float64
+		for i, value := range values {
+			value = strings.TrimSpace(value)
+			switch columns[i] {
+			case "sku":
+				record.item.SKU = value
+			case "title":
+				record.item.Title = value
+			case "tags":
+				record.item.Tags = splitImportList(value)
+			case "category":
+				record.item.Category = value
+			case "location":
+				record.item.Location = value
+			case "city":
+				record.item.City = value
+			case "voivodeship":
+				record.item.Voivodeship = value
+			case "postalCode":
+				record.item.PostalCode = value
+			case "address":
+				record.item.Address = value
+			case "locationPrecision":
+				record.item.LocationPrecision = value
+			case "offerType":
+				record.item.OfferType = value
+			case "condition":
+				record.item.Condition = value
+			case "material":
+				record.item.Material = value
+			case "color":
+				record.item.Color = value
+			case "dimensions":
+				if value == "" {
+					continue
+				}
+				width, depth, height, err := parseDimensionsCm(value)
+				if err != nil {
+					record.errors = append(record.errors, ImportError{Row: row, Field: columns[i], Message: err.Error()})
+					continue
+				}
+				record.item.Dimensions = &Dimensions{WidthCm: &width, DepthCm: &depth, HeightCm: &height}
+			case "widthCm", "depthCm", "heightCm":
+				if value == "" {
+					continue
+				}
+				cm, err := parseLengthCm(value)
+				if err != nil {
+					record.errors = append(record.errors, ImportError{Row: row, Field: columns[i], Message: err.Error()})
+					continue
+				}
+				if record.item.Dimensions == nil {
+					record.item.Dimensions = &Dimensions{}
+				}
+				switch columns[i] {
+				case "widthCm":
+					record.item.Dimensions.WidthCm = &cm
+				case "depthCm":
+					record.item.Dimensions.DepthCm = &cm
+				default:
+					record.item.Dimensions.HeightCm = &cm
+				}
+			case "imageUrls":
+				record.item.ImageURLs = append(record.item.ImageURLs, splitImportList(value)...)
+			case "pickup", "courier":
+				if value == "" {
+					continue
+				}
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					record.errors = append(record.errors, ImportError{
+						Row: row, Field: columns[i], Message: "must be true or false",
+					})
+					continue
+				}
+				hasDelivery = true
+				if columns[i] == "pickup" {
+					delivery.Pickup = enabled
+				} else if !enabled {
+					delivery.Courier = nil
+				} else if delivery.Courier == nil {
+					delivery.Courier = &CourierDelivery{}
+				}
+			case "latitude", "longitude", "price", "deliveryRadiusKm", "deliveryFeePerKm", "courierFee":
+				if value == "" {
+					continue
+				}
+				number, err := strconv.ParseFloat(value, 64)
+				if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+					record.errors = append(record.errors, ImportError{
+						Row: row, Field: columns[i], Message: "must be a number",
+					})
+					continue
+				}
+				switch columns[i] {
+				case "latitude":
+					record.item.Latitude = &number
+				case "longitude":
+					record.item.Longitude = &number
+				case "deliveryRadiusKm":
+					hasDelivery, radiusKm = true, &number
+				case "deliveryFeePerKm":
+					hasDelivery, feePerKm = true, &number
+				case "courierFee":
+					// A courier fee only matters when courier is offered
+					if delivery.Courier != nil {
+						delivery.Courier.Fee = &number
+					}
+				default:
+					record.item.Price = &number
+				}
+			}
+		}
+		if hasDelivery {
+			if radiusKm != nil {
+				delivery.OwnDelivery = &OwnDelivery{RadiusKm: *radiusKm}
+				if feePerKm != nil {
+					delivery.OwnDelivery.FeePerKm = *feePerKm
+				}
+			}
+			record.item.Delivery = &delivery
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// validateImportRecords appends field errors to each record, including
+// SKUs repeated within the same file.
+func validateImportRecords(records []importRecord, categories map[string]int) {
+	seen := make(map[string]int, len(records))
+
+	for i := range records {
+		record := &records[i]
+		item := &record.item
+		addError := func(field, message string) {
+			record.errors = append(record.errors, ImportError{Row: record.row, Field: field, Message: message})
+		}
+
+		item.SKU = strings.TrimSpace(item.SKU)
+		item.Title = strings.TrimSpace(item.Title)
+		item.Location = strings.TrimSpace(item.Location)
+		item.City = strings.TrimSpace(item.City)
+		item.Voivodeship = strings.TrimSpace(item.Voivodeship)
+		item.PostalCode = strings.TrimSpace(item.PostalCode)
+		item.Address = strings.TrimSpace(item.Address)
+
+		switch {
+		case item.SKU == "":
+			addError("sku", "is required")
+		case len(item.SKU) > 100:
+			addError("sku", "must be at most 100 characters")
+		default:
+			if first, ok := seen[item.SKU]; ok {
+				addError("sku", fmt.Sprintf("duplicates row %d", first))
+			} else {
+				seen[item.SKU] = record.row
+			}
+		}
+
+		if item.Title == "" {
+			addError("title", "is required")
+		} else if len(item.Title) > 255 {
+			addError("title", "must be at most 255 characters")
+		}
+
+		if item.OfferType == "" {
+			item.OfferType = OfferTypeSell
+		}
+		if item.OfferType == OfferTypeAuction {
+			addError("offerType", "auctions are started with PUT /api/furniture/{id}/auction")
+		} else if !isOfferType(item.OfferType) {
+			addError("offerType", fmt.Sprintf("must be one of %s", strings.Join(offerTypes, ", ")))
+		}
+
+		tags := item.Tags[:0]
+		for _, tag := range item.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		item.Tags = tags
+		if len(item.Tags) == 0 {
+			addError("tags", "at least one tag is required")
+		}
+		for _, tag := range item.Tags {
+			if normalizeTag(tag) == "" {
+				addError("tags", fmt.Sprintf("tag %q has no letters or digits", tag))
+			} else if len(tag) > 100 {
+				addError("tags", "each tag must be at most 100 characters")
+			}
+		}
+
+		item.Category = strings.TrimSpace(item.Category)
+		if item.Category == "" {
+			addError("category", "is required")
+		} else if _, ok := categories[item.Category]; !ok {
+			addError("category", fmt.Sprintf("unknown category: %s", item.Category))
+		}
+
+		if (item.Latitude == nil) != (item.Longitude == nil) {
+			addError("latitude", "latitude and longitude must be provided together")
+		}
+		if item.Latitude != nil && (*item.Latitude < -90 || *item.Latitude > 90) {
+			addError("latitude", "must be between -90 and 90")
+		}
+		if item.Longitude != nil && (*item.Longitude < -180 || *item.Longitude > 180) {
+			addError("longitude", "must be between -180 and 180")
+		}
+
+		if item.City == "" && item.Location == "" {
+			addError("city", "city or location is required")
+		} else {
+			if item.City == "" {
+				item.City, item.Voivodeship, item.PostalCode = splitLocation(item.Location)
+			}
+			place, postalCode, err := resolveLocation(item.City, item.Voivodeship, item.PostalCode)
+			var locationErr *FieldError
+			if errors.As(err, &locationErr) {
+				addError(locationErr.Field, locationErr.Message)
+			} else {
+				item.City = place.City
+				item.Voivodeship = place.Voivodeship
+				item.PostalCode = postalCode
+				item.Location = formatLocation(place.City, place.Voivodeship)
+				// Geocode from the gazetteer unless the seller gave exact coordinates
+				if item.Latitude == nil && item.Longitude == nil && place.located {
+					item.Latitude = &place.Latitude
+					item.Longitude = &place.Longitude
+				}
+			}
+		}
+
+		if len(item.Address) > 255 {
+			addError("address", "must be at most 255 characters")
+		}
+		if item.LocationPrecision == "" {
+			item.LocationPrecision = defaultLocationPrecision
+		}
+		if !isLocationPrecision(item.LocationPrecision) {
+			addError("locationPrecision", fmt.Sprintf("must be one of %s", strings.Join(locationPrecisions, ", ")))
+		}
+
+		if item.Delivery == nil {
+			delivery := pickupOnly
+			item.Delivery = &delivery
+		}
+		if fieldErr := item.Delivery.validate(); fieldErr != nil {
+			addError(fieldErr.Field, fieldErr.Message)
+		}
+
+		item.PhysicalAttributes.normalize()
+		if fieldErr := item.PhysicalAttributes.validate(); fieldErr != nil {
+			addError(fieldErr.Field, fieldErr.Message)
+		}
+
+		if item.Price != nil && (*item.Price < 0 || *item.Price > maxListingPrice) {
+			addError("price", fmt.Sprintf("must be between 0 and %.2f", maxListingPrice))
+		}
+
+		if len(item.ImageURLs) == 0 {
+			addError("imageUrls", "at least one image URL is required")
+		}
+		for _, imageURL := range item.ImageURLs {
+			parsed, err := url.Parse(imageURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				addError("imageUrls", fmt.Sprintf("invalid image URL: %s", imageURL))
+			}
+		}
+
+		for j := range record.errors {
+			record.errors[j].SKU = item.SKU
+		}
+	}
+}
+
+func normalizeImportColumn(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// splitImportList splits a CSV cell holding several values. Commas are
+// avoided as separators because they are common inside quoted CSV fields.
+func splitImportList(value string) []string {
+	parts := strings.FieldsFunc(value, func(r rune) bool { return r == '|' || r == ';' })
+	list := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+func isOfferType(offerType string) bool {
+	for _, t := range offerTypes {
+		if t == offerType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxSimilarItems = 8
+	// similarNearbyKm is the distance within which a similar item gets a
+	// proximity bonus on top of shared tags and category
+	similarNearbyKm = 25
+)
+
+type SellerSummary struct {
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	MemberSince    time.Time `json:"memberSince"`
+	ActiveListings int       `json:"activeListings"`
+}
+
+type FurnitureDetail struct {
+	Furniture
+	Images        []string       `json:"images"`
+	SellerSummary *SellerSummary `json:"sellerSummary,omitempty"`
+	Views         int            `json:"views"`
+	Similar       []Furniture    `json:"similar"`
+}
+
+func initViewTables() error {
+	createViewTablesSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS view_count INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS furniture_views (
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		viewer_key VARCHAR(80) NOT NULL,
+		day DATE NOT NULL DEFAULT CURRENT_DATE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		viewed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (furniture_id, viewer_key, day)
+	);
+	CREATE INDEX IF NOT EXISTS furniture_views_user_idx ON furniture_views (user_id, viewed_at DESC) WHERE user_id IS NOT NULL;`
+
+	if _, err := db.Exec(createViewTablesSQL); err != nil {
+		return fmt.Errorf("failed to create view tables: %w", err)
+	}
+
+	return nil
+}
+
+// viewerKey identifies a viewer for de-duplicating views: the user when
+// signed in, otherwise a keyed hash of the client address so raw IPs are
+// not stored and cannot be recovered by hashing the IPv4 space.
+func viewerKey(r *http.Request, userID int, signedIn bool) string {
+	if signedIn {
+		return "user:" + strconv.Itoa(userID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	mac := hmac.New(sha256.New, deriveKey("view-dedup"))
+	mac.Write([]byte(host))
+	return "ip:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// recordView counts a view once per viewer and day. Sellers looking at
+// their own listing are not counted.
+func recordView(ctx context.Context, furnitureID int, key string, userID *int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var inserted bool
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO furniture_views (furniture_id, viewer_key, user_id) VALUES ($1, $2, $3)
+		ON CONFLICT (furniture_id, viewer_key, day) DO UPDATE SET viewed_at = CURRENT_TIMESTAMP
+		RETURNING (xmax = 0)`, furnitureID, key, userID).Scan(&inserted)
+	if err != nil {
+		return false, err
+	}
+	if inserted {
+		if _, err := tx.ExecContext(ctx, "UPDATE furniture SET view_count = view_count + 1 WHERE id = $1", furnitureID); err != nil {
+			return false, err
+		}
+	}
+	return inserted, tx.Commit()
+}
+
+// furnitureDetailHandler returns one listing with its images, a summary of
+// the seller and similar listings, and counts the view.
+func furnitureDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+
+	var detail FurnitureDetail
+	var sellerID *int
+	rows, err := db.QueryContext(ctx, "SELECT "+furnitureColumns+", images, view_count, user_id FROM furniture WHERE id = $1 AND removed_at IS NULL", id)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	found := rows.Next()
+	if found {
+		detail.Furniture, err = scanFurniture(rows, pq.Array(&detail.Images), &detail.Views, &sellerID)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+
+	userID, signedIn := optionalUserID(r)
+	if sellerID == nil || !signedIn || *sellerID != userID {
+		var viewer *int
+		if signedIn {
+			viewer = &userID
+		}
+		// A failed count should not hide the listing
+		counted, err := recordView(ctx, id, viewerKey(r, userID, signedIn), viewer)
+		if err != nil {
+			log.Printf("Error recording view of furniture %d: %v", id, err)
+		} else if counted {
+			detail.Views++
+		}
+	}
+
+	if sellerID != nil {
+		seller := SellerSummary{ID: *sellerID}
+		err := db.QueryRowContext(ctx, `
+			SELECT name, created_at,
+				(SELECT COUNT(*) FROM furniture WHERE user_id = users.id AND expires_at > CURRENT_TIMESTAMP)
+			FROM users WHERE id = $1`, *sellerID).Scan(&seller.Name, &seller.MemberSince, &seller.ActiveListings)
+		if err != nil && err != sql.ErrNoRows {
+			respondWithError(w, "Error fetching seller", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			detail.SellerSummary = &seller
+		}
+	}
+
+	detail.Similar, err = similarFurniture(ctx, detail.Furniture)
+	if err != nil {
+		respondWithError(w, "Error fetching similar furniture", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, detail, http.StatusOK)
+}
+
+// similarFurniture ranks other live listings by shared tags, then the same
+// category, then being nearby, measured on the true coordinates.
+func similarFurniture(ctx context.Context, item Furniture) ([]Furniture, error) {
+	q := &furnitureQuery{}
+	tags := q.arg(pq.Array(item.Tags))
+	category := q.arg(item.CategoryID)
+	q.where("id <> " + q.arg(item.ID))
+	q.where("expires_at > CURRENT_TIMESTAMP")
+	q.where("(tags && " + tags + "::text[] OR category_id = " + category + ")")
+
+	score := "cardinality(ARRAY(SELECT unnest(tags) INTERSECT SELECT unnest(" + tags + "::text[]))) * 2" +
+		" + CASE WHEN category_id = " + category + " THEN 1 ELSE 0 END"
+	order := " ORDER BY score DESC, id DESC"
+	if item.Latitude != nil && item.Longitude != nil {
+		distance := distanceKmSQL("latitude", "longitude", q.arg(*item.Latitude), q.arg(*item.Longitude))
+		score += " + CASE WHEN " + distance + " <= " + q.arg(similarNearbyKm) + " THEN 1 ELSE 0 END"
+		order = " ORDER BY score DESC, " + distance + " ASC NULLS LAST, id DESC"
+	}
+
+	query := "SELECT " + furnitureColumns + ", " + score + " AS score FROM furniture" + q.whereClause() + order +
+		" LIMIT " + strconv.Itoa(maxSimilarItems)
+	rows, err := db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similar := []Furniture{}
+	for rows.Next() {
+		var score int
+		f, err := scanFurniture(rows, &score)
+		if err != nil {
+			return nil, err
+		}
+		similar = append(similar, f)
+	}
+	return similar, rows.Err()
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// gazetteerCSV is a bundled list of Polish cities with their voivodeship,
+// the two-digit postal code prefixes they use and their coordinates, so
+// listings can be validated and geocoded without an external service.
+//
+//go:embed data/gazetteer_pl.csv
+var gazetteerCSV string
+
+// voivodeships are the sixteen Polish provinces as displayed in locations.
+var voivodeships = []string{
+	"Dolnośląskie", "Kujawsko-Pomorskie", "Lubelskie", "Lubuskie",
+	"Łódzkie", "Małopolskie", "Mazowieckie", "Opolskie",
+	"Podkarpackie", "Podlaskie", "Pomorskie", "Śląskie",
+	"Świętokrzyskie", "Warmińsko-Mazurskie", "Wielkopolskie", "Zachodniopomorskie",
+}
+
+type GazetteerCity struct {
+	City        string  `json:"city"`
+	Voivodeship string  `json:"voivodeship"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	postalMin   int
+	postalMax   int
+	// located is false for places outside the gazetteer, which have no
+	// coordinates
+	located bool
+}
+
+// postalDistricts maps the first two digits of Polish postal codes onto the
+// voivodeships they serve. Districts follow the old postal regions rather
+// than today's borders, so codes near a border may serve several.
+var postalDistricts = []struct {
+	voivodeship string
+	from, to    int
+}{
+	{"Mazowieckie", 0, 9}, {"Mazowieckie", 26, 27}, {"Mazowieckie", 96, 96},
+	{"Warmińsko-Mazurskie", 10, 14}, {"Warmińsko-Mazurskie", 19, 19}, {"Warmińsko-Mazurskie", 82, 82},
+	{"Podlaskie", 15, 19},
+	{"Lubelskie", 8, 8}, {"Lubelskie", 20, 24},
+	{"Świętokrzyskie", 25, 29},
+	{"Małopolskie", 30, 34}, {"Małopolskie", 38, 38},
+	{"Podkarpackie", 35, 39},
+	{"Śląskie", 34, 34}, {"Śląskie", 40, 44}, {"Śląskie", 47, 47},
+	{"Opolskie", 45, 49},
+	{"Dolnośląskie", 50, 59}, {"Dolnośląskie", 67, 67},
+	{"Wielkopolskie", 60, 64}, {"Wielkopolskie", 77, 77}, {"Wielkopolskie", 89, 89},
+	{"Lubuskie", 65, 69},
+	{"Zachodniopomorskie", 70, 78},
+	{"Pomorskie", 76, 77}, {"Pomorskie", 80, 84}, {"Pomorskie", 89, 89},
+	{"Kujawsko-Pomorskie", 85, 89},
+	{"Łódzkie", 26, 26}, {"Łódzkie", 90, 99},
+}
+
+var postalCodePattern = regexp.MustCompile(`^(\d{2})-?(\d{3})$`)
+
+// gazetteer holds every bundled city keyed by its normalized name. Names
+// may repeat across voivodeships, hence the slice.
+var gazetteer = mustLoadGazetteer()
+
+func mustLoadGazetteer() map[string][]GazetteerCity {
+	records, err := csv.NewReader(strings.NewReader(gazetteerCSV)).ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("invalid gazetteer: %v", err))
+	}
+
+	cities := make(map[string][]GazetteerCity)
+	for i, record := range records[1:] {
+		city := GazetteerCity{City: record[0], Voivodeship: record[1], located: true}
+		if canonicalVoivodeship(city.Voivodeship) != city.Voivodeship {
+			panic(fmt.Sprintf("invalid gazetteer row %d: unknown voivodeship %s", i+2, city.Voivodeship))
+		}
+
+		prefixes := strings.SplitN(record[2], "-", 2)
+		city.postalMin, err = strconv.Atoi(prefixes[0])
+		if err == nil {
+			city.postalMax = city.postalMin
+			if len(prefixes) == 2 {
+				city.postalMax, err = strconv.Atoi(prefixes[1])
+			}
+		}
+		if err == nil {
+			city.Latitude, err = strconv.ParseFloat(record[3], 64)
+		}
+		if err == nil {
+			city.Longitude, err = strconv.ParseFloat(record[4], 64)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("invalid gazetteer row %d: %v", i+2, err))
+		}
+
+		key := normalizeTag(city.City)
+		cities[key] = append(cities[key], city)
+	}
+	return cities
+}
+
+// postalVoivodeships holds, for each two-digit postal prefix, the
+// voivodeships it serves according to postalDistricts and the gazetteer.
+var postalVoivodeships = buildPostalVoivodeships()
+
+func buildPostalVoivodeships() map[int]map[string]bool {
+	prefixes := make(map[int]map[string]bool)
+	add := func(voivodeship string, from, to int) {
+		for prefix := from; prefix <= to; prefix++ {
+			if prefixes[prefix] == nil {
+				prefixes[prefix] = make(map[string]bool)
+			}
+			prefixes[prefix][voivodeship] = true
+		}
+	}
+	for _, d := range postalDistricts {
+		add(d.voivodeship, d.from, d.to)
+	}
+	for _, cities := range gazetteer {
+		for _, c := range cities {
+			add(c.Voivodeship, c.postalMin, c.postalMax)
+		}
+	}
+	return prefixes
+}
+
+// canonicalVoivodeship returns the display name of a voivodeship given in
+// any case, with or without Polish diacritics, or "" if there is none.
+func canonicalVoivodeship(name string) string {
+	key := normalizeTag(strings.TrimSuffix(strings.TrimSpace(strings.ToLower(name)), " voivodeship"))
+	key = strings.TrimPrefix(key, "wojewodztwo-")
+	for _, v := range voivodeships {
+		if normalizeTag(v) == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// canonicalCities returns the display names of every bundled city called
+// name, whatever its voivodeship.
+func canonicalCities(name string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, city := range gazetteer[normalizeTag(name)] {
+		if !seen[city.City] {
+			seen[city.City] = true
+			names = append(names, city.City)
+		}
+	}
+	return names
+}
+
+// normalizePostalCode formats a Polish postal code as NN-NNN, reporting
+// whether s was one.
+func normalizePostalCode(s string) (string, bool) {
+	m := postalCodePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", false
+	}
+	return m[1] + "-" + m[2], true
+}
+
+// splitLocation breaks a legacy free-text location such as
+// "Warszawa, Mazowieckie" or "00-001 Warszawa" into its parts.
+func splitLocation(location string) (city, voivodeship, postalCode string) {
+	parts := strings.SplitN(location, ",", 2)
+	city = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		voivodeship = strings.TrimSpace(parts[1])
+	}
+
+	if fields := strings.Fields(city); len(fields) > 1 {
+		if code, ok := normalizePostalCode(fields[0]); ok {
+			postalCode = code
+			city = strings.Join(fields[1:], " ")
+		}
+	}
+	return city, voivodeship, postalCode
+}
+
+// formatLocation is the display string stored in furniture.location.
+func formatLocation(city, voivodeship string) string {
+	return city + ", " + voivodeship
+}
+
+// FieldError reports which field of a listing failed validation.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// resolveLocation validates a location against the gazetteer. The
+// voivodeship is only needed to tell apart cities sharing a name, and the
+// postal code, when given, must belong to the city. Localities the
+// gazetteer does not list are accepted with both a voivodeship and a postal
+// code from it, but have no coordinates.
+func resolveLocation(city, voivodeship, postalCode string) (GazetteerCity, string, error) {
+	if strings.TrimSpace(city) == "" {
+		return GazetteerCity{}, "", &FieldError{"city", "is required"}
+	}
+
+	candidates := gazetteer[normalizeTag(city)]
+	if len(candidates) == 0 {
+		return resolveUnlistedLocation(city, voivodeship, postalCode)
+	}
+
+	if voivodeship != "" {
+		canonical := canonicalVoivodeship(voivodeship)
+		if canonical == "" {
+			return GazetteerCity{}, "", &FieldError{"voivodeship", fmt.Sprintf("unknown voivodeship: %s", voivodeship)}
+		}
+		var matching []GazetteerCity
+		for _, c := range candidates {
+			if c.Voivodeship == canonical {
+				matching = append(matching, c)
+			}
+		}
+		if len(matching) == 0 {
+			return GazetteerCity{}, "", &FieldError{"voivodeship", fmt.Sprintf("%s is not in %s", candidates[0].City, canonical)}
+		}
+		candidates = matching
+	}
+	if len(candidates) > 1 {
+		return GazetteerCity{}, "", &FieldError{"voivodeship", fmt.Sprintf("is required to tell apart cities named %s", candidates[0].City)}
+	}
+	match := candidates[0]
+
+	if postalCode == "" {
+		return match, "", nil
+	}
+	code, ok := normalizePostalCode(postalCode)
+	if !ok {
+		return GazetteerCity{}, "", &FieldError{"postalCode", "must be in the format NN-NNN"}
+	}
+	prefix, _ := strconv.Atoi(code[:2])
+	if prefix < match.postalMin || prefix > match.postalMax {
+		return GazetteerCity{}, "", &FieldError{"postalCode", fmt.Sprintf("%s does not belong to %s", code, match.City)}
+	}
+	return match, code, nil
+}
+
+// resolveUnlistedLocation accepts a locality missing from the gazetteer
+// when its postal code lies in the given voivodeship.
+func resolveUnlistedLocation(city, voivodeship, postalCode string) (GazetteerCity, string, error) {
+	if voivodeship == "" || postalCode == "" {
+		return GazetteerCity{}, "", &FieldError{"city", fmt.Sprintf("unknown city: %s; give its voivodeship and postal code", city)}
+	}
+	canonical := canonicalVoivodeship(voivodeship)
+	if canonical == "" {
+		return GazetteerCity{}, "", &FieldError{"voivodeship", fmt.Sprintf("unknown voivodeship: %s", voivodeship)}
+	}
+	code, ok := normalizePostalCode(postalCode)
+	if !ok {
+		return GazetteerCity{}, "", &FieldError{"postalCode", "must be in the format NN-NNN"}
+	}
+	prefix, _ := strconv.Atoi(code[:2])
+	if !postalVoivodeships[prefix][canonical] {
+		return GazetteerCity{}, "", &FieldError{"postalCode", fmt.Sprintf("%s is not in %s", code, canonical)}
+	}
+	return GazetteerCity{City: strings.Join(strings.Fields(city), " "), Voivodeship: canonical}, code, nil
+}
+
+func initLocationTables() error {
+	alterFurnitureLocationSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS city VARCHAR(100);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS voivodeship VARCHAR(50);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS postal_code VARCHAR(6);
+	CREATE INDEX IF NOT EXISTS furniture_voivodeship_city_idx ON furniture (voivodeship, city);`
+
+	if _, err := db.Exec(alterFurnitureLocationSQL); err != nil {
+		return fmt.Errorf("failed to add furniture location columns: %w", err)
+	}
+
+	return backfillFurnitureLocations()
+}
+
+// backfillFurnitureLocations parses the free-text location of listings
+// created before locations were structured, and fills in coordinates that
+// were never entered. Locations the gazetteer does not know are left for
+// their sellers to fix.
+func backfillFurnitureLocations() error {
+	rows, err := db.Query("SELECT id, location FROM furniture WHERE city IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to fetch legacy locations: %w", err)
+	}
+
+	type resolved struct {
+		id         int
+		place      GazetteerCity
+		postalCode string
+	}
+	var updates []resolved
+	unresolved := 0
+	for rows.Next() {
+		var id int
+		var location string
+		if err := rows.Scan(&id, &location); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan legacy location: %w", err)
+		}
+		place, postalCode, err := resolveLocation(splitLocation(location))
+		if err != nil {
+			unresolved++
+			continue
+		}
+		updates = append(updates, resolved{id, place, postalCode})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read legacy locations: %w", err)
+	}
+
+	for _, u := range updates {
+		var lat, lng *float64
+		if u.place.located {
+			lat, lng = &u.place.Latitude, &u.place.Longitude
+		}
+		_, err := db.Exec(`
+			UPDATE furniture SET city = $2, voivodeship = $3, postal_code = NULLIF($4, ''), location = $5,
+				latitude = COALESCE(latitude, $6), longitude = COALESCE(longitude, $7)
+			WHERE id = $1`,
+			u.id, u.place.City, u.place.Voivodeship, u.postalCode, formatLocation(u.place.City, u.place.Voivodeship),
+			lat, lng)
+		if err != nil {
+			return fmt.Errorf("failed to backfill furniture location: %w", err)
+		}
+	}
+
+	if unresolved > 0 {
+		log.Printf("%d listing(s) have a location missing from the gazetteer", unresolved)
+	}
+	return nil
+}
+
+// locationFilter restricts q to the requested voivodeships and cities,
+// including localities the gazetteer does not list.
+func locationFilter(q *furnitureQuery, r *http.Request, skip string) error {
+	var names []string
+	for _, v := range r.URL.Query()["voivodeship"] {
+		canonical := canonicalVoivodeship(v)
+		if canonical == "" {
+			return fmt.Errorf("Unknown voivodeship: %s", v)
+		}
+		names = append(names, canonical)
+	}
+	if len(names) > 0 && skip != filterVoivodeship {
+		q.where("voivodeship = ANY(" + q.arg(pq.Array(names)) + ")")
+	}
+
+	// Localities missing from the gazetteer are stored as the seller typed
+	// them, so they are compared by their normalized form instead
+	var cities, unlisted []string
+	for _, c := range r.URL.Query()["city"] {
+		if canonical := canonicalCities(c); len(canonical) > 0 {
+			cities = append(cities, canonical...)
+		} else if key := normalizeTag(c); key != "" {
+			unlisted = append(unlisted, key)
+		} else {
+			return fmt.Errorf("Unknown city: %s", c)
+		}
+	}
+	if skip != filterCity {
+		switch {
+		case len(cities) > 0 && len(unlisted) > 0:
+			q.where("(city = ANY(" + q.arg(pq.Array(cities)) + ") OR " +
+				titleKeySQL("city") + " = ANY(" + q.arg(pq.Array(unlisted)) + "))")
+		case len(cities) > 0:
+			q.where("city = ANY(" + q.arg(pq.Array(cities)) + ")")
+		case len(unlisted) > 0:
+			q.where(titleKeySQL("city") + " = ANY(" + q.arg(pq.Array(unlisted)) + ")")
+		}
+	}
+
+	return nil
+}
+
+// locationsHandler looks up gazetteer cities by name prefix so clients can
+// offer valid places and prefill coordinates.
+func locationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := normalizeTag(r.URL.Query().Get("q"))
+	voivodeship := r.URL.Query().Get("voivodeship")
+	if voivodeship != "" {
+		if voivodeship = canonicalVoivodeship(voivodeship); voivodeship == "" {
+			respondWithError(w, "Unknown voivodeship", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cities := []GazetteerCity{}
+	for key, matches := range gazetteer {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, city := range matches {
+			if voivodeship == "" || city.Voivodeship == voivodeship {
+				cities = append(cities, city)
+			}
+		}
+	}
+	sort.Slice(cities, func(i, j int) bool {
+		// Compare folded names so Łódź sorts among the Ls
+		if a, b := normalizeTag(cities[i].City), normalizeTag(cities[j].City); a != b {
+			return a < b
+		}
+		return cities[i].Voivodeship < cities[j].Voivodeship
+	})
+
+	respondWithJSON(w, map[string]interface{}{
+		"voivodeships": voivodeships,
+		"cities":       cities,
+	}, http.StatusOK)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Location precisions a seller can publish a listing with. Anything but
+// exact moves the public coordinates away from the true ones.
+const (
+	PrecisionExact        = "exact"
+	PrecisionStreet       = "street"
+	PrecisionNeighborhood = "neighborhood"
+	PrecisionCity         = "city"
+)
+
+var locationPrecisions = []string{PrecisionExact, PrecisionStreet, PrecisionNeighborhood, PrecisionCity}
+
+// defaultLocationPrecision protects private sellers who never chose one.
+const defaultLocationPrecision = PrecisionNeighborhood
+
+// fuzzRadiusMeters is the furthest the public coordinates may be from the
+// true ones at each precision. City precision uses the city centre when
+// the gazetteer knows it.
+var fuzzRadiusMeters = map[string]float64{
+	PrecisionStreet:       150,
+	PrecisionNeighborhood: 750,
+	PrecisionCity:         3000,
+}
+
+const metersPerDegreeLatitude = 111320
+
+type ListingAddress struct {
+	Address     string   `json:"address"`
+	PostalCode  string   `json:"postalCode,omitempty"`
+	City        string   `json:"city"`
+	Voivodeship string   `json:"voivodeship"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+}
+
+type UpdateListingAddressRequest struct {
+	Address           *string `json:"address"`
+	LocationPrecision *string `json:"locationPrecision"`
+}
+
+func initLocationPrivacyTables() error {
+	alterFurniturePrivacySQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS address VARCHAR(255);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS location_precision VARCHAR(20) NOT NULL DEFAULT 'neighborhood';
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS public_latitude DECIMAL(10, 8);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS public_longitude DECIMAL(11, 8);`
+
+	if _, err := db.Exec(alterFurniturePrivacySQL); err != nil {
+		return fmt.Errorf("failed to add furniture privacy columns: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, latitude, longitude, location_precision, COALESCE(city, ''), COALESCE(voivodeship, '')
+		FROM furniture WHERE latitude IS NOT NULL AND public_latitude IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to fetch listings without public coordinates: %w", err)
+	}
+
+	type publicCoordinates struct {
+		id       int
+		lat, lng *float64
+	}
+	var updates []publicCoordinates
+	for rows.Next() {
+		var id int
+		var lat, lng *float64
+		var precision, city, voivodeship string
+		if err := rows.Scan(&id, &lat, &lng, &precision, &city, &voivodeship); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan listing coordinates: %w", err)
+		}
+		publicLat, publicLng := fuzzCoordinates(lat, lng, precision, city, voivodeship)
+		updates = append(updates, publicCoordinates{id, publicLat, publicLng})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read listing coordinates: %w", err)
+	}
+
+	for _, u := range updates {
+		if _, err := db.Exec("UPDATE furniture SET public_latitude = $2, public_longitude = $3 WHERE id = $1", u.id, u.lat, u.lng); err != nil {
+			return fmt.Errorf("failed to backfill public coordinates: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func isLocationPrecision(precision string) bool {
+	for _, p := range locationPrecisions {
+		if p == precision {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzCoordinates returns the coordinates published for a listing. The
+// offset is derived from the true position with a server secret, so it is
+// stable across requests and listings at the same address, and cannot be
+// averaged away or reversed by clients.
+func fuzzCoordinates(lat, lng *float64, precision, city, voivodeship string) (*float64, *float64) {
+	if lat == nil || lng == nil || precision == PrecisionExact {
+		return lat, lng
+	}
+
+	if precision == PrecisionCity {
+		if place, _, err := resolveLocation(city, voivodeship, ""); err == nil && place.located {
+			return &place.Latitude, &place.Longitude
+		}
+	}
+
+	radius, ok := fuzzRadiusMeters[precision]
+	if !ok {
+		radius = fuzzRadiusMeters[defaultLocationPrecision]
+	}
+
+	mac := hmac.New(sha256.New, deriveKey("location-fuzz"))
+	fmt.Fprintf(mac, "location:%s:%.6f:%.6f", precision, *lat, *lng)
+	sum := mac.Sum(nil)
+	u1 := float64(binary.BigEndian.Uint64(sum[0:8])) / math.MaxUint64
+	u2 := float64(binary.BigEndian.Uint64(sum[8:16])) / math.MaxUint64
+
+	// Keep at least a third of the radius so the true point is never shown
+	bearing := 2 * math.Pi * u1
+	distance := radius * (1.0/3 + 2.0/3*math.Sqrt(u2))
+
+	publicLat := *lat + distance*math.Cos(bearing)/metersPerDegreeLatitude
+	publicLng := *lng + distance*math.Sin(bearing)/(metersPerDegreeLatitude*math.Cos(*lat*math.Pi/180))
+	publicLat = math.Round(publicLat*1e5) / 1e5
+	publicLng = math.Round(publicLng*1e5) / 1e5
+	return &publicLat, &publicLng
+}
+
+// distanceKmSQL is the haversine distance in kilometres between a listing's
+// coordinates in the given columns and the point bound at the placeholders.
+func distanceKmSQL(latColumn, lngColumn, latPlaceholder, lngPlaceholder string) string {
+	return fmt.Sprintf(`(6371 * 2 * asin(sqrt(
+		power(sin(radians(%[1]s - %[3]s) / 2), 2) +
+		cos(radians(%[3]s)) * cos(radians(%[1]s)) * power(sin(radians(%[2]s - %[4]s) / 2), 2))))`,
+		latColumn, lngColumn, latPlaceholder, lngPlaceholder)
+}
+
+// haversineKm is the great-circle distance in kilometres between two points.
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// parseLatLng reads "lat,lng".
+func parseLatLng(value string) (float64, float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) == 2 {
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lng, lngErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if latErr == nil && lngErr == nil && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 {
+			return lat, lng, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("must be latitude,longitude")
+}
+
+// canViewAddress reports whether userID may see a listing's exact address:
+// its seller, or a buyer whose reservation the seller accepted.
+func canViewAddress(userID, furnitureID int, sellerID *int) (bool, error) {
+	if sellerID != nil && *sellerID == userID {
+		return true, nil
+	}
+	var accepted bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM furniture_reservations WHERE furniture_id = $1 AND buyer_id = $2 AND status = $3)`,
+		furnitureID, userID, ReservationAccepted).Scan(&accepted)
+	return accepted, err
+}
+
+func listingAddressHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	var sellerID *int
+	var address ListingAddress
+	var precision string
+	err = db.QueryRow(`
+		SELECT user_id, COALESCE(address, ''), COALESCE(postal_code, ''), COALESCE(city, ''), COALESCE(voivodeship, ''),
+			latitude, longitude, location_precision
+		FROM furniture WHERE id = $1`, id).
+		Scan(&sellerID, &address.Address, &address.PostalCode, &address.City, &address.Voivodeship,
+			&address.Latitude, &address.Longitude, &precision)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		allowed, err := canViewAddress(userID, id, sellerID)
+		if err != nil {
+			respondWithError(w, "Error checking reservation", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			respondWithError(w, "The address is shared once the seller accepts your reservation", http.StatusForbidden)
+			return
+		}
+		respondWithJSON(w, address, http.StatusOK)
+
+	case "PUT":
+		if sellerID == nil || *sellerID != userID {
+			respondWithError(w, "Furniture not found", http.StatusNotFound)
+			return
+		}
+
+		var req UpdateListingAddressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Address != nil {
+			address.Address = strings.TrimSpace(*req.Address)
+			if len(address.Address) > 255 {
+				respondWithError(w, "Address must be at most 255 characters", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.LocationPrecision != nil {
+			if !isLocationPrecision(*req.LocationPrecision) {
+				respondWithError(w, "locationPrecision must be one of "+strings.Join(locationPrecisions, ", "), http.StatusBadRequest)
+				return
+			}
+			precision = *req.LocationPrecision
+		}
+
+		publicLat, publicLng := fuzzCoordinates(address.Latitude, address.Longitude, precision, address.City, address.Voivodeship)
+		err := withRevisionActor(r.Context(), userID, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				UPDATE furniture SET address = NULLIF($2, ''), location_precision = $3, public_latitude = $4, public_longitude = $5,
+					updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1`, id, address.Address, precision, publicLat, publicLng); err != nil {
+				return err
+			}
+			return dispatchListingUpdated(r.Context(), tx, id)
+		})
+		if err != nil {
+			respondWithError(w, "Error updating furniture", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, address, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
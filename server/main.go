@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"log"
@@ -16,6 +19,11 @@ import (
 var db *sql.DB
 var jwtSecret []byte
 
+// dataSecret keys values the server derives and stores, such as public
+// coordinates. Unlike JWT_SECRET it must stay the same for the lifetime of
+// the data, so it is a separate setting.
+var dataSecret []byte
+
 func main() {
 	// Load environment variables
 	if err := loadEnv(); err != nil {
@@ -27,6 +35,35 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
+	// One-off administration command; see promoteAdmins
+	if len(os.Args) > 1 {
+		if os.Args[1] != "promote-admin" || len(os.Args) < 3 {
+			log.Fatal("Usage: auth-server [promote-admin <email>...]")
+		}
+		if err := promoteAdmins(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Start background email delivery
+	mailer, err := newMailerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure email delivery:", err)
+	}
+	duplicateAction, err = duplicateActionFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure duplicate detection:", err)
+	}
+	go runEmailWorker(context.Background(), mailer)
+	go runWebhookWorker(context.Background())
+	go runPickupReminderWorker(context.Background())
+	go runWantedMatchWorker(context.Background())
+	go runAuctionWorker(context.Background())
+	go runListingExpiryWorker(context.Background())
+	go runDraftPublishWorker(context.Background())
+	go runDuplicateWorker(context.Background())
+
 	// Get port from environment
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -39,6 +76,65 @@ func main() {
 	http.HandleFunc("/api/auth/temporary", corsMiddleware(temporaryUserHandler))
 	http.HandleFunc("/api/profile", corsMiddleware(authMiddleware(getProfileHandler)))
 	http.HandleFunc("/api/furniture", corsMiddleware(furnitureHandler))
+	http.HandleFunc("/api/furniture/import", corsMiddleware(authMiddleware(furnitureImportHandler)))
+	http.HandleFunc("/api/furniture/export", corsMiddleware(authMiddleware(furnitureExportHandler)))
+	http.HandleFunc("/api/furniture/clusters", corsMiddleware(furnitureClustersHandler))
+	http.HandleFunc("/api/furniture/{id}/address", corsMiddleware(authMiddleware(listingAddressHandler)))
+	http.HandleFunc("/api/furniture/{id}/delivery", corsMiddleware(authMiddleware(furnitureDeliveryHandler)))
+	http.HandleFunc("/api/furniture/{id}/attributes", corsMiddleware(authMiddleware(furnitureAttributesHandler)))
+	http.HandleFunc("/api/furniture/{id}/delivery/estimate", corsMiddleware(deliveryEstimateHandler))
+	http.HandleFunc("/api/furniture/{id}/reservations", corsMiddleware(authMiddleware(furnitureReservationsHandler)))
+	http.HandleFunc("/api/drafts", corsMiddleware(authMiddleware(draftsHandler)))
+	http.HandleFunc("/api/drafts/{id}", corsMiddleware(authMiddleware(draftHandler)))
+	http.HandleFunc("/api/drafts/{id}/publish", corsMiddleware(authMiddleware(draftPublishHandler)))
+	http.HandleFunc("/api/furniture/{id}", corsMiddleware(furnitureDetailHandler))
+	http.HandleFunc("/api/furniture/{id}/favorite", corsMiddleware(authMiddleware(favoriteHandler)))
+	http.HandleFunc("/api/favorites", corsMiddleware(authMiddleware(favoritesHandler)))
+	http.HandleFunc("/api/recently-viewed", corsMiddleware(authMiddleware(recentlyViewedHandler)))
+	http.HandleFunc("/api/recommendations", corsMiddleware(authMiddleware(recommendationsHandler)))
+	http.HandleFunc("/api/furniture/{id}/history", corsMiddleware(authMiddleware(furnitureHistoryHandler)))
+	http.HandleFunc("/api/furniture/{id}/price-history", corsMiddleware(priceHistoryHandler))
+	http.HandleFunc("/api/furniture/{id}/renew", corsMiddleware(authMiddleware(renewListingHandler)))
+	http.HandleFunc("/api/furniture/{id}/auction", corsMiddleware(auctionHandler))
+	http.HandleFunc("/api/furniture/{id}/bids", corsMiddleware(auctionBidsHandler))
+	http.HandleFunc("/api/bundles", corsMiddleware(bundlesHandler))
+	http.HandleFunc("/api/bundles/{id}", corsMiddleware(bundleHandler))
+	http.HandleFunc("/api/bundles/{id}/reservations", corsMiddleware(authMiddleware(bundleReservationsHandler)))
+	http.HandleFunc("/api/reservations", corsMiddleware(authMiddleware(reservationsHandler)))
+	http.HandleFunc("/api/reservations/{id}", corsMiddleware(authMiddleware(reservationHandler)))
+	http.HandleFunc("/api/reservations/{id}/pickup-slots", corsMiddleware(authMiddleware(pickupSlotsHandler)))
+	http.HandleFunc("/api/reservations/{id}/pickup", corsMiddleware(authMiddleware(pickupHandler)))
+	http.HandleFunc("/api/reservations/{id}/pickup.ics", corsMiddleware(authMiddleware(pickupICSHandler)))
+	http.HandleFunc("/api/availability", corsMiddleware(authMiddleware(availabilityHandler)))
+	http.HandleFunc("/api/availability/{id}", corsMiddleware(authMiddleware(availabilityWindowHandler)))
+	http.HandleFunc("/api/wanted", corsMiddleware(wantedFeedHandler))
+	http.HandleFunc("/api/wanted/mine", corsMiddleware(authMiddleware(myWantedHandler)))
+	http.HandleFunc("/api/wanted/{id}", corsMiddleware(authMiddleware(wantedPostHandler)))
+	http.HandleFunc("/api/wanted/{id}/answers", corsMiddleware(authMiddleware(wantedAnswersHandler)))
+	http.HandleFunc("/api/wanted/{id}/matches", corsMiddleware(authMiddleware(wantedMatchesHandler)))
+	http.HandleFunc("/api/feed/products.xml", corsMiddleware(productFeedXMLHandler))
+	http.HandleFunc("/api/feed/products.json", corsMiddleware(productFeedJSONHandler))
+	http.HandleFunc("/api/categories", corsMiddleware(categoriesHandler))
+	http.HandleFunc("/api/tags", corsMiddleware(tagsHandler))
+	http.HandleFunc("/api/search/suggest", corsMiddleware(searchSuggestHandler))
+	http.HandleFunc("/api/locations", corsMiddleware(locationsHandler))
+	http.HandleFunc("/api/attributes", corsMiddleware(attributeOptionsHandler))
+	http.HandleFunc("/api/admin/tags", corsMiddleware(authMiddleware(requireRole(adminCreateTagHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/tags/{slug}", corsMiddleware(authMiddleware(requireRole(adminTagHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/tags/{slug}/merge", corsMiddleware(authMiddleware(requireRole(adminMergeTagHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/tag-suggestions", corsMiddleware(authMiddleware(requireRole(adminTagSuggestionsHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/tag-suggestions/{slug}", corsMiddleware(authMiddleware(requireRole(adminTagSuggestionHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/duplicates", corsMiddleware(authMiddleware(requireRole(adminDuplicatesHandler, RoleAdmin))))
+	http.HandleFunc("/api/admin/duplicates/{id}", corsMiddleware(authMiddleware(requireRole(adminDuplicateHandler, RoleAdmin))))
+	http.HandleFunc("/api/notifications", corsMiddleware(authMiddleware(notificationsHandler)))
+	http.HandleFunc("/api/notifications/unread-count", corsMiddleware(authMiddleware(unreadNotificationsHandler)))
+	http.HandleFunc("/api/notifications/read", corsMiddleware(authMiddleware(markNotificationsReadHandler)))
+	http.HandleFunc("/api/notifications/read-all", corsMiddleware(authMiddleware(markAllNotificationsReadHandler)))
+	http.HandleFunc("/api/notifications/preferences", corsMiddleware(authMiddleware(notificationPreferencesHandler)))
+	http.HandleFunc("/api/webhooks", corsMiddleware(authMiddleware(webhooksHandler)))
+	http.HandleFunc("/api/webhooks/{id}", corsMiddleware(authMiddleware(webhookHandler)))
+	http.HandleFunc("/api/webhooks/{id}/deliveries", corsMiddleware(authMiddleware(webhookDeliveriesHandler)))
+	http.HandleFunc("/api/webhooks/{id}/test", corsMiddleware(authMiddleware(webhookTestHandler)))
 
 	// Handle preflight requests
 	http.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
@@ -83,9 +179,23 @@ func loadEnv() error {
 		return fmt.Errorf("JWT_SECRET environment variable is required")
 	}
 	jwtSecret = []byte(secret)
+
+	secret = os.Getenv("DATA_SECRET")
+	if secret == "" {
+		return fmt.Errorf("DATA_SECRET environment variable is required")
+	}
+	dataSecret = []byte(secret)
 	return nil
 }
 
+// deriveKey returns the key for one purpose of DATA_SECRET, so no two
+// purposes share a key.
+func deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, dataSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 func initDB() error {
 	// Get database connection string from environment
 	dbHost := os.Getenv("DB_HOST")
@@ -164,6 +274,108 @@ func initDB() error {
 		return fmt.Errorf("failed to create furniture table: %w", err)
 	}
 
+	// Add furniture columns introduced after the initial schema
+	alterFurnitureTableSQL := `
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS external_sku VARCHAR(100);
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS images TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+	ALTER TABLE furniture ADD COLUMN IF NOT EXISTS price DECIMAL(10, 2);
+	CREATE UNIQUE INDEX IF NOT EXISTS furniture_user_sku_idx ON furniture (user_id, external_sku);`
+
+	_, err = db.Exec(alterFurnitureTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to migrate furniture table: %w", err)
+	}
+
+	if err = initRoles(); err != nil {
+		return err
+	}
+
+	if err = initCategoryTables(); err != nil {
+		return err
+	}
+
+	if err = initTagTables(); err != nil {
+		return err
+	}
+
+	if err = initExpiryTables(); err != nil {
+		return err
+	}
+
+	if err = initLocationTables(); err != nil {
+		return err
+	}
+
+	if err = initLocationPrivacyTables(); err != nil {
+		return err
+	}
+
+	if err = initDeliveryTables(); err != nil {
+		return err
+	}
+
+	if err = initAttributeTables(); err != nil {
+		return err
+	}
+
+	if err = initReservationTables(); err != nil {
+		return err
+	}
+
+	if err = initPickupTables(); err != nil {
+		return err
+	}
+
+	if err = initBundleTables(); err != nil {
+		return err
+	}
+
+	if err = initAuctionTables(); err != nil {
+		return err
+	}
+
+	if err = initDraftTables(); err != nil {
+		return err
+	}
+
+	if err = initRevisionTables(); err != nil {
+		return err
+	}
+
+	if err = initViewTables(); err != nil {
+		return err
+	}
+
+	if err = initFavoriteTables(); err != nil {
+		return err
+	}
+
+	if err = initWantedTables(); err != nil {
+		return err
+	}
+
+	if err = initSearchTables(); err != nil {
+		return err
+	}
+
+	if err = initEmailTables(); err != nil {
+		return err
+	}
+
+	if err = initNotificationTables(); err != nil {
+		return err
+	}
+
+	if err = initWebhookTables(); err != nil {
+		return err
+	}
+
+	if err = initDuplicateTables(); err != nil {
+		return err
+	}
+
 	// Insert sample furniture data if table is empty
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM furniture").Scan(&count)
@@ -187,6 +399,7 @@ func insertSampleFurniture() {
 		offerType string
 		latitude  float64
 		longitude float64
+		category  string
 	}{
 		{
 			title:     "Modern Leather Sofa",
@@ -197,6 +410,7 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  52.2297,
 			longitude: 21.0122,
+			category:  "sofas",
 		},
 		{
 			title:     "Vintage Wooden Chair",
@@ -207,6 +421,7 @@ func insertSampleFurniture() {
 			offerType: "Giveaway",
 			latitude:  50.0647,
 			longitude: 19.9450,
+			category:  "chairs",
 		},
 		{
 			title:     "Glass Coffee Table",
@@ -217,6 +432,7 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  51.1079,
 			longitude: 17.0385,
+			category:  "coffee-tables",
 		},
 		{
 			title:     "Queen Size Bed Frame",
@@ -227,6 +443,7 @@ func insertSampleFurniture() {
 			offerType: "Free",
 			latitude:  52.4064,
 			longitude: 16.9252,
+			category:  "beds",
 		},
 		{
 			title:     "Classic Wardrobe",
@@ -237,6 +454,7 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  54.3521,
 			longitude: 18.6466,
+			category:  "wardrobes",
 		},
 		{
 			title:     "Office Desk",
@@ -247,6 +465,7 @@ func insertSampleFurniture() {
 			offerType: "Giveaway",
 			latitude:  51.7592,
 			longitude: 19.4559,
+			category:  "desks",
 		},
 		{
 			title:     "Kitchen Cabinet Set",
@@ -257,6 +476,7 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  50.2613,
 			longitude: 19.0233,
+			category:  "kitchen-cabinets",
 		},
 		{
 			title:     "Modern Pendant Light",
@@ -267,6 +487,7 @@ func insertSampleFurniture() {
 			offerType: "Free",
 			latitude:  53.4285,
 			longitude: 14.5528,
+			category:  "lighting",
 		},
 		{
 			title:     "Dining Room Table",
@@ -277,6 +498,7 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  51.2465,
 			longitude: 22.5684,
+			category:  "dining-tables",
 		},
 		{
 			title:     "Accent Armchair",
@@ -287,6 +509,7 @@ func insertSampleFurniture() {
 			offerType: "Giveaway",
 			latitude:  53.1325,
 			longitude: 23.1688,
+			category:  "armchairs",
 		},
 		{
 			title:     "Bookshelf Unit",
@@ -297,6 +520,7 @@ func insertSampleFurniture() {
 			offerType: "Free",
 			latitude:  50.8661,
 			longitude: 20.6286,
+			category:  "bookshelves",
 		},
 		{
 			title:     "Bedside Table",
@@ -307,12 +531,15 @@ func insertSampleFurniture() {
 			offerType: "Sell",
 			latitude:  50.0409,
 			longitude: 21.9992,
+			category:  "bedside-tables",
 		},
 	}
 
 	for _, item := range sampleFurniture {
-		_, err := db.Exec("INSERT INTO furniture (title, url, tags, seller, location, offer_type, latitude, longitude) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-			item.title, item.url, pq.Array(item.tags), item.seller, item.location, item.offerType, item.latitude, item.longitude)
+		// Sample sellers are shops, which publish their exact address
+		city, voivodeship, _ := splitLocation(item.location)
+		_, err := db.Exec("INSERT INTO furniture (title, url, tags, seller, location, city, voivodeship, offer_type, latitude, longitude, public_latitude, public_longitude, location_precision, category_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $9, $10, $11, (SELECT id FROM categories WHERE slug = $12))",
+			item.title, item.url, pq.Array(normalizeTags(item.tags)), item.seller, item.location, city, voivodeship, item.offerType, item.latitude, item.longitude, PrecisionExact, item.category)
 		if err != nil {
 			log.Printf("Error inserting furniture item: %v", err)
 		}
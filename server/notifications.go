@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notification types that subsystems can emit through Notify.
+const (
+	NotificationMessage    = "message"
+	NotificationOffer      = "offer"
+	NotificationReview     = "review"
+	NotificationModeration = "moderation"
+	NotificationPickup     = "pickup"
+	NotificationWanted     = "wanted"
+	NotificationAuction    = "auction"
+	NotificationListing    = "listing"
+)
+
+// Delivery channels a user can choose per notification type.
+const (
+	ChannelInApp = "in_app"
+	ChannelEmail = "email"
+	ChannelNone  = "none"
+)
+
+var notificationTypes = []string{
+	NotificationMessage,
+	NotificationOffer,
+	NotificationReview,
+	NotificationModeration,
+	NotificationPickup,
+	NotificationWanted,
+	NotificationAuction,
+	NotificationListing,
+}
+
+type NotificationEvent struct {
+	Type  string                 `json:"type"`
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+type Notification struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Body      string          `json:"body"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ReadAt    *time.Time      `json:"readAt,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type NotificationListResponse struct {
+	Notifications []Notification `json:"notifications"`
+	Total         int            `json:"total"`
+	Unread        int            `json:"unread"`
+	Page          int            `json:"page"`
+	Limit         int            `json:"limit"`
+}
+
+type MarkNotificationsReadRequest struct {
+	IDs []int `json:"ids"`
+}
+
+type NotificationPreferencesRequest struct {
+	Preferences map[string]string `json:"preferences"`
+}
+
+func initNotificationTables() error {
+	createNotificationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(50) NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		data JSONB,
+		read_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS notifications_user_created_idx ON notifications (user_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS notifications_user_unread_idx ON notifications (user_id) WHERE read_at IS NULL;`
+
+	if _, err := db.Exec(createNotificationsTableSQL); err != nil {
+		return fmt.Errorf("failed to create notifications table: %w", err)
+	}
+
+	createPreferencesTableSQL := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(50) NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		PRIMARY KEY (user_id, type)
+	);`
+
+	if _, err := db.Exec(createPreferencesTableSQL); err != nil {
+		return fmt.Errorf("failed to create notification preferences table: %w", err)
+	}
+
+	return nil
+}
+
+// Notify delivers an event to a user according to their preference for the
+// event type. It is the single entry point other subsystems use to reach users.
+func Notify(ctx context.Context, userID int, event NotificationEvent) error {
+	channel, err := notificationChannel(ctx, userID, event.Type)
+	if err != nil {
+		return err
+	}
+	if channel == ChannelNone {
+		return nil
+	}
+
+	var data []byte
+	if event.Data != nil {
+		data, err = json.Marshal(event.Data)
+		if err != nil {
+			return fmt.Errorf("failed to encode notification data: %w", err)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin notification transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Email recipients still get the in-app entry so the notification center
+	// stays a complete history.
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO notifications (user_id, type, title, body, data) VALUES ($1, $2, $3, $4, $5)",
+		userID, event.Type, event.Title, event.Body, data)
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+
+	if channel == ChannelEmail {
+		var email, locale string
+		err = tx.QueryRowContext(ctx, "SELECT email, locale FROM users WHERE id = $1", userID).Scan(&email, &locale)
+		if err != nil {
+			return fmt.Errorf("failed to load notification recipient: %w", err)
+		}
+		if isDeliverableEmail(email) {
+			if err := enqueueEmail(ctx, tx, email, "notification", locale, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// claimAndNotify runs a background job that reminds or warns users. claim
+// selects due rows with FOR UPDATE SKIP LOCKED, so several server instances
+// can share the work without waiting on each other, marks them as handled
+// and returns them. Its transaction is committed before notify is called
+// for each row, so no row stays locked while notifications are stored and
+// emails queued. A failed notification is logged and not retried: a missed
+// reminder is better than a repeated one.
+func claimAndNotify[T any](ctx context.Context, claim func(tx *sql.Tx) ([]T, error), notify func(item T) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	items, err := claim(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := notify(item); err != nil {
+			log.Printf("Error sending notification: %v", err)
+		}
+	}
+	return nil
+}
+
+func notificationChannel(ctx context.Context, userID int, notificationType string) (string, error) {
+	var channel string
+	err := db.QueryRowContext(ctx,
+		"SELECT channel FROM notification_preferences WHERE user_id = $1 AND type = $2",
+		userID, notificationType).Scan(&channel)
+	if err == sql.ErrNoRows {
+		return ChannelInApp, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load notification preference: %w", err)
+	}
+	return channel, nil
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	page, limit := parsePagination(r)
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	query := `
+		SELECT id, type, title, body, data, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1
+	`
+	if unreadOnly {
+		query += " AND read_at IS NULL"
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3"
+
+	rows, err := db.Query(query, userID, limit, (page-1)*limit)
+	if err != nil {
+		respondWithError(w, "Error fetching notifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var data []byte
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &data, &readAt, &n.CreatedAt); err != nil {
+			respondWithError(w, "Error scanning notification data", http.StatusInternalServerError)
+			return
+		}
+		if data != nil {
+			n.Data = json.RawMessage(data)
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating notification data", http.StatusInternalServerError)
+		return
+	}
+
+	var total, unread int
+	err = db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE read_at IS NULL)
+		FROM notifications WHERE user_id = $1`, userID).Scan(&total, &unread)
+	if err != nil {
+		respondWithError(w, "Error counting notifications", http.StatusInternalServerError)
+		return
+	}
+	if unreadOnly {
+		total = unread
+	}
+
+	respondWithJSON(w, NotificationListResponse{
+		Notifications: notifications,
+		Total:         total,
+		Unread:        unread,
+		Page:          page,
+		Limit:         limit,
+	}, http.StatusOK)
+}
+
+func unreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	var unread int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL",
+		userID).Scan(&unread)
+	if err != nil {
+		respondWithError(w, "Error counting notifications", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]int{"unread": unread}, http.StatusOK)
+}
+
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	var req MarkNotificationsReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		respondWithError(w, "At least one notification id is required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND id = ANY($2) AND read_at IS NULL`,
+		userID, pq.Array(req.IDs))
+	if err != nil {
+		respondWithError(w, "Error updating notifications", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "Notifications marked as read"}, http.StatusOK)
+}
+
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	_, err := db.Exec("UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND read_at IS NULL",
+		userID)
+	if err != nil {
+		respondWithError(w, "Error updating notifications", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "All notifications marked as read"}, http.StatusOK)
+}
+
+func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var req NotificationPreferencesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		for notificationType, channel := range req.Preferences {
+			if !isNotificationType(notificationType) {
+				respondWithError(w, fmt.Sprintf("Unknown notification type: %s", notificationType), http.StatusBadRequest)
+				return
+			}
+			if channel != ChannelInApp && channel != ChannelEmail && channel != ChannelNone {
+				respondWithError(w, fmt.Sprintf("Invalid channel: %s", channel), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for notificationType, channel := range req.Preferences {
+			_, err := db.Exec(`
+				INSERT INTO notification_preferences (user_id, type, channel) VALUES ($1, $2, $3)
+				ON CONFLICT (user_id, type) DO UPDATE SET channel = EXCLUDED.channel`,
+				userID, notificationType, channel)
+			if err != nil {
+				respondWithError(w, "Error saving notification preferences", http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	preferences, err := loadNotificationPreferences(userID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		respondWithError(w, "Error fetching notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, NotificationPreferencesRequest{Preferences: preferences}, http.StatusOK)
+}
+
+// loadNotificationPreferences returns the channel for every known type,
+// filling in the in-app default where the user has not chosen one.
+func loadNotificationPreferences(userID int) (map[string]string, error) {
+	preferences := make(map[string]string, len(notificationTypes))
+	for _, notificationType := range notificationTypes {
+		preferences[notificationType] = ChannelInApp
+	}
+
+	rows, err := db.Query("SELECT type, channel FROM notification_preferences WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var notificationType, channel string
+		if err := rows.Scan(&notificationType, &channel); err != nil {
+			return nil, err
+		}
+		preferences[notificationType] = channel
+	}
+
+	return preferences, rows.Err()
+}
+
+func isNotificationType(notificationType string) bool {
+	for _, t := range notificationTypes {
+		if t == notificationType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSlotMinutes    = 30
+	maxAvailabilityLength = 12 * time.Hour
+	maxAvailabilityAhead  = 60 * 24 * time.Hour
+	// pickupReminderLead is how long before a pickup both sides are reminded.
+	pickupReminderLead     = 24 * time.Hour
+	pickupReminderInterval = time.Minute
+)
+
+// Appointment statuses.
+const (
+	PickupScheduled = "scheduled"
+	PickupCancelled = "cancelled"
+)
+
+type AvailabilityWindow struct {
+	ID          int       `json:"id"`
+	StartsAt    time.Time `json:"startsAt"`
+	EndsAt      time.Time `json:"endsAt"`
+	SlotMinutes int       `json:"slotMinutes"`
+}
+
+type PickupSlot struct {
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+type PickupAppointment struct {
+	ID            int       `json:"id"`
+	ReservationID int       `json:"reservationId"`
+	StartsAt      time.Time `json:"startsAt"`
+	EndsAt        time.Time `json:"endsAt"`
+	Status        string    `json:"status"`
+	// Sequence counts reschedules, as iCalendar clients expect.
+	Sequence  int       `json:"sequence"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type BookPickupRequest struct {
+	StartsAt time.Time `json:"startsAt"`
+}
+
+func initPickupTables() error {
+	createPickupTablesSQL := `
+	CREATE TABLE IF NOT EXISTS availability_windows (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		slot_minutes INTEGER NOT NULL DEFAULT 30,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (ends_at > starts_at)
+	);
+	CREATE INDEX IF NOT EXISTS availability_windows_user_idx ON availability_windows (user_id, starts_at);
+	CREATE TABLE IF NOT EXISTS pickup_appointments (
+		id SERIAL PRIMARY KEY,
+		reservation_id INTEGER NOT NULL REFERENCES furniture_reservations(id) ON DELETE CASCADE,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'scheduled',
+		sequence INTEGER NOT NULL DEFAULT 0,
+		reminder_sent_at TIMESTAMPTZ,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS pickup_appointments_reservation_idx
+		ON pickup_appointments (reservation_id) WHERE status = 'scheduled';
+	CREATE INDEX IF NOT EXISTS pickup_appointments_reminder_idx
+		ON pickup_appointments (starts_at) WHERE status = 'scheduled' AND reminder_sent_at IS NULL;`
+
+	if _, err := db.Exec(createPickupTablesSQL); err != nil {
+		return fmt.Errorf("failed to create pickup tables: %w", err)
+	}
+
+	return nil
+}
+
+// availabilityHandler lists the current user's upcoming availability (GET)
+// and publishes a new window (POST).
+func availabilityHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query(`
+			SELECT id, starts_at, ends_at, slot_minutes FROM availability_windows
+			WHERE user_id = $1 AND ends_at > CURRENT_TIMESTAMP ORDER BY starts_at`, userID)
+		if err != nil {
+			respondWithError(w, "Error fetching availability", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		windows := []AvailabilityWindow{}
+		for rows.Next() {
+			var window AvailabilityWindow
+			if err := rows.Scan(&window.ID, &window.StartsAt, &window.EndsAt, &window.SlotMinutes); err != nil {
+				respondWithError(w, "Error scanning availability data", http.StatusInternalServerError)
+				return
+			}
+			windows = append(windows, window)
+		}
+		if err = rows.Err(); err != nil {
+			respondWithError(w, "Error iterating availability data", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, map[string]interface{}{"windows": windows}, http.StatusOK)
+
+	case "POST":
+		var req AvailabilityWindow
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.SlotMinutes == 0 {
+			req.SlotMinutes = defaultSlotMinutes
+		}
+
+		now := time.Now()
+		switch {
+		case req.StartsAt.IsZero() || req.EndsAt.IsZero():
+			respondWithError(w, "startsAt and endsAt are required", http.StatusBadRequest)
+			return
+		case !req.EndsAt.After(req.StartsAt):
+			respondWithError(w, "endsAt must be after startsAt", http.StatusBadRequest)
+			return
+		case req.EndsAt.Before(now):
+			respondWithError(w, "Availability must be in the future", http.StatusBadRequest)
+			return
+		case req.EndsAt.Sub(req.StartsAt) > maxAvailabilityLength:
+			respondWithError(w, "Availability windows can be at most 12 hours long", http.StatusBadRequest)
+			return
+		case req.StartsAt.After(now.Add(maxAvailabilityAhead)):
+			respondWithError(w, "Availability can be published at most 60 days ahead", http.StatusBadRequest)
+			return
+		case req.SlotMinutes < 15 || req.SlotMinutes > 240:
+			respondWithError(w, "slotMinutes must be between 15 and 240", http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO availability_windows (user_id, starts_at, ends_at, slot_minutes) VALUES ($1, $2, $3, $4) RETURNING id`,
+			userID, req.StartsAt, req.EndsAt, req.SlotMinutes).Scan(&req.ID)
+		if err != nil {
+			respondWithError(w, "Error creating availability", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, req, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// availabilityWindowHandler withdraws a window. Pickups already booked in
+// it stay scheduled.
+func availabilityWindowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid availability id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM availability_windows WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		respondWithError(w, "Error deleting availability", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondWithError(w, "Availability not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "Availability deleted"}, http.StatusOK)
+}
+
+// pickupReservation loads a reservation the current user takes part in.
+// Pickups can only be arranged once the seller has accepted it.
+func pickupReservation(w http.ResponseWriter, r *http.Request) (Reservation, bool) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid reservation id", http.StatusBadRequest)
+		return Reservation{}, false
+	}
+
+	reservation, err := scanReservation(db.QueryRow(reservationSelectSQL+" WHERE r.id = $1", id))
+	if err == sql.ErrNoRows || (err == nil && reservation.BuyerID != userID && reservation.SellerID != userID) {
+		respondWithError(w, "Reservation not found", http.StatusNotFound)
+		return reservation, false
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching reservation", http.StatusInternalServerError)
+		return reservation, false
+	}
+	return reservation, true
+}
+
+// freePickupSlots carves the seller's upcoming availability into slots and
+// drops those overlapping scheduled pickups, ignoring the appointment being
+// rescheduled.
+func freePickupSlots(ctx context.Context, q querier, sellerID, ignoreAppointmentID int) ([]PickupSlot, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT starts_at, ends_at, slot_minutes FROM availability_windows
+		WHERE user_id = $1 AND ends_at > CURRENT_TIMESTAMP ORDER BY starts_at`, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	var windows []AvailabilityWindow
+	for rows.Next() {
+		var window AvailabilityWindow
+		if err := rows.Scan(&window.StartsAt, &window.EndsAt, &window.SlotMinutes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.QueryContext(ctx, `
+		SELECT a.starts_at, a.ends_at FROM pickup_appointments a
+		JOIN furniture_reservations r ON r.id = a.reservation_id
+		JOIN furniture f ON f.id = r.furniture_id
+		WHERE f.user_id = $1 AND a.status = $2 AND a.id <> $3 AND a.ends_at > CURRENT_TIMESTAMP`,
+		sellerID, PickupScheduled, ignoreAppointmentID)
+	if err != nil {
+		return nil, err
+	}
+	var booked []PickupSlot
+	for rows.Next() {
+		var slot PickupSlot
+		if err := rows.Scan(&slot.StartsAt, &slot.EndsAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		booked = append(booked, slot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	slots := []PickupSlot{}
+	for _, window := range windows {
+		length := time.Duration(window.SlotMinutes) * time.Minute
+		for start := window.StartsAt; !start.Add(length).After(window.EndsAt); start = start.Add(length) {
+			slot := PickupSlot{StartsAt: start.UTC(), EndsAt: start.Add(length).UTC()}
+			if slot.StartsAt.Before(now) {
+				continue
+			}
+			free := true
+			for _, b := range booked {
+				if slot.StartsAt.Before(b.EndsAt) && b.StartsAt.Before(slot.EndsAt) {
+					free = false
+					break
+				}
+			}
+			if free {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots, nil
+}
+
+func pickupSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reservation, ok := pickupReservation(w, r)
+	if !ok {
+		return
+	}
+
+	slots, err := freePickupSlots(r.Context(), db, reservation.SellerID, 0)
+	if err != nil {
+		respondWithError(w, "Error fetching pickup slots", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"slots": slots}, http.StatusOK)
+}
+
+func loadPickupAppointment(ctx context.Context, q querier, reservationID int) (PickupAppointment, error) {
+	var a PickupAppointment
+	err := q.QueryRowContext(ctx, `
+		SELECT id, reservation_id, starts_at, ends_at, status, sequence, created_at, updated_at
+		FROM pickup_appointments WHERE reservation_id = $1
+		ORDER BY (status = 'scheduled') DESC, created_at DESC LIMIT 1`, reservationID).
+		Scan(&a.ID, &a.ReservationID, &a.StartsAt, &a.EndsAt, &a.Status, &a.Sequence, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// pickupHandler books (POST), reschedules (PUT) and cancels (DELETE) the
+// pickup of a reserved listing, and returns it (GET).
+func pickupHandler(w http.ResponseWriter, r *http.Request) {
+	reservation, ok := pickupReservation(w, r)
+	if !ok {
+		return
+	}
+	userID := r.Context().Value(userIDKey).(int)
+	ctx := r.Context()
+
+	current, err := loadPickupAppointment(ctx, db, reservation.ID)
+	hasScheduled := err == nil && current.Status == PickupScheduled
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, "Error fetching pickup", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if err == sql.ErrNoRows {
+			respondWithError(w, "No pickup has been booked", http.StatusNotFound)
+			return
+		}
+		respondWithJSON(w, current, http.StatusOK)
+
+	case "POST", "PUT":
+		if reservation.Status != ReservationAccepted {
+			respondWithError(w, "Pickups can be booked once the reservation is accepted", http.StatusConflict)
+			return
+		}
+		if r.Method == "POST" && hasScheduled {
+			respondWithError(w, "A pickup is already booked; reschedule it instead", http.StatusConflict)
+			return
+		}
+		if r.Method == "PUT" && !hasScheduled {
+			respondWithError(w, "No pickup has been booked", http.StatusNotFound)
+			return
+		}
+
+		var req BookPickupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.StartsAt.IsZero() {
+			respondWithError(w, "startsAt is required", http.StatusBadRequest)
+			return
+		}
+
+		appointment, status, msg := bookPickup(ctx, reservation, current, hasScheduled, req.StartsAt)
+		if msg != "" {
+			respondWithError(w, msg, status)
+			return
+		}
+
+		verb := "booked"
+		if r.Method == "PUT" {
+			verb = "rescheduled"
+		}
+		notifyPickup(ctx, reservation, userID, appointment, "Pickup "+verb,
+			fmt.Sprintf("Pickup of %s %s for %s.", reservation.FurnitureTitle, verb, appointment.StartsAt.Format("2006-01-02 15:04 MST")))
+		respondWithJSON(w, appointment, status)
+
+	case "DELETE":
+		if !hasScheduled {
+			respondWithError(w, "No pickup has been booked", http.StatusNotFound)
+			return
+		}
+		err := db.QueryRowContext(ctx, `
+			UPDATE pickup_appointments SET status = $2, sequence = sequence + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 RETURNING status, sequence, updated_at`, current.ID, PickupCancelled).
+			Scan(&current.Status, &current.Sequence, &current.UpdatedAt)
+		if err != nil {
+			respondWithError(w, "Error cancelling pickup", http.StatusInternalServerError)
+			return
+		}
+
+		notifyPickup(ctx, reservation, userID, current, "Pickup cancelled",
+			fmt.Sprintf("The pickup of %s on %s was cancelled.", reservation.FurnitureTitle, current.StartsAt.Format("2006-01-02 15:04 MST")))
+		respondWithJSON(w, current, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bookPickup books or moves the reservation's pickup to the free slot
+// starting at startsAt. It returns the HTTP status to answer with and, on
+// failure, the message for the client.
+func bookPickup(ctx context.Context, reservation Reservation, current PickupAppointment, reschedule bool, startsAt time.Time) (PickupAppointment, int, string) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return current, http.StatusInternalServerError, "Error booking pickup"
+	}
+	defer tx.Rollback()
+
+	// Serialize bookings per seller so two buyers cannot take the same slot
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", reservation.SellerID); err != nil {
+		return current, http.StatusInternalServerError, "Error booking pickup"
+	}
+
+	ignore := 0
+	if reschedule {
+		ignore = current.ID
+	}
+	slots, err := freePickupSlots(ctx, tx, reservation.SellerID, ignore)
+	if err != nil {
+		return current, http.StatusInternalServerError, "Error booking pickup"
+	}
+	var slot *PickupSlot
+	for i := range slots {
+		if slots[i].StartsAt.Equal(startsAt) {
+			slot = &slots[i]
+			break
+		}
+	}
+	if slot == nil {
+		return current, http.StatusConflict, "That pickup slot is not available"
+	}
+
+	// Pickups booked inside the reminder lead time need no separate reminder
+	var reminded *time.Time
+	if now := time.Now(); slot.StartsAt.Sub(now) < pickupReminderLead {
+		reminded = &now
+	}
+
+	var appointment PickupAppointment
+	status := http.StatusCreated
+	if reschedule {
+		status = http.StatusOK
+		err = tx.QueryRowContext(ctx, `
+			UPDATE pickup_appointments SET starts_at = $2, ends_at = $3, reminder_sent_at = $4, sequence = sequence + 1,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING id, reservation_id, starts_at, ends_at, status, sequence, created_at, updated_at`,
+			current.ID, slot.StartsAt, slot.EndsAt, reminded).
+			Scan(&appointment.ID, &appointment.ReservationID, &appointment.StartsAt, &appointment.EndsAt,
+				&appointment.Status, &appointment.Sequence, &appointment.CreatedAt, &appointment.UpdatedAt)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO pickup_appointments (reservation_id, starts_at, ends_at, reminder_sent_at) VALUES ($1, $2, $3, $4)
+			RETURNING id, reservation_id, starts_at, ends_at, status, sequence, created_at, updated_at`,
+			reservation.ID, slot.StartsAt, slot.EndsAt, reminded).
+			Scan(&appointment.ID, &appointment.ReservationID, &appointment.StartsAt, &appointment.EndsAt,
+				&appointment.Status, &appointment.Sequence, &appointment.CreatedAt, &appointment.UpdatedAt)
+	}
+	if isUniqueViolation(err) {
+		return current, http.StatusConflict, "A pickup is already booked; reschedule it instead"
+	}
+	if err != nil {
+		return current, http.StatusInternalServerError, "Error booking pickup"
+	}
+
+	if err := tx.Commit(); err != nil {
+		return current, http.StatusInternalServerError, "Error booking pickup"
+	}
+	return appointment, status, ""
+}
+
+// cancelPickups cancels the scheduled pickup of a reservation, if any.
+func cancelPickups(ctx context.Context, reservationID int) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE pickup_appointments SET status = $2, sequence = sequence + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE reservation_id = $1 AND status = $3`, reservationID, PickupCancelled, PickupScheduled)
+	return err
+}
+
+// notifyPickup tells the side of the reservation other than actorID about a
+// pickup change. The change is already saved, so failures are only logged.
+func notifyPickup(ctx context.Context, reservation Reservation, actorID int, appointment PickupAppointment, title, body string) {
+	recipient := reservation.SellerID
+	if actorID == reservation.SellerID {
+		recipient = reservation.BuyerID
+	}
+	err := Notify(ctx, recipient, pickupNotification(reservation, appointment, title, body))
+	if err != nil {
+		log.Printf("Error notifying user %d about pickup %d: %v", recipient, appointment.ID, err)
+	}
+}
+
+func pickupNotification(reservation Reservation, appointment PickupAppointment, title, body string) NotificationEvent {
+	return NotificationEvent{
+		Type:  NotificationPickup,
+		Title: title,
+		Body:  body,
+		Data: map[string]interface{}{
+			"reservationId": reservation.ID,
+			"furnitureId":   reservation.FurnitureID,
+			"appointmentId": appointment.ID,
+			"startsAt":      appointment.StartsAt,
+		},
+	}
+}
+
+func runPickupReminderWorker(ctx context.Context) {
+	ticker := time.NewTicker(pickupReminderInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sendPickupReminders(ctx); err != nil {
+			log.Printf("Error sending pickup reminders: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendPickupReminders(ctx context.Context) error {
+	type due struct {
+		appointment   PickupAppointment
+		reservationID int
+	}
+
+	claim := func(tx *sql.Tx) ([]due, error) {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT a.id, a.starts_at, a.ends_at, a.reservation_id
+			FROM pickup_appointments a
+			WHERE a.status = $1 AND a.reminder_sent_at IS NULL
+				AND a.starts_at > CURRENT_TIMESTAMP AND a.starts_at <= CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+			ORDER BY a.starts_at
+			LIMIT 50
+			FOR UPDATE SKIP LOCKED`, PickupScheduled, pickupReminderLead.Seconds())
+		if err != nil {
+			return nil, err
+		}
+		var reminders []due
+		for rows.Next() {
+			var d due
+			if err := rows.Scan(&d.appointment.ID, &d.appointment.StartsAt, &d.appointment.EndsAt, &d.reservationID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			reminders = append(reminders, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, d := range reminders {
+			if _, err := tx.ExecContext(ctx, "UPDATE pickup_appointments SET reminder_sent_at = CURRENT_TIMESTAMP WHERE id = $1", d.appointment.ID); err != nil {
+				return nil, err
+			}
+		}
+		return reminders, nil
+	}
+
+	return claimAndNotify(ctx, claim, func(d due) error {
+		reservation, err := scanReservation(db.QueryRowContext(ctx, reservationSelectSQL+" WHERE r.id = $1", d.reservationID))
+		if err != nil {
+			return fmt.Errorf("pickup %d: %w", d.appointment.ID, err)
+		}
+
+		when := d.appointment.StartsAt.Format("2006-01-02 15:04 MST")
+		for _, recipient := range []int{reservation.BuyerID, reservation.SellerID} {
+			event := pickupNotification(reservation, d.appointment, "Pickup reminder",
+				fmt.Sprintf("Pickup of %s is scheduled for %s.", reservation.FurnitureTitle, when))
+			if err := Notify(ctx, recipient, event); err != nil {
+				return fmt.Errorf("pickup %d: %w", d.appointment.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// pickupICSHandler exports the reservation's pickup as an iCalendar event.
+// Cancelled pickups are exported with STATUS:CANCELLED so calendars that
+// imported the event before remove it.
+func pickupICSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reservation, ok := pickupReservation(w, r)
+	if !ok {
+		return
+	}
+	appointment, err := loadPickupAppointment(r.Context(), db, reservation.ID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "No pickup has been booked", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching pickup", http.StatusInternalServerError)
+		return
+	}
+
+	// Both sides of an accepted reservation may see the exact address
+	var address, city string
+	err = db.QueryRow("SELECT COALESCE(address, ''), location FROM furniture WHERE id = $1", reservation.FurnitureID).Scan(&address, &city)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	location := city
+	if address != "" {
+		location = address + ", " + city
+	}
+
+	status := "CONFIRMED"
+	if appointment.Status == PickupCancelled {
+		status = "CANCELLED"
+	}
+
+	const icsTime = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//FurnitureHub//Pickup//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:pickup-%d@furniturehub", appointment.ID),
+		"DTSTAMP:" + appointment.UpdatedAt.UTC().Format(icsTime),
+		"DTSTART:" + appointment.StartsAt.UTC().Format(icsTime),
+		"DTEND:" + appointment.EndsAt.UTC().Format(icsTime),
+		"SEQUENCE:" + strconv.Itoa(appointment.Sequence),
+		"STATUS:" + status,
+		"SUMMARY:" + escapeICSText("Pickup: "+reservation.FurnitureTitle),
+		"LOCATION:" + escapeICSText(location),
+		"DESCRIPTION:" + escapeICSText(fmt.Sprintf("Pickup of %s reserved by %s.", reservation.FurnitureTitle, reservation.BuyerName)),
+		"URL:" + listingURL(reservation.FurnitureID),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(foldICSLine(line))
+		b.WriteString("\r\n")
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pickup-%d.ics\"", appointment.ID))
+	w.Write([]byte(b.String()))
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escapeICSText(s string) string {
+	return icsTextEscaper.Replace(s)
+}
+
+// foldICSLine splits lines longer than 75 octets as RFC 5545 requires,
+// without breaking UTF-8 sequences.
+func foldICSLine(line string) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
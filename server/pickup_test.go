@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFoldICSLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"empty", "", ""},
+		{"short", "SUMMARY:Pickup", "SUMMARY:Pickup"},
+		{"exactly 75 octets", strings.Repeat("a", 75), strings.Repeat("a", 75)},
+		{"76 octets", strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a"},
+		{
+			"continuation lines hold 74 octets",
+			strings.Repeat("a", 75+74+1),
+			strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n a",
+		},
+		{
+			"multi-byte rune is not split",
+			strings.Repeat("a", 74) + "ł",
+			strings.Repeat("a", 74) + "\r\n ł",
+		},
+		{
+			"multi-byte rune fits exactly",
+			strings.Repeat("a", 73) + "ł",
+			strings.Repeat("a", 73) + "ł",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := foldICSLine(tt.line)
+			if got != tt.want {
+				t.Errorf("foldICSLine(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+			for _, line := range strings.Split(got, "\r\n") {
+				if len(line) > 75 {
+					t.Errorf("folded line has %d octets: %q", len(line), line)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("folded line is not valid UTF-8: %q", line)
+				}
+			}
+			if unfolded := strings.ReplaceAll(got, "\r\n ", ""); unfolded != tt.line {
+				t.Errorf("unfolding gave %q, want %q", unfolded, tt.line)
+			}
+		})
+	}
+}
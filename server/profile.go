@@ -66,4 +66,26 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 	}
-} 
\ No newline at end of file
+}
+
+// optionalUserID returns the caller's user id on public endpoints that
+// behave differently for signed-in users. A missing or invalid token just
+// means an anonymous caller.
+func optionalUserID(r *http.Request) (int, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) < 7 || authHeader[:7] != "Bearer " {
+		return 0, false
+	}
+
+	token, err := jwt.ParseWithClaims(authHeader[7:], &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return 0, false
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return 0, false
+	}
+	return claims.UserID, true
+}
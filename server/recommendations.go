@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Recommendation strategies. Users without any views or favorites yet,
+// such as fresh guests from temporaryUserHandler, get popular listings.
+const (
+	StrategyPersonalized = "personalized"
+	StrategyPopular      = "popular"
+)
+
+const (
+	maxRecentlyViewed = 50
+	// Favorites say more about taste than a passing view
+	viewSignalWeight     = 1
+	favoriteSignalWeight = 3
+	signalWindowSQL      = "INTERVAL '90 days'"
+	popularWindowDays    = 7
+	// proximityScaleKm is the distance at which the proximity score halves
+	proximityScaleKm = 25
+)
+
+type FavoriteItem struct {
+	Furniture   Furniture `json:"furniture"`
+	FavoritedAt time.Time `json:"favoritedAt"`
+}
+
+type RecentlyViewedItem struct {
+	Furniture Furniture `json:"furniture"`
+	ViewedAt  time.Time `json:"viewedAt"`
+}
+
+type RecommendationResponse struct {
+	Furniture []Furniture `json:"furniture"`
+	Strategy  string      `json:"strategy"`
+	Page      int         `json:"page"`
+	Limit     int         `json:"limit"`
+}
+
+func initFavoriteTables() error {
+	createFavoriteTablesSQL := `
+	CREATE TABLE IF NOT EXISTS furniture_favorites (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, furniture_id)
+	);`
+
+	if _, err := db.Exec(createFavoriteTablesSQL); err != nil {
+		return fmt.Errorf("failed to create favorite tables: %w", err)
+	}
+
+	return nil
+}
+
+// favoriteHandler adds (PUT) or removes (DELETE) a listing from the
+// caller's favorites. Both are idempotent.
+func favoriteHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		result, err := db.Exec(`
+			INSERT INTO furniture_favorites (user_id, furniture_id)
+			SELECT $1, id FROM furniture WHERE id = $2
+			ON CONFLICT DO NOTHING`, userID, id)
+		if err != nil {
+			respondWithError(w, "Error saving favorite", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM furniture WHERE id = $1)", id).Scan(&exists); err != nil {
+				respondWithError(w, "Error saving favorite", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				respondWithError(w, "Furniture not found", http.StatusNotFound)
+				return
+			}
+		}
+		respondWithJSON(w, Response{Message: "Added to favorites"}, http.StatusOK)
+
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM furniture_favorites WHERE user_id = $1 AND furniture_id = $2", userID, id); err != nil {
+			respondWithError(w, "Error removing favorite", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, Response{Message: "Removed from favorites"}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// favoritesHandler lists the caller's favorites, most recent first,
+// including expired listings so they do not silently disappear.
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	rows, err := db.Query(`
+		SELECT `+furnitureColumns+`, fav.created_at
+		FROM furniture JOIN furniture_favorites fav ON fav.furniture_id = furniture.id
+		WHERE fav.user_id = $1 ORDER BY fav.created_at DESC`, userID)
+	if err != nil {
+		respondWithError(w, "Error fetching favorites", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	favorites := []FavoriteItem{}
+	for rows.Next() {
+		var item FavoriteItem
+		item.Furniture, err = scanFurniture(rows, &item.FavoritedAt)
+		if err != nil {
+			respondWithError(w, "Error scanning favorite data", http.StatusInternalServerError)
+			return
+		}
+		favorites = append(favorites, item)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating favorite data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"favorites": favorites, "total": len(favorites)}, http.StatusOK)
+}
+
+// recentlyViewedHandler lists the listings the caller opened, most recent
+// first. Views are recorded by furnitureDetailHandler.
+func recentlyViewedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	rows, err := db.Query(`
+		SELECT `+furnitureColumns+`, recent.viewed_at
+		FROM furniture JOIN (
+			SELECT furniture_id, MAX(viewed_at) AS viewed_at FROM furniture_views
+			WHERE user_id = $1 GROUP BY furniture_id
+		) recent ON recent.furniture_id = furniture.id
+		ORDER BY recent.viewed_at DESC
+		LIMIT $2`, userID, maxRecentlyViewed)
+	if err != nil {
+		respondWithError(w, "Error fetching recently viewed furniture", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []RecentlyViewedItem{}
+	for rows.Next() {
+		var item RecentlyViewedItem
+		item.Furniture, err = scanFurniture(rows, &item.ViewedAt)
+		if err != nil {
+			respondWithError(w, "Error scanning furniture data", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating furniture data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"furniture": items, "total": len(items)}, http.StatusOK)
+}
+
+// recommendationsHandler is the home feed. Active listings from other
+// sellers that the caller has not viewed or favorited yet are scored by how
+// well their tags and category match what the caller viewed and favorited,
+// whether their price falls in the caller's usual range and how close they
+// are to where the caller usually looks, or to ?near= when given.
+func recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	page, limit := parsePagination(r)
+
+	q := &furnitureQuery{}
+	user := q.arg(userID)
+	q.where("expires_at > CURRENT_TIMESTAMP")
+	q.where("(user_id IS NULL OR user_id <> " + user + ")")
+	q.where("id NOT IN (SELECT furniture_id FROM furniture_favorites WHERE user_id = " + user + ")")
+	// Listings the caller already opened are what the feed is built from and
+	// are one tap away under recently viewed, so they are not suggested again
+	q.where("id NOT IN (SELECT furniture_id FROM furniture_views WHERE user_id = " + user +
+		" AND viewed_at > CURRENT_TIMESTAMP - " + signalWindowSQL + ")")
+
+	nearLat, nearLng := "NULL::float8", "NULL::float8"
+	if near := r.URL.Query().Get("near"); near != "" {
+		lat, lng, err := parseLatLng(near)
+		if err != nil {
+			respondWithError(w, "near "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		nearLat, nearLng = q.arg(lat), q.arg(lng)
+	}
+
+	signals := `
+		SELECT furniture_id, ` + strconv.Itoa(viewSignalWeight) + `::float8 AS weight FROM furniture_views
+			WHERE user_id = ` + user + ` AND viewed_at > CURRENT_TIMESTAMP - ` + signalWindowSQL + `
+		UNION ALL
+		SELECT furniture_id, ` + strconv.Itoa(favoriteSignalWeight) + ` FROM furniture_favorites WHERE user_id = ` + user
+
+	var personalized bool
+	if err := db.QueryRow("SELECT EXISTS ("+signals+")", q.args[0]).Scan(&personalized); err != nil {
+		respondWithError(w, "Error fetching recommendations", http.StatusInternalServerError)
+		return
+	}
+
+	var query string
+	strategy := StrategyPopular
+	if personalized {
+		strategy = StrategyPersonalized
+		query = `
+		WITH signals AS (` + signals + `),
+		seen AS (
+			SELECT f.tags, f.category_id, ` + effectivePriceSQL + ` AS effective_price,
+				f.latitude, f.longitude, s.weight
+			FROM signals s JOIN furniture f ON f.id = s.furniture_id
+		),
+		tag_affinity AS (
+			SELECT tag, SUM(weight) / (SELECT SUM(weight) FROM seen) AS affinity
+			FROM seen, unnest(tags) AS tag GROUP BY tag
+		),
+		category_affinity AS (
+			SELECT category_id, SUM(weight) / (SELECT SUM(weight) FROM seen) AS affinity
+			FROM seen GROUP BY category_id
+		),
+		profile AS (
+			SELECT
+				percentile_cont(0.1) WITHIN GROUP (ORDER BY effective_price) AS min_price,
+				percentile_cont(0.9) WITHIN GROUP (ORDER BY effective_price) AS max_price,
+				COALESCE(` + nearLat + `, AVG(latitude)) AS lat,
+				COALESCE(` + nearLng + `, AVG(longitude)) AS lng
+			FROM seen
+		)
+		SELECT ` + furnitureColumns + `,
+			3 * COALESCE((SELECT SUM(affinity) FROM tag_affinity WHERE tag = ANY (furniture.tags)), 0)
+			+ 2 * COALESCE((SELECT affinity FROM category_affinity ca WHERE ca.category_id = furniture.category_id), 0)
+			+ (SELECT CASE WHEN ` + effectivePriceSQL + ` BETWEEN p.min_price AND p.max_price THEN 1 ELSE 0 END FROM profile p)
+			+ (SELECT ` + proximityScoreSQL("p.lat", "p.lng") + ` FROM profile p) AS score
+		FROM furniture`
+	} else {
+		// Cold start: what others have been looking at lately, freshly
+		// listed items and, when ?near= is given, nearby ones
+		query = `
+		SELECT ` + furnitureColumns + `,
+			LN(1 + (SELECT COUNT(*) FROM furniture_views v
+				WHERE v.furniture_id = furniture.id AND v.day > CURRENT_DATE - ` + strconv.Itoa(popularWindowDays) + `))
+			+ CASE WHEN created_at > CURRENT_TIMESTAMP - INTERVAL '` + strconv.Itoa(popularWindowDays) + ` days' THEN 1 ELSE 0 END
+			+ ` + proximityScoreSQL(nearLat, nearLng) + ` AS score
+		FROM furniture`
+	}
+	query += q.whereClause() + fmt.Sprintf(" ORDER BY score DESC, id DESC LIMIT %d OFFSET %d", limit, (page-1)*limit)
+
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		respondWithError(w, "Error fetching recommendations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	furniture := []Furniture{}
+	for rows.Next() {
+		var score sql.NullFloat64
+		item, err := scanFurniture(rows, &score)
+		if err != nil {
+			respondWithError(w, "Error scanning furniture data", http.StatusInternalServerError)
+			return
+		}
+		furniture = append(furniture, item)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating furniture data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, RecommendationResponse{Furniture: furniture, Strategy: strategy, Page: page, Limit: limit}, http.StatusOK)
+}
+
+// proximityScoreSQL scores a listing between 0 and 1 by its distance from a
+// point, or 0 when either position is unknown.
+func proximityScoreSQL(lat, lng string) string {
+	distance := distanceKmSQL("furniture.latitude", "furniture.longitude", lat, lng)
+	return fmt.Sprintf("COALESCE(1 / (1 + %s / %d), 0)", distance, proximityScaleKm)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reservation statuses. A buyer asks to reserve a listing, the seller
+// accepts or declines, and either side can cancel until the deal is done.
+const (
+	ReservationPending   = "pending"
+	ReservationAccepted  = "accepted"
+	ReservationDeclined  = "declined"
+	ReservationCancelled = "cancelled"
+)
+
+type Reservation struct {
+	ID             int    `json:"id"`
+	FurnitureID    int    `json:"furnitureId"`
+	FurnitureTitle string `json:"furnitureTitle"`
+	BuyerID        int    `json:"buyerId"`
+	BuyerName      string `json:"buyerName"`
+	SellerID       int    `json:"sellerId"`
+	// BundleID is set on each item reservation made through a bundle; such
+	// reservations change status together
+	BundleID  *int      `json:"bundleId,omitempty"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ReservationRequest struct {
+	Message string `json:"message"`
+}
+
+type UpdateReservationRequest struct {
+	Status string `json:"status"`
+}
+
+type ReservationListResponse struct {
+	Reservations []Reservation `json:"reservations"`
+	Total        int           `json:"total"`
+}
+
+func initReservationTables() error {
+	createReservationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS furniture_reservations (
+		id SERIAL PRIMARY KEY,
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		buyer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		message TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS furniture_reservations_active_idx
+		ON furniture_reservations (furniture_id, buyer_id) WHERE status IN ('pending', 'accepted');
+	CREATE UNIQUE INDEX IF NOT EXISTS furniture_reservations_accepted_idx
+		ON furniture_reservations (furniture_id) WHERE status = 'accepted';
+	CREATE INDEX IF NOT EXISTS furniture_reservations_buyer_idx ON furniture_reservations (buyer_id, created_at DESC);`
+
+	if _, err := db.Exec(createReservationsTableSQL); err != nil {
+		return fmt.Errorf("failed to create reservations table: %w", err)
+	}
+
+	return nil
+}
+
+const reservationSelectSQL = `
+	SELECT r.id, r.furniture_id, f.title, r.buyer_id, u.name, f.user_id, r.bundle_id, r.status, r.message, r.created_at, r.updated_at
+	FROM furniture_reservations r
+	JOIN furniture f ON f.id = r.furniture_id
+	JOIN users u ON u.id = r.buyer_id`
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation"
+}
+
+func scanReservation(row interface{ Scan(...interface{}) error }) (Reservation, error) {
+	var res Reservation
+	err := row.Scan(&res.ID, &res.FurnitureID, &res.FurnitureTitle, &res.BuyerID, &res.BuyerName, &res.SellerID, &res.BundleID,
+		&res.Status, &res.Message, &res.CreatedAt, &res.UpdatedAt)
+	return res, err
+}
+
+func queryReservations(query string, args ...interface{}) ([]Reservation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, res)
+	}
+	return reservations, rows.Err()
+}
+
+// furnitureReservationsHandler lets a buyer reserve a listing (POST) and its
+// seller review the reservations it received (GET).
+func furnitureReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	furnitureID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	var sellerID *int
+	var title, offerType string
+	var expired bool
+	err = db.QueryRow("SELECT user_id, title, offer_type, expires_at <= CURRENT_TIMESTAMP FROM furniture WHERE id = $1", furnitureID).
+		Scan(&sellerID, &title, &offerType, &expired)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if sellerID == nil || *sellerID != userID {
+			respondWithError(w, "Furniture not found", http.StatusNotFound)
+			return
+		}
+		reservations, err := queryReservations(reservationSelectSQL+" WHERE r.furniture_id = $1 ORDER BY r.created_at DESC", furnitureID)
+		if err != nil {
+			respondWithError(w, "Error fetching reservations", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, ReservationListResponse{Reservations: reservations, Total: len(reservations)}, http.StatusOK)
+
+	case "POST":
+		// Listings imported before ownership existed have no seller to answer
+		if sellerID == nil {
+			respondWithError(w, "This listing cannot be reserved", http.StatusConflict)
+			return
+		}
+		if *sellerID == userID {
+			respondWithError(w, "You cannot reserve your own listing", http.StatusBadRequest)
+			return
+		}
+		if expired {
+			respondWithError(w, "This listing has expired", http.StatusConflict)
+			return
+		}
+		// The auction's winner gets the reservation when it closes
+		if offerType == OfferTypeAuction {
+			respondWithError(w, "Auctioned listings cannot be reserved; place a bid instead", http.StatusConflict)
+			return
+		}
+
+		var req ReservationRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				respondWithError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		req.Message = strings.TrimSpace(req.Message)
+		if len(req.Message) > 1000 {
+			respondWithError(w, "Message must be at most 1000 characters", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var id int
+		err = tx.QueryRow(`
+			INSERT INTO furniture_reservations (furniture_id, buyer_id, message) VALUES ($1, $2, $3) RETURNING id`,
+			furnitureID, userID, req.Message).Scan(&id)
+		if isUniqueViolation(err) {
+			respondWithError(w, "You already have an active reservation for this listing", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = dispatchReservationCreated(r.Context(), tx, id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			respondWithError(w, "Error creating reservation", http.StatusInternalServerError)
+			return
+		}
+
+		reservation, err := scanReservation(db.QueryRow(reservationSelectSQL+" WHERE r.id = $1", id))
+		if err != nil {
+			respondWithError(w, "Error fetching reservation", http.StatusInternalServerError)
+			return
+		}
+
+		notifyReservation(r, *sellerID, reservation, "New reservation request",
+			fmt.Sprintf("%s would like to reserve %s.", reservation.BuyerName, title))
+		respondWithJSON(w, reservation, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// reservationsHandler lists the current user's reservations, as a buyer by
+// default or as a seller with ?as=seller.
+func reservationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	query := reservationSelectSQL + " WHERE r.buyer_id = $1"
+	switch r.URL.Query().Get("as") {
+	case "", "buyer":
+	case "seller":
+		query = reservationSelectSQL + " WHERE f.user_id = $1"
+	default:
+		respondWithError(w, "as must be buyer or seller", http.StatusBadRequest)
+		return
+	}
+
+	args := []interface{}{userID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND r.status = $2"
+		args = append(args, status)
+	}
+
+	reservations, err := queryReservations(query+" ORDER BY r.created_at DESC", args...)
+	if err != nil {
+		respondWithError(w, "Error fetching reservations", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, ReservationListResponse{Reservations: reservations, Total: len(reservations)}, http.StatusOK)
+}
+
+// reservationHandler moves a reservation through its lifecycle. Sellers
+// accept or decline pending reservations; either side may cancel.
+func reservationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid reservation id", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := scanReservation(db.QueryRow(reservationSelectSQL+" WHERE r.id = $1", id))
+	if err == sql.ErrNoRows || (err == nil && reservation.BuyerID != userID && reservation.SellerID != userID) {
+		respondWithError(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching reservation", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respondWithJSON(w, reservation, http.StatusOK)
+
+	case "PUT":
+		var req UpdateReservationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		isSeller := reservation.SellerID == userID
+		var allowedFrom []string
+		switch req.Status {
+		case ReservationAccepted, ReservationDeclined:
+			if !isSeller {
+				respondWithError(w, "Only the seller can accept or decline a reservation", http.StatusForbidden)
+				return
+			}
+			allowedFrom = []string{ReservationPending}
+		case ReservationCancelled:
+			allowedFrom = []string{ReservationPending, ReservationAccepted}
+		default:
+			respondWithError(w, "status must be accepted, declined or cancelled", http.StatusBadRequest)
+			return
+		}
+
+		updated, err := updateReservationStatus(r.Context(), reservation, req.Status, allowedFrom)
+		if isUniqueViolation(err) {
+			respondWithError(w, "Another reservation for this listing is already accepted", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError(w, "Error updating reservation", http.StatusInternalServerError)
+			return
+		}
+		if !updated {
+			respondWithError(w, fmt.Sprintf("A %s reservation cannot be %s", reservation.Status, req.Status), http.StatusConflict)
+			return
+		}
+		reservation.Status = req.Status
+		reservation.UpdatedAt = time.Now()
+
+		// A cancelled deal frees the seller's pickup slot
+		if req.Status == ReservationCancelled {
+			if err := cancelPickups(r.Context(), id); err != nil {
+				log.Printf("Error cancelling pickups of reservation %d: %v", id, err)
+			}
+		}
+
+		recipient, title := reservation.BuyerID, "Reservation "+req.Status
+		body := fmt.Sprintf("Your reservation of %s was %s.", reservation.FurnitureTitle, req.Status)
+		if !isSeller {
+			recipient = reservation.SellerID
+			body = fmt.Sprintf("%s cancelled their reservation of %s.", reservation.BuyerName, reservation.FurnitureTitle)
+		}
+		notifyReservation(r, recipient, reservation, title, body)
+		respondWithJSON(w, reservation, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// updateReservationStatus moves a reservation, and the other item
+// reservations of the same bundle request, to status. An accepted
+// reservation sells its items, which partners hear about through the
+// listing.sold webhook in the same transaction, and breaks the bundles an
+// item sold on its own belonged to.
+func updateReservationStatus(ctx context.Context, reservation Reservation, status string, allowedFrom []string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE furniture_reservations SET status = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE status = ANY($3) AND (id = $1 OR (bundle_id = $4 AND buyer_id = $5))
+		RETURNING furniture_id`,
+		reservation.ID, status, pq.Array(allowedFrom), reservation.BundleID, reservation.BuyerID)
+	if err != nil {
+		return false, err
+	}
+	var furnitureIDs []int
+	for rows.Next() {
+		var furnitureID int
+		if err := rows.Scan(&furnitureID); err != nil {
+			rows.Close()
+			return false, err
+		}
+		furnitureIDs = append(furnitureIDs, furnitureID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(furnitureIDs) == 0 {
+		return false, err
+	}
+
+	var broken []brokenBundle
+	if status == ReservationAccepted {
+		for _, furnitureID := range furnitureIDs {
+			if err := dispatchListingSold(ctx, tx, furnitureID, SoldViaReservation); err != nil {
+				return false, err
+			}
+		}
+
+		// Selling an item on its own breaks the bundles it was part of
+		if reservation.BundleID == nil {
+			if broken, err = breakBundles(ctx, tx, reservation.FurnitureID); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	for _, b := range broken {
+		notifyBundleCancelled(ctx, b.buyers, b.id, b.title)
+	}
+	return true, nil
+}
+
+// notifyReservation tells the other party about a reservation change. The
+// change itself has already been saved, so failures are only logged.
+func notifyReservation(r *http.Request, userID int, reservation Reservation, title, body string) {
+	err := Notify(r.Context(), userID, NotificationEvent{
+		Type:  NotificationOffer,
+		Title: title,
+		Body:  body,
+		Data: map[string]interface{}{
+			"reservationId": reservation.ID,
+			"furnitureId":   reservation.FurnitureID,
+			"status":        reservation.Status,
+		},
+	})
+	if err != nil {
+		log.Printf("Error notifying user %d about reservation %d: %v", userID, reservation.ID, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revision actions, named after the statement that produced them.
+const (
+	RevisionInsert = "insert"
+	RevisionUpdate = "update"
+)
+
+const maxRevisionsShown = 500
+
+// FurnitureRevision is one recorded change to a listing. ActorID is the
+// user the change was made on behalf of; it is empty for changes made by
+// the server itself, such as bids moving an auction's price or archiving.
+type FurnitureRevision struct {
+	ID        int64                  `json:"id"`
+	Action    string                 `json:"action"`
+	ActorID   *int                   `json:"actorId,omitempty"`
+	ActorName string                 `json:"actorName,omitempty"`
+	Changes   map[string]FieldChange `json:"changes"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+type FieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+type PricePoint struct {
+	Price     *float64  `json:"price"`
+	OfferType string    `json:"offerType"`
+	From      time.Time `json:"from"`
+}
+
+// initRevisionTables installs the trigger that records every insert and
+// update of a furniture row, whichever code path made it. Revisions have
+// no foreign key so they outlive the listing, and cannot be changed.
+func initRevisionTables() error {
+	createRevisionTablesSQL := `
+	CREATE TABLE IF NOT EXISTS furniture_revisions (
+		id BIGSERIAL PRIMARY KEY,
+		furniture_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		action VARCHAR(10) NOT NULL,
+		changes JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS furniture_revisions_furniture_idx ON furniture_revisions (furniture_id, id);
+
+	CREATE OR REPLACE FUNCTION record_furniture_revision() RETURNS trigger AS $$
+	DECLARE
+		old_row JSONB := CASE WHEN TG_OP = 'UPDATE' THEN to_jsonb(OLD) ELSE '{}'::jsonb END;
+		new_row JSONB := to_jsonb(NEW);
+		changes JSONB := '{}'::jsonb;
+		column_name TEXT;
+	BEGIN
+		FOR column_name IN SELECT jsonb_object_keys(new_row) LOOP
+			-- Bookkeeping and derived columns are not edits
+			IF column_name IN ('id', 'created_at', 'updated_at', 'expiry_reminded_at', 'public_latitude', 'public_longitude',
+				'view_count', 'title_key') THEN
+				CONTINUE;
+			END IF;
+			IF COALESCE(old_row -> column_name, 'null'::jsonb) IS DISTINCT FROM new_row -> column_name THEN
+				changes := changes || jsonb_build_object(column_name,
+					jsonb_build_object('from', old_row -> column_name, 'to', new_row -> column_name));
+			END IF;
+		END LOOP;
+
+		IF changes <> '{}'::jsonb THEN
+			INSERT INTO furniture_revisions (furniture_id, actor_id, action, changes)
+			VALUES (NEW.id, NULLIF(current_setting('app.actor_id', true), '')::INTEGER, lower(TG_OP), changes);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS furniture_revision_trigger ON furniture;
+	CREATE TRIGGER furniture_revision_trigger AFTER INSERT OR UPDATE ON furniture
+		FOR EACH ROW EXECUTE FUNCTION record_furniture_revision();
+
+	CREATE OR REPLACE FUNCTION forbid_revision_change() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'furniture revisions are immutable';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS furniture_revisions_immutable ON furniture_revisions;
+	CREATE TRIGGER furniture_revisions_immutable BEFORE UPDATE OR DELETE ON furniture_revisions
+		FOR EACH ROW EXECUTE FUNCTION forbid_revision_change();`
+
+	if _, err := db.Exec(createRevisionTablesSQL); err != nil {
+		return fmt.Errorf("failed to create revision tables: %w", err)
+	}
+
+	return nil
+}
+
+// setRevisionActor attributes the furniture changes made in tx to userID.
+// The setting is local to the transaction.
+func setRevisionActor(ctx context.Context, tx execer, userID int) error {
+	_, err := tx.ExecContext(ctx, "SELECT set_config('app.actor_id', $1, true)", strconv.Itoa(userID))
+	return err
+}
+
+// withRevisionActor runs fn in a transaction whose furniture changes are
+// attributed to userID.
+func withRevisionActor(ctx context.Context, userID int, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setRevisionActor(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revisionFieldName turns a column name into the field name the API uses,
+// e.g. width_cm into widthCm.
+func revisionFieldName(column string) string {
+	parts := strings.Split(column, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// furnitureHistoryHandler lists a listing's revisions, newest first. Only
+// the owner and admins may see it, since it includes the private address.
+func furnitureHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	// Revisions outlive the listing, so ownership is read from them when
+	// the listing itself is gone
+	var ownerID *int
+	err = db.QueryRow(`
+		SELECT COALESCE(
+			(SELECT user_id FROM furniture WHERE id = $1),
+			(SELECT (changes -> 'user_id' ->> 'to')::INTEGER FROM furniture_revisions
+				WHERE furniture_id = $1 AND changes ? 'user_id' ORDER BY id DESC LIMIT 1))`, id).Scan(&ownerID)
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+	if ownerID == nil || *ownerID != userID {
+		role, err := userRole(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Error fetching user", http.StatusInternalServerError)
+			return
+		}
+		if role != RoleAdmin {
+			respondWithError(w, "Furniture not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT r.id, r.action, r.actor_id, COALESCE(u.name, ''), r.changes, r.created_at
+		FROM furniture_revisions r LEFT JOIN users u ON u.id = r.actor_id
+		WHERE r.furniture_id = $1
+		ORDER BY r.id DESC
+		LIMIT $2`, id, maxRevisionsShown)
+	if err != nil {
+		respondWithError(w, "Error fetching history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []FurnitureRevision{}
+	for rows.Next() {
+		var rev FurnitureRevision
+		var changes []byte
+		if err := rows.Scan(&rev.ID, &rev.Action, &rev.ActorID, &rev.ActorName, &changes, &rev.CreatedAt); err != nil {
+			respondWithError(w, "Error scanning history data", http.StatusInternalServerError)
+			return
+		}
+		var columns map[string]FieldChange
+		if err := json.Unmarshal(changes, &columns); err != nil {
+			respondWithError(w, "Error scanning history data", http.StatusInternalServerError)
+			return
+		}
+		rev.Changes = make(map[string]FieldChange, len(columns))
+		for column, change := range columns {
+			rev.Changes[revisionFieldName(column)] = change
+		}
+		revisions = append(revisions, rev)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating history data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"revisions": revisions, "total": len(revisions)}, http.StatusOK)
+}
+
+// priceHistoryHandler returns the public series of a listing's prices,
+// oldest first. Each point holds from its time until the next one.
+func priceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid furniture id", http.StatusBadRequest)
+		return
+	}
+
+	var current PricePoint
+	var createdAt time.Time
+	err = db.QueryRow("SELECT price, offer_type, created_at FROM furniture WHERE id = $1 AND removed_at IS NULL", id).
+		Scan(&current.Price, &current.OfferType, &createdAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Furniture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT action, changes -> 'price', changes -> 'offer_type', created_at FROM furniture_revisions
+		WHERE furniture_id = $1 AND (changes ? 'price' OR changes ? 'offer_type')
+		ORDER BY id DESC`, id)
+	if err != nil {
+		respondWithError(w, "Error fetching price history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Walk back from the current price, undoing one change at a time, so
+	// listings older than the history still get a starting point
+	var points []PricePoint
+	state := current
+	createdInHistory := false
+	for rows.Next() {
+		var action string
+		var priceChange, offerTypeChange []byte
+		var at time.Time
+		if err := rows.Scan(&action, &priceChange, &offerTypeChange, &at); err != nil {
+			respondWithError(w, "Error scanning price history", http.StatusInternalServerError)
+			return
+		}
+		state.From = at
+		points = append(points, state)
+
+		if priceChange != nil {
+			state.Price = nil
+			revertChange(priceChange, &state.Price)
+		}
+		if offerTypeChange != nil {
+			revertChange(offerTypeChange, &state.OfferType)
+		}
+		createdInHistory = action == RevisionInsert
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating price history", http.StatusInternalServerError)
+		return
+	}
+	if !createdInHistory {
+		state.From = createdAt
+		points = append(points, state)
+	}
+
+	// Oldest first, without repeats of the same effective price
+	series := []PricePoint{}
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+		if n := len(series); n > 0 && sameListingPrice(series[n-1], p) {
+			continue
+		}
+		series = append(series, p)
+	}
+
+	respondWithJSON(w, map[string]interface{}{"furnitureId": id, "prices": series}, http.StatusOK)
+}
+
+// revertChange stores the value a recorded change replaced into dest.
+func revertChange(change []byte, dest interface{}) {
+	var c FieldChange
+	if err := json.Unmarshal(change, &c); err == nil && c.From != nil {
+		json.Unmarshal(c.From, dest)
+	}
+}
+
+func sameListingPrice(a, b PricePoint) bool {
+	return a.OfferType == b.OfferType &&
+		listingPrice(Furniture{OfferType: a.OfferType, Price: a.Price}) == listingPrice(Furniture{OfferType: b.OfferType, Price: b.Price})
+}
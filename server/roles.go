@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+func initRoles() error {
+	if _, err := db.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user'"); err != nil {
+		return fmt.Errorf("failed to add users role column: %w", err)
+	}
+
+	return nil
+}
+
+// promoteAdmins makes the accounts with the given emails administrators.
+// It only runs as the one-off command
+//
+//	auth-server promote-admin <email>...
+//
+// and never on startup: signup does not verify email ownership, so whoever
+// registered a listed address first would become an admin.
+func promoteAdmins(emails []string) error {
+	rows, err := db.Query("UPDATE users SET role = $1 WHERE email = ANY($2) RETURNING email", RoleAdmin, pq.Array(emails))
+	if err != nil {
+		return fmt.Errorf("failed to promote administrators: %w", err)
+	}
+	defer rows.Close()
+
+	promoted := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return fmt.Errorf("failed to promote administrators: %w", err)
+		}
+		promoted[email] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to promote administrators: %w", err)
+	}
+
+	for _, email := range emails {
+		if promoted[email] {
+			log.Printf("%s is an admin", email)
+		} else {
+			log.Printf("No account with email %s", email)
+		}
+	}
+	return nil
+}
+
+func userRole(ctx context.Context, userID int) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	return role, err
+}
+
+// requireRole wraps an authenticated handler and rejects users whose role is
+// not one of roles. It must run inside authMiddleware.
+func requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(userIDKey).(int)
+
+		role, err := userRole(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				next(w, r)
+				return
+			}
+		}
+
+		respondWithError(w, "Insufficient permissions", http.StatusForbidden)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type SearchSuggestion struct {
+	Type  string `json:"type"` // "title", "tag", "category" or "city"
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+type SearchSuggestResponse struct {
+	Suggestions []SearchSuggestion `json:"suggestions"`
+}
+
+const (
+	minSuggestPrefix    = 2
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 20
+)
+
+func initSearchTables() error {
+	// pg_trgm provides similarity() and the trigram indexes that keep
+	// substring and typo-tolerant matching fast on titles
+	createSearchIndexesSQL := `
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+	CREATE INDEX IF NOT EXISTS furniture_title_trgm_idx ON furniture USING GIN (title gin_trgm_ops);`
+
+	if _, err := db.Exec(createSearchIndexesSQL); err != nil {
+		return fmt.Errorf("failed to create search indexes: %w", err)
+	}
+
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchFilter restricts q to listings whose title, tags, category or
+// location match the free-text search.
+func searchFilter(q *furnitureQuery, search string) {
+	pattern := q.arg("%" + escapeLike(search) + "%")
+	conditions := []string{
+		"title ILIKE " + pattern,
+		"location ILIKE " + pattern,
+		"category_id IN (SELECT id FROM categories WHERE name_pl ILIKE " + pattern + " OR name_en ILIKE " + pattern + ")",
+	}
+	if slug := normalizeTag(search); slug != "" {
+		conditions = append(conditions, "tags && "+canonicalTagsSQL(q.arg(pq.Array([]string{slug}))))
+	}
+	q.where("(" + strings.Join(conditions, " OR ") + ")")
+}
+
+// liveListingSQL matches listings search can return, so suggestions never
+// point at expired or archived ones.
+const liveListingSQL = "expires_at > CURRENT_TIMESTAMP AND archived_at IS NULL"
+
+// searchSuggestions completes prefix against listing titles, tags,
+// categories and cities. Exact prefix matches rank first, followed by
+// typo-tolerant trigram matches.
+func searchSuggestions(ctx context.Context, prefix, locale string, limit int) ([]SearchSuggestion, error) {
+	// locale is one of supportedLocales, so it is safe to splice in
+	nameColumn := "name_" + locale
+
+	query := `
+		WITH candidates (type, value, label, term) AS (
+			SELECT DISTINCT 'title', title, title, title FROM furniture WHERE ` + liveListingSQL + `
+			UNION ALL SELECT 'tag', slug, ` + nameColumn + `, name_pl FROM tags
+			UNION ALL SELECT 'tag', slug, ` + nameColumn + `, name_en FROM tags
+			UNION ALL SELECT 'category', slug, ` + nameColumn + `, name_pl FROM categories
+			UNION ALL SELECT 'category', slug, ` + nameColumn + `, name_en FROM categories
+			UNION ALL SELECT DISTINCT 'city', city, city, city FROM furniture WHERE city IS NOT NULL AND ` + liveListingSQL + `
+		),
+		ranked AS (
+			SELECT DISTINCT ON (type, value) type, value, label,
+				term ILIKE $1 AS is_prefix,
+				word_similarity($3, term) AS score
+			FROM candidates
+			WHERE term ILIKE $1 OR term ILIKE $2 OR $3 <% term
+			ORDER BY type, value, is_prefix DESC, score DESC
+		)
+		SELECT type, value, label FROM ranked
+		ORDER BY is_prefix DESC, score DESC, label
+		LIMIT $4`
+
+	escaped := escapeLike(prefix)
+	rows, err := db.QueryContext(ctx, query, escaped+"%", "% "+escaped+"%", prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []SearchSuggestion{}
+	for rows.Next() {
+		var s SearchSuggestion
+		if err := rows.Scan(&s.Type, &s.Value, &s.Label); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+// didYouMean returns the known term most similar to a search that found
+// nothing, or "" when nothing is close enough.
+func didYouMean(ctx context.Context, search string) (string, error) {
+	query := `
+		WITH terms (term) AS (
+			SELECT DISTINCT word FROM furniture, regexp_split_to_table(title, '\s+') AS word
+				WHERE length(word) >= 3 AND ` + liveListingSQL + `
+			UNION SELECT name_pl FROM tags
+			UNION SELECT name_en FROM tags
+			UNION SELECT name_pl FROM categories
+			UNION SELECT name_en FROM categories
+			UNION SELECT city FROM furniture WHERE city IS NOT NULL AND ` + liveListingSQL + `
+		)
+		SELECT term FROM terms
+		WHERE term % $1 AND lower(term) <> lower($1)
+		ORDER BY similarity(term, $1) DESC, term
+		LIMIT 1`
+
+	var term string
+	err := db.QueryRowContext(ctx, query, search).Scan(&term)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return term, err
+}
+
+func searchSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(prefix)) < minSuggestPrefix {
+		respondWithJSON(w, SearchSuggestResponse{Suggestions: []SearchSuggestion{}}, http.StatusOK)
+		return
+	}
+
+	limit := defaultSuggestLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxSuggestLimit {
+		limit = maxSuggestLimit
+	}
+
+	suggestions, err := searchSuggestions(r.Context(), prefix, normalizeLocale(r.URL.Query().Get("locale")), limit)
+	if err != nil {
+		respondWithError(w, "Error fetching suggestions", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, SearchSuggestResponse{Suggestions: suggestions}, http.StatusOK)
+}
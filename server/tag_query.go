@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Tag query expressions let power users combine tags precisely, e.g.
+//
+//	(table AND modern) OR (chair AND NOT vintage)
+//
+// Operators are case-insensitive, "-tag" is shorthand for NOT tag, adjacent
+// terms without an operator are ANDed, and multi-word tags can be quoted:
+// "corner sofa".
+const (
+	maxTagQueryLength = 500
+	maxTagQueryTerms  = 30
+	maxTagQueryDepth  = 10
+)
+
+type tagQueryToken struct {
+	kind  string // "tag", "and", "or", "not", "(", ")"
+	value string
+}
+
+type tagQueryParser struct {
+	tokens []tagQueryToken
+	pos    int
+	terms  int
+	depth  int
+	q      *furnitureQuery
+}
+
+// compileTagQuery parses expr and returns an SQL condition over the tags
+// column, registering its arguments on q.
+func compileTagQuery(q *furnitureQuery, expr string) (string, error) {
+	if len(expr) > maxTagQueryLength {
+		return "", fmt.Errorf("Tag query must be at most %d characters", maxTagQueryLength)
+	}
+
+	tokens, err := tokenizeTagQuery(expr)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("Tag query is empty")
+	}
+
+	p := &tagQueryParser{tokens: tokens, q: q}
+	sql, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.tokens) {
+		return "", fmt.Errorf("Unexpected %q in tag query", p.tokens[p.pos].value)
+	}
+	return sql, nil
+}
+
+func tokenizeTagQuery(expr string) ([]tagQueryToken, error) {
+	var tokens []tagQueryToken
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, tagQueryToken{kind: string(r), value: string(r)})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("Unterminated quote in tag query")
+			}
+			tokens = append(tokens, tagQueryToken{kind: "tag", value: string(runes[i+1 : end])})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '(' && runes[end] != ')' && runes[end] != '"' {
+				end++
+			}
+			word := string(runes[i:end])
+			if len(word) > 1 && word[0] == '-' {
+				// "-vintage" is shorthand for "NOT vintage"
+				tokens = append(tokens, tagQueryToken{kind: "not", value: "-"})
+				word = word[1:]
+			}
+			switch strings.ToUpper(word) {
+			case "AND":
+				tokens = append(tokens, tagQueryToken{kind: "and", value: word})
+			case "OR":
+				tokens = append(tokens, tagQueryToken{kind: "or", value: word})
+			case "NOT":
+				tokens = append(tokens, tagQueryToken{kind: "not", value: word})
+			default:
+				tokens = append(tokens, tagQueryToken{kind: "tag", value: word})
+			}
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *tagQueryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+// parseOr handles: and-expr (OR and-expr)*
+func (p *tagQueryParser) parseOr() (string, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return "", err
+	}
+	parts := []string{left}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, right)
+	}
+	if len(parts) == 1 {
+		return left, nil
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", nil
+}
+
+// parseAnd handles: unary ([AND] unary)*
+func (p *tagQueryParser) parseAnd() (string, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return "", err
+	}
+	parts := []string{left}
+	for {
+		switch p.peek() {
+		case "and":
+			p.pos++
+		case "tag", "not", "(":
+		default:
+			if len(parts) == 1 {
+				return left, nil
+			}
+			return "(" + strings.Join(parts, " AND ") + ")", nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, right)
+	}
+}
+
+// parseUnary handles: NOT unary | ( or-expr ) | tag
+func (p *tagQueryParser) parseUnary() (string, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + operand, nil
+	case "(":
+		p.depth++
+		if p.depth > maxTagQueryDepth {
+			return "", fmt.Errorf("Tag query is nested too deeply")
+		}
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		if p.peek() != ")" {
+			return "", fmt.Errorf("Missing closing parenthesis in tag query")
+		}
+		p.pos++
+		p.depth--
+		return inner, nil
+	case "tag":
+		token := p.tokens[p.pos]
+		p.pos++
+		p.terms++
+		if p.terms > maxTagQueryTerms {
+			return "", fmt.Errorf("Tag query may reference at most %d tags", maxTagQueryTerms)
+		}
+		slug := normalizeTag(token.value)
+		if slug == "" {
+			return "", fmt.Errorf("Invalid tag %q in tag query", token.value)
+		}
+		return "(tags && " + canonicalTagsSQL(p.q.arg(pq.Array([]string{slug}))) + ")", nil
+	case "":
+		return "", fmt.Errorf("Tag query ends unexpectedly")
+	default:
+		return "", fmt.Errorf("Unexpected %q in tag query", p.tokens[p.pos].value)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// readableTagSQL replaces each compiled tag term with #n, its argument
+// number, so expectations can be written as plain boolean expressions.
+func readableTagSQL(sql string, args int) string {
+	for n := args; n >= 1; n-- {
+		term := "(tags && " + canonicalTagsSQL(fmt.Sprintf("$%d", n)) + ")"
+		sql = strings.ReplaceAll(sql, term, fmt.Sprintf("#%d", n))
+	}
+	return sql
+}
+
+func TestCompileTagQuery(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+		tags []string
+	}{
+		{"sofa", "#1", []string{"sofa"}},
+		{"table modern", "(#1 AND #2)", []string{"table", "modern"}},
+		{"table and Modern", "(#1 AND #2)", []string{"table", "modern"}},
+		{"table OR chair", "(#1 OR #2)", []string{"table", "chair"}},
+		{"-vintage", "NOT #1", []string{"vintage"}},
+		{"not vintage", "NOT #1", []string{"vintage"}},
+		{`"Corner Sofa" krzesło`, "(#1 AND #2)", []string{"corner-sofa", "krzeslo"}},
+		{"a OR b c", "(#1 OR (#2 AND #3))", []string{"a", "b", "c"}},
+		{
+			"(table AND modern) OR (chair AND NOT vintage)",
+			"((#1 AND #2) OR (#3 AND NOT #4))",
+			[]string{"table", "modern", "chair", "vintage"},
+		},
+		{"NOT (a OR b)", "NOT (#1 OR #2)", []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q := &furnitureQuery{}
+			sql, err := compileTagQuery(q, tt.expr)
+			if err != nil {
+				t.Fatalf("compileTagQuery(%q) error: %v", tt.expr, err)
+			}
+			if got := readableTagSQL(sql, len(q.args)); got != tt.want {
+				t.Errorf("compileTagQuery(%q) = %s, want %s", tt.expr, got, tt.want)
+			}
+
+			var tags []string
+			for _, arg := range q.args {
+				tags = append(tags, []string(*arg.(*pq.StringArray))...)
+			}
+			if !reflect.DeepEqual(tags, tt.tags) {
+				t.Errorf("compileTagQuery(%q) tags = %v, want %v", tt.expr, tags, tt.tags)
+			}
+		})
+	}
+}
+
+func TestCompileTagQueryErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "Tag query is empty"},
+		{"   ", "Tag query is empty"},
+		{`"sofa`, "Unterminated quote in tag query"},
+		{"(sofa", "Missing closing parenthesis in tag query"},
+		{"sofa)", `Unexpected ")" in tag query`},
+		{"sofa OR", "Tag query ends unexpectedly"},
+		{"AND sofa", `Unexpected "AND" in tag query`},
+		{`"!!"`, `Invalid tag "!!" in tag query`},
+		{strings.Repeat("(", maxTagQueryDepth+1) + "a" + strings.Repeat(")", maxTagQueryDepth+1), "Tag query is nested too deeply"},
+		{strings.Repeat("a ", maxTagQueryTerms+1), fmt.Sprintf("Tag query may reference at most %d tags", maxTagQueryTerms)},
+		{strings.Repeat("a", maxTagQueryLength+1), fmt.Sprintf("Tag query must be at most %d characters", maxTagQueryLength)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := compileTagQuery(&furnitureQuery{}, tt.expr)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("compileTagQuery(%q) error = %v, want %q", tt.expr, err, tt.want)
+			}
+		})
+	}
+}
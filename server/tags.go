@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+type Tag struct {
+	Slug     string   `json:"slug"`
+	NamePL   string   `json:"namePl"`
+	NameEN   string   `json:"nameEn"`
+	Synonyms []string `json:"synonyms"`
+	Count    int      `json:"count"`
+}
+
+type TagRequest struct {
+	Slug     *string  `json:"slug,omitempty"`
+	NamePL   *string  `json:"namePl,omitempty"`
+	NameEN   *string  `json:"nameEn,omitempty"`
+	Synonyms []string `json:"synonyms,omitempty"`
+}
+
+// TagSuggestion is a tag users asked for that is not in the vocabulary.
+type TagSuggestion struct {
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Uses      int       `json:"uses"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type MergeTagRequest struct {
+	Into string `json:"into"`
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// seedTags is the initial vocabulary, covering every tag used by the sample
+// listings plus common Polish and English synonyms.
+var seedTags = []struct {
+	slug, namePL, nameEN string
+	synonyms             []string
+}{
+	{"sofa", "Sofa", "Sofa", []string{"couch", "settee", "kanapa"}},
+	{"chair", "Krzesło", "Chair", []string{"krzeslo", "stool", "taboret"}},
+	{"table", "Stół", "Table", []string{"stol", "stolik"}},
+	{"desk", "Biurko", "Desk", []string{"biurko"}},
+	{"bed", "Łóżko", "Bed", []string{"lozko"}},
+	{"wardrobe", "Szafa", "Wardrobe", []string{"szafa", "closet"}},
+	{"cabinet", "Szafka", "Cabinet", []string{"szafka", "komoda", "dresser"}},
+	{"lighting", "Oświetlenie", "Lighting", []string{"lamp", "lampa", "oswietlenie"}},
+	{"modern", "Nowoczesny", "Modern", []string{"nowoczesny", "contemporary"}},
+	{"vintage", "Vintage", "Vintage", []string{"retro", "antique", "antyk"}},
+	{"classic", "Klasyczny", "Classic", []string{"klasyczny", "traditional"}},
+	{"office", "Biuro", "Office", []string{"biuro", "biurowy"}},
+	{"kitchen", "Kuchnia", "Kitchen", []string{"kuchnia", "kuchenny"}},
+	{"dining", "Jadalnia", "Dining", []string{"jadalnia"}},
+	{"accent", "Dekoracyjny", "Accent", []string{"dekoracyjny"}},
+	{"storage", "Przechowywanie", "Storage", []string{"przechowywanie"}},
+	{"bedroom", "Sypialnia", "Bedroom", []string{"sypialnia"}},
+}
+
+var polishLetters = strings.NewReplacer(
+	"ą", "a", "ć", "c", "ę", "e", "ł", "l", "ń", "n", "ó", "o", "ś", "s", "ź", "z", "ż", "z",
+)
+
+// normalizeTag turns free-form input into a slug: lowercase ASCII words
+// joined by hyphens, with Polish diacritics folded.
+func normalizeTag(tag string) string {
+	tag = polishLetters.Replace(strings.ToLower(strings.TrimSpace(tag)))
+
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range tag {
+		switch {
+		case r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+		default:
+			pendingHyphen = true
+		}
+	}
+	return b.String()
+}
+
+func normalizeTags(tags []string) []string {
+	slugs := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		slug := normalizeTag(tag)
+		if slug != "" && !seen[slug] {
+			seen[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+	return slugs
+}
+
+// canonicalTagsSQL returns an expression mapping the normalized text array
+// bound at placeholder onto canonical tag slugs via the synonym table.
+func canonicalTagsSQL(placeholder string) string {
+	return fmt.Sprintf(`ARRAY(
+		SELECT COALESCE(t.slug, v)
+		FROM unnest(%s::text[]) AS v
+		LEFT JOIN tag_synonyms s ON s.synonym = v
+		LEFT JOIN tags t ON t.id = s.tag_id)`, placeholder)
+}
+
+func initTagTables() error {
+	createTagTablesSQL := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id SERIAL PRIMARY KEY,
+		slug VARCHAR(100) UNIQUE NOT NULL,
+		name_pl VARCHAR(100) NOT NULL,
+		name_en VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS tag_synonyms (
+		synonym VARCHAR(100) PRIMARY KEY,
+		tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS furniture_tags_idx ON furniture USING GIN (tags);
+	CREATE TABLE IF NOT EXISTS tag_suggestions (
+		slug VARCHAR(100) PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		uses INTEGER NOT NULL DEFAULT 1,
+		first_seen TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_seen TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(createTagTablesSQL); err != nil {
+		return fmt.Errorf("failed to create tag tables: %w", err)
+	}
+
+	for _, t := range seedTags {
+		_, err := db.Exec("INSERT INTO tags (slug, name_pl, name_en) VALUES ($1, $2, $3) ON CONFLICT (slug) DO NOTHING",
+			t.slug, t.namePL, t.nameEN)
+		if err != nil {
+			return fmt.Errorf("failed to seed tag %s: %w", t.slug, err)
+		}
+		for _, synonym := range t.synonyms {
+			_, err := db.Exec(`
+				INSERT INTO tag_synonyms (synonym, tag_id) SELECT $1, id FROM tags WHERE slug = $2
+				ON CONFLICT (synonym) DO NOTHING`, normalizeTag(synonym), t.slug)
+			if err != nil {
+				return fmt.Errorf("failed to seed tag synonym %s: %w", synonym, err)
+			}
+		}
+	}
+
+	return migrateLegacyTags()
+}
+
+// migrateLegacyTags rewrites listings still carrying display-name tags such
+// as "Modern" into canonical slugs. Unknown tags stay on the listing as
+// slugs and are queued for review rather than dropped.
+func migrateLegacyTags() error {
+	rows, err := db.Query("SELECT id, tags FROM furniture")
+	if err != nil {
+		return fmt.Errorf("failed to load furniture tags: %w", err)
+	}
+
+	type legacyRow struct {
+		id   int
+		tags []string
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var row legacyRow
+		if err := rows.Scan(&row.id, pq.Array(&row.tags)); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan furniture tags: %w", err)
+		}
+		for _, tag := range row.tags {
+			if normalizeTag(tag) != tag {
+				legacy = append(legacy, row)
+				break
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate furniture tags: %w", err)
+	}
+
+	ctx := context.Background()
+	for _, row := range legacy {
+		slugs, unknown, err := lookupTags(ctx, db, row.tags)
+		if err == nil {
+			err = suggestTags(ctx, db, unknown)
+		}
+		if err != nil {
+			return err
+		}
+		for _, u := range unknown {
+			slugs = append(slugs, normalizeTag(u))
+		}
+		if _, err := db.Exec("UPDATE furniture SET tags = $2 WHERE id = $1", row.id, pq.Array(slugs)); err != nil {
+			return fmt.Errorf("failed to migrate furniture tags: %w", err)
+		}
+	}
+
+	if len(legacy) > 0 {
+		log.Printf("Migrated tags of %d furniture item(s) to canonical slugs", len(legacy))
+	}
+	return nil
+}
+
+// resolveTags maps user-supplied tags onto canonical slugs, following
+// synonyms. The vocabulary is managed by admins, so tags outside it are
+// kept on the listing as plain slugs and queued in tag_suggestions; once
+// approved as a tag or synonym they are rewritten in place.
+func resolveTags(ctx context.Context, q querier, tags []string) ([]string, error) {
+	slugs, unknown, err := lookupTags(ctx, q, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := suggestTags(ctx, q, unknown); err != nil {
+		return nil, err
+	}
+	for _, u := range unknown {
+		slugs = append(slugs, normalizeTag(u))
+	}
+	return slugs, nil
+}
+
+// lookupTags resolves tags against the vocabulary, returning the canonical
+// slugs of known tags and the unknown tags as given.
+func lookupTags(ctx context.Context, q querier, tags []string) (slugs, unknown []string, err error) {
+	seen := make(map[string]bool)
+	seenSlugs := make(map[string]bool)
+
+	for _, tag := range tags {
+		normalized := normalizeTag(tag)
+		if normalized == "" || seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+
+		var slug string
+		err := q.QueryRowContext(ctx, `
+			SELECT t.slug FROM tags t WHERE t.slug = $1
+			UNION ALL
+			SELECT t.slug FROM tag_synonyms s JOIN tags t ON t.id = s.tag_id WHERE s.synonym = $1
+			LIMIT 1`, normalized).Scan(&slug)
+		if err == sql.ErrNoRows {
+			unknown = append(unknown, strings.TrimSpace(tag))
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve tag %q: %w", normalized, err)
+		}
+
+		if !seenSlugs[slug] {
+			seenSlugs[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+
+	return slugs, unknown, nil
+}
+
+// suggestTags queues unknown tags for admins, counting how often each one
+// is asked for.
+func suggestTags(ctx context.Context, ex execer, tags []string) error {
+	for _, tag := range tags {
+		slug := normalizeTag(tag)
+		if len(slug) > 100 {
+			continue
+		}
+		name := tag
+		if len(name) > 100 {
+			name = slug
+		}
+		_, err := ex.ExecContext(ctx, `
+			INSERT INTO tag_suggestions (slug, name) VALUES ($1, $2)
+			ON CONFLICT (slug) DO UPDATE SET uses = tag_suggestions.uses + 1, last_seen = CURRENT_TIMESTAMP`,
+			slug, name)
+		if err != nil {
+			return fmt.Errorf("failed to queue tag suggestion %q: %w", slug, err)
+		}
+	}
+	return nil
+}
+
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT t.slug, t.name_pl, t.name_en,
+			COALESCE((SELECT array_agg(s.synonym ORDER BY s.synonym) FROM tag_synonyms s WHERE s.tag_id = t.id), '{}'),
+			(SELECT COUNT(*) FROM furniture f
+				WHERE t.slug = ANY(f.tags) AND f.removed_at IS NULL AND f.expires_at > CURRENT_TIMESTAMP)
+		FROM tags t
+		ORDER BY t.name_en`)
+	if err != nil {
+		respondWithError(w, "Error fetching tags", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Slug, &t.NamePL, &t.NameEN, pq.Array(&t.Synonyms), &t.Count); err != nil {
+			respondWithError(w, "Error scanning tag data", http.StatusInternalServerError)
+			return
+		}
+		tags = append(tags, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating tag data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"tags": tags}, http.StatusOK)
+}
+
+func adminCreateTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.NamePL == nil || req.NameEN == nil || *req.NamePL == "" || *req.NameEN == "" {
+		respondWithError(w, "Polish and English names are required", http.StatusBadRequest)
+		return
+	}
+
+	slug := normalizeTag(*req.NameEN)
+	if req.Slug != nil {
+		slug = normalizeTag(*req.Slug)
+	}
+	if slug == "" {
+		respondWithError(w, "Invalid tag slug", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, "Error creating tag", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tagID int
+	err = tx.QueryRow("INSERT INTO tags (slug, name_pl, name_en) VALUES ($1, $2, $3) ON CONFLICT (slug) DO NOTHING RETURNING id",
+		slug, *req.NamePL, *req.NameEN).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Tag already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		respondWithError(w, "Error creating tag", http.StatusInternalServerError)
+		return
+	}
+
+	if msg, err := replaceTagSynonyms(r.Context(), tx, tagID, slug, req.Synonyms); msg != "" || err != nil {
+		respondWithTagError(w, msg, err)
+		return
+	}
+
+	// Suggestions the new tag covers are settled
+	_, err = tx.Exec(`
+		DELETE FROM tag_suggestions
+		WHERE slug = $1 OR slug IN (SELECT synonym FROM tag_synonyms WHERE tag_id = $2)`, slug, tagID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, "Error creating tag", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "Tag created"}, http.StatusCreated)
+}
+
+// adminTagSuggestionsHandler lists tags users asked for that are not in the
+// vocabulary, most requested first. Admins add them with
+// adminCreateTagHandler, as a tag or a synonym, or dismiss them.
+func adminTagSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, limit := parsePagination(r)
+	rows, err := db.Query(`
+		SELECT slug, name, uses, first_seen, last_seen FROM tag_suggestions
+		ORDER BY uses DESC, last_seen DESC
+		LIMIT $1 OFFSET $2`, limit, (page-1)*limit)
+	if err != nil {
+		respondWithError(w, "Error fetching tag suggestions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []TagSuggestion{}
+	for rows.Next() {
+		var t TagSuggestion
+		if err := rows.Scan(&t.Slug, &t.Name, &t.Uses, &t.FirstSeen, &t.LastSeen); err != nil {
+			respondWithError(w, "Error scanning tag suggestion data", http.StatusInternalServerError)
+			return
+		}
+		suggestions = append(suggestions, t)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating tag suggestion data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"suggestions": suggestions, "page": page, "limit": limit}, http.StatusOK)
+}
+
+// adminTagSuggestionHandler dismisses a tag suggestion.
+func adminTagSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM tag_suggestions WHERE slug = $1", r.PathValue("slug"))
+	if err != nil {
+		respondWithError(w, "Error dismissing tag suggestion", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondWithError(w, "Tag suggestion not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "Tag suggestion dismissed"}, http.StatusOK)
+}
+
+// adminTagHandler renames a tag. Changing the slug rewrites every listing
+// and keeps the old slug as a synonym so existing links still resolve.
+func adminTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	slug := r.PathValue("slug")
+	var tagID int
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE slug = $1 FOR UPDATE", slug).Scan(&tagID); err != nil {
+		respondWithError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	if req.NamePL != nil && *req.NamePL != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET name_pl = $2 WHERE id = $1", tagID, *req.NamePL); err != nil {
+			respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.NameEN != nil && *req.NameEN != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET name_en = $2 WHERE id = $1", tagID, *req.NameEN); err != nil {
+			respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.Slug != nil && normalizeTag(*req.Slug) != slug {
+		newSlug := normalizeTag(*req.Slug)
+		if newSlug == "" {
+			respondWithError(w, "Invalid tag slug", http.StatusBadRequest)
+			return
+		}
+
+		var taken bool
+		err := tx.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM tags WHERE slug = $1) OR EXISTS (SELECT 1 FROM tag_synonyms WHERE synonym = $1 AND tag_id <> $2)",
+			newSlug, tagID).Scan(&taken)
+		if err != nil {
+			respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			respondWithError(w, "Slug is already in use; merge the tags instead", http.StatusConflict)
+			return
+		}
+
+		if err := renameTagSlug(ctx, tx, tagID, slug, newSlug); err != nil {
+			log.Printf("Error renaming tag: %v", err)
+			respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+			return
+		}
+		slug = newSlug
+	}
+
+	if req.Synonyms != nil {
+		if msg, err := replaceTagSynonyms(ctx, tx, tagID, slug, req.Synonyms); msg != "" || err != nil {
+			respondWithTagError(w, msg, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, "Error updating tag", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: "Tag updated"}, http.StatusOK)
+}
+
+// adminMergeTagHandler folds one tag into another: listings are retagged,
+// and the source slug and synonyms become synonyms of the target.
+func adminMergeTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MergeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	source := r.PathValue("slug")
+	target := normalizeTag(req.Into)
+	if target == "" || target == source {
+		respondWithError(w, "A different target tag is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(w, "Error merging tags", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sourceID, targetID int
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE slug = $1 FOR UPDATE", source).Scan(&sourceID); err != nil {
+		respondWithError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE slug = $1 FOR UPDATE", target).Scan(&targetID); err != nil {
+		respondWithError(w, "Target tag not found", http.StatusNotFound)
+		return
+	}
+
+	if err := replaceTagSlug(ctx, tx, source, target); err != nil {
+		log.Printf("Error merging tags: %v", err)
+		respondWithError(w, "Error merging tags", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE tag_synonyms SET tag_id = $2 WHERE tag_id = $1", sourceID, targetID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO tag_synonyms (synonym, tag_id) VALUES ($1, $2)
+			ON CONFLICT (synonym) DO UPDATE SET tag_id = EXCLUDED.tag_id`, source, targetID)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = $1", sourceID)
+	}
+	if err != nil {
+		log.Printf("Error merging tags: %v", err)
+		respondWithError(w, "Error merging tags", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, "Error merging tags", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, Response{Message: fmt.Sprintf("Tag %s merged into %s", source, target)}, http.StatusOK)
+}
+
+func renameTagSlug(ctx context.Context, tx *sql.Tx, tagID int, oldSlug, newSlug string) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET slug = $2 WHERE id = $1", tagID, newSlug); err != nil {
+		return err
+	}
+	if err := replaceTagSlug(ctx, tx, oldSlug, newSlug); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_synonyms WHERE synonym = $1", newSlug); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO tag_synonyms (synonym, tag_id) VALUES ($1, $2)
+		ON CONFLICT (synonym) DO UPDATE SET tag_id = EXCLUDED.tag_id`, oldSlug, tagID)
+	return err
+}
+
+// replaceTagSlug swaps one slug for another on every listing and wanted
+// post, dropping the duplicate when one already carried both.
+func replaceTagSlug(ctx context.Context, tx *sql.Tx, from, to string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE furniture SET tags = ARRAY(
+			SELECT tag FROM unnest(array_replace(tags, $1, $2)) WITH ORDINALITY AS u(tag, n)
+			GROUP BY tag ORDER BY MIN(n)
+		), updated_at = CURRENT_TIMESTAMP
+		WHERE $1 = ANY(tags)`, from, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE wanted_posts SET tags = ARRAY(
+			SELECT tag FROM unnest(array_replace(tags, $1, $2)) WITH ORDINALITY AS u(tag, n)
+			GROUP BY tag ORDER BY MIN(n)
+		), updated_at = CURRENT_TIMESTAMP
+		WHERE $1 = ANY(tags)`, from, to)
+	return err
+}
+
+// replaceTagSynonyms sets the synonym list of a tag. It returns a client
+// message when a synonym collides with another tag.
+func replaceTagSynonyms(ctx context.Context, tx *sql.Tx, tagID int, slug string, synonyms []string) (string, error) {
+	normalized := normalizeTags(synonyms)
+
+	for _, synonym := range normalized {
+		if synonym == slug {
+			continue
+		}
+		var conflict bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM tags WHERE slug = $1)
+				OR EXISTS (SELECT 1 FROM tag_synonyms WHERE synonym = $1 AND tag_id <> $2)`,
+			synonym, tagID).Scan(&conflict)
+		if err != nil {
+			return "", err
+		}
+		if conflict {
+			return fmt.Sprintf("Synonym %q already belongs to another tag", synonym), nil
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_synonyms WHERE tag_id = $1", tagID); err != nil {
+		return "", err
+	}
+	for _, synonym := range normalized {
+		if synonym == slug {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tag_synonyms (synonym, tag_id) VALUES ($1, $2)", synonym, tagID); err != nil {
+			return "", err
+		}
+		// Listings may carry the synonym from when it was still a suggestion
+		if err := replaceTagSlug(ctx, tx, synonym, slug); err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+func respondWithTagError(w http.ResponseWriter, msg string, err error) {
+	if msg != "" {
+		respondWithError(w, msg, http.StatusConflict)
+		return
+	}
+	log.Printf("Error saving tag synonyms: %v", err)
+	respondWithError(w, "Error saving tag synonyms", http.StatusInternalServerError)
+}
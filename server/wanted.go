@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Wanted post statuses. Open posts are listed in the feed and matched
+// against new listings; closed ones are kept for their owner only.
+const (
+	WantedOpen   = "open"
+	WantedClosed = "closed"
+)
+
+const (
+	maxWantedRadiusKm  = 300
+	wantedPollInterval = 30 * time.Second
+)
+
+type WantedPost struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"userId"`
+	Author      string    `json:"author"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags"`
+	Category    string    `json:"category,omitempty"`
+	MaxPrice    *float64  `json:"maxPrice,omitempty"`
+	City        string    `json:"city,omitempty"`
+	Voivodeship string    `json:"voivodeship,omitempty"`
+	RadiusKm    *float64  `json:"radiusKm,omitempty"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type WantedRequest struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Category    string   `json:"category"`
+	MaxPrice    *float64 `json:"maxPrice"`
+	City        string   `json:"city"`
+	Voivodeship string   `json:"voivodeship"`
+	RadiusKm    *float64 `json:"radiusKm"`
+}
+
+type UpdateWantedRequest struct {
+	Status string `json:"status"`
+}
+
+type WantedListResponse struct {
+	Posts []WantedPost `json:"posts"`
+	Total int          `json:"total"`
+	Page  int          `json:"page"`
+	Limit int          `json:"limit"`
+}
+
+// WantedAnswer is a seller's reply to a wanted post, optionally pointing
+// at one of their listings.
+type WantedAnswer struct {
+	ID          int       `json:"id"`
+	WantedID    int       `json:"wantedId"`
+	SellerID    int       `json:"sellerId"`
+	SellerName  string    `json:"sellerName"`
+	FurnitureID *int      `json:"furnitureId,omitempty"`
+	Message     string    `json:"message"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type WantedAnswerRequest struct {
+	FurnitureID *int   `json:"furnitureId"`
+	Message     string `json:"message"`
+}
+
+type WantedMatch struct {
+	Furniture Furniture `json:"furniture"`
+	MatchedAt time.Time `json:"matchedAt"`
+}
+
+func initWantedTables() error {
+	createWantedTablesSQL := `
+	CREATE TABLE IF NOT EXISTS wanted_posts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		tags TEXT[] NOT NULL DEFAULT '{}',
+		category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+		max_price DECIMAL(10, 2),
+		city VARCHAR(100),
+		voivodeship VARCHAR(50),
+		latitude DECIMAL(10, 8),
+		longitude DECIMAL(11, 8),
+		radius_km DECIMAL(6, 1),
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS wanted_posts_open_idx ON wanted_posts (created_at DESC) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS wanted_posts_tags_idx ON wanted_posts USING GIN (tags);
+	CREATE TABLE IF NOT EXISTS wanted_matches (
+		wanted_id INTEGER NOT NULL REFERENCES wanted_posts(id) ON DELETE CASCADE,
+		furniture_id INTEGER NOT NULL REFERENCES furniture(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		notified_at TIMESTAMP,
+		PRIMARY KEY (wanted_id, furniture_id)
+	);
+	CREATE INDEX IF NOT EXISTS wanted_matches_pending_idx ON wanted_matches (created_at) WHERE notified_at IS NULL;
+	CREATE TABLE IF NOT EXISTS wanted_answers (
+		id SERIAL PRIMARY KEY,
+		wanted_id INTEGER NOT NULL REFERENCES wanted_posts(id) ON DELETE CASCADE,
+		seller_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		furniture_id INTEGER REFERENCES furniture(id) ON DELETE SET NULL,
+		message TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS wanted_answers_wanted_idx ON wanted_answers (wanted_id, created_at DESC);`
+
+	if _, err := db.Exec(createWantedTablesSQL); err != nil {
+		return fmt.Errorf("failed to create wanted tables: %w", err)
+	}
+
+	return nil
+}
+
+const wantedSelectSQL = `
+	SELECT w.id, w.user_id, u.name, w.title, w.description, w.tags, COALESCE(c.slug, ''), w.max_price,
+		COALESCE(w.city, ''), COALESCE(w.voivodeship, ''), w.radius_km, w.status, w.created_at, w.updated_at
+	FROM wanted_posts w
+	JOIN users u ON u.id = w.user_id
+	LEFT JOIN categories c ON c.id = w.category_id`
+
+func scanWantedPost(row interface{ Scan(...interface{}) error }) (WantedPost, error) {
+	var post WantedPost
+	err := row.Scan(&post.ID, &post.UserID, &post.Author, &post.Title, &post.Description, pq.Array(&post.Tags), &post.Category,
+		&post.MaxPrice, &post.City, &post.Voivodeship, &post.RadiusKm, &post.Status, &post.CreatedAt, &post.UpdatedAt)
+	return post, err
+}
+
+func queryWantedPosts(query string, args ...interface{}) ([]WantedPost, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []WantedPost{}
+	for rows.Next() {
+		post, err := scanWantedPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// wantedFeedHandler lists open wanted posts, newest first. It accepts the
+// q, tags, category, voivodeship and city filters of the furniture listing.
+func wantedFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, limit := parsePagination(r)
+	q := &furnitureQuery{}
+	q.where("status = " + q.arg(WantedOpen))
+	if search := strings.TrimSpace(r.URL.Query().Get("q")); search != "" {
+		pattern := q.arg("%" + escapeLike(search) + "%")
+		q.where("(title ILIKE " + pattern + " OR description ILIKE " + pattern + ")")
+	}
+	if slugs := normalizeTags(r.URL.Query()["tags"]); len(slugs) > 0 {
+		q.where("tags && " + canonicalTagsSQL(q.arg(pq.Array(slugs))))
+	}
+	if category := r.URL.Query().Get("category"); category != "" {
+		categoryFilter(q, category)
+	}
+	if err := locationFilter(q, r, ""); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM wanted_posts"+q.whereClause(), q.args...).Scan(&total); err != nil {
+		respondWithError(w, "Error counting wanted posts", http.StatusInternalServerError)
+		return
+	}
+
+	// The filters use bare column names, so they run on wanted_posts alone
+	query := wantedSelectSQL + " WHERE w.id IN (SELECT id FROM wanted_posts" + q.whereClause() + ")" +
+		" ORDER BY w.created_at DESC, w.id DESC LIMIT " + q.arg(limit) + " OFFSET " + q.arg((page-1)*limit)
+	posts, err := queryWantedPosts(query, q.args...)
+	if err != nil {
+		respondWithError(w, "Error fetching wanted posts", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, WantedListResponse{Posts: posts, Total: total, Page: page, Limit: limit}, http.StatusOK)
+}
+
+// myWantedHandler lists the current user's wanted posts (GET) and creates
+// a new one (POST).
+func myWantedHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		posts, err := queryWantedPosts(wantedSelectSQL+" WHERE w.user_id = $1 ORDER BY w.created_at DESC", userID)
+		if err != nil {
+			respondWithError(w, "Error fetching wanted posts", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, WantedListResponse{Posts: posts, Total: len(posts), Page: 1, Limit: len(posts)}, http.StatusOK)
+
+	case "POST":
+		var req WantedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		post, err := createWantedPost(r.Context(), userID, req)
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			respondWithError(w, fieldErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError(w, "Error creating wanted post", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, post, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createWantedPost validates and stores a wanted post. Validation problems
+// are returned as *FieldError.
+func createWantedPost(ctx context.Context, userID int, req WantedRequest) (WantedPost, error) {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Description = strings.TrimSpace(req.Description)
+	req.City = strings.TrimSpace(req.City)
+	req.Voivodeship = strings.TrimSpace(req.Voivodeship)
+
+	switch {
+	case req.Title == "":
+		return WantedPost{}, &FieldError{"title", "is required"}
+	case len(req.Title) > 255:
+		return WantedPost{}, &FieldError{"title", "must be at most 255 characters"}
+	case len(req.Description) > 2000:
+		return WantedPost{}, &FieldError{"description", "must be at most 2000 characters"}
+	case len(normalizeTags(req.Tags)) == 0 && req.Category == "":
+		// Without either, every new listing would match
+		return WantedPost{}, &FieldError{"tags", "at least one tag or a category is required"}
+	case req.MaxPrice != nil && *req.MaxPrice < 0:
+		return WantedPost{}, &FieldError{"maxPrice", "must not be negative"}
+	}
+
+	var categoryID *int
+	if req.Category != "" {
+		var id int
+		err := db.QueryRowContext(ctx, "SELECT id FROM categories WHERE slug = $1", req.Category).Scan(&id)
+		if err == sql.ErrNoRows {
+			return WantedPost{}, &FieldError{"category", "unknown category: " + req.Category}
+		}
+		if err != nil {
+			return WantedPost{}, err
+		}
+		categoryID = &id
+	}
+
+	// A radius is measured from the city centre; without one the post
+	// matches listings in the same city, or else the same voivodeship
+	var lat, lng *float64
+	switch {
+	case req.City != "":
+		place, _, err := resolveLocation(req.City, req.Voivodeship, "")
+		// Wanted posts have no postal code, so a locality the gazetteer does
+		// not list is taken as given within its voivodeship
+		if err != nil && len(canonicalCities(req.City)) == 0 && canonicalVoivodeship(req.Voivodeship) != "" {
+			place = GazetteerCity{City: strings.Join(strings.Fields(req.City), " "), Voivodeship: canonicalVoivodeship(req.Voivodeship)}
+			err = nil
+		}
+		if err != nil {
+			var locationErr *FieldError
+			if errors.As(err, &locationErr) {
+				return WantedPost{}, locationErr
+			}
+			return WantedPost{}, err
+		}
+		req.City, req.Voivodeship = place.City, place.Voivodeship
+		if place.located {
+			lat, lng = &place.Latitude, &place.Longitude
+		}
+	case req.Voivodeship != "":
+		if req.Voivodeship = canonicalVoivodeship(req.Voivodeship); req.Voivodeship == "" {
+			return WantedPost{}, &FieldError{"voivodeship", "is not a Polish voivodeship"}
+		}
+	}
+	if req.RadiusKm != nil {
+		if lat == nil {
+			return WantedPost{}, &FieldError{"radiusKm", "requires a city from the gazetteer"}
+		}
+		if *req.RadiusKm <= 0 || *req.RadiusKm > maxWantedRadiusKm {
+			return WantedPost{}, &FieldError{"radiusKm", fmt.Sprintf("must be between 0 and %d", maxWantedRadiusKm)}
+		}
+	}
+
+	tags, err := resolveTags(ctx, db, req.Tags)
+	if err != nil {
+		return WantedPost{}, err
+	}
+
+	var id int
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO wanted_posts (user_id, title, description, tags, category_id, max_price, city, voivodeship, latitude, longitude, radius_km)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11)
+		RETURNING id`,
+		userID, req.Title, req.Description, pq.Array(tags), categoryID, req.MaxPrice, req.City, req.Voivodeship,
+		lat, lng, req.RadiusKm).Scan(&id)
+	if err != nil {
+		return WantedPost{}, err
+	}
+
+	return scanWantedPost(db.QueryRowContext(ctx, wantedSelectSQL+" WHERE w.id = $1", id))
+}
+
+// loadWantedPost reads the wanted post named in the path.
+func loadWantedPost(w http.ResponseWriter, r *http.Request) (WantedPost, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid wanted post id", http.StatusBadRequest)
+		return WantedPost{}, false
+	}
+
+	post, err := scanWantedPost(db.QueryRow(wantedSelectSQL+" WHERE w.id = $1", id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Wanted post not found", http.StatusNotFound)
+		return post, false
+	}
+	if err != nil {
+		respondWithError(w, "Error fetching wanted post", http.StatusInternalServerError)
+		return post, false
+	}
+	return post, true
+}
+
+// wantedPostHandler shows a wanted post (GET) and lets its owner close or
+// reopen it (PUT) or delete it (DELETE).
+func wantedPostHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	post, ok := loadWantedPost(w, r)
+	if !ok {
+		return
+	}
+	if post.Status != WantedOpen && post.UserID != userID {
+		respondWithError(w, "Wanted post not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respondWithJSON(w, post, http.StatusOK)
+
+	case "PUT":
+		if post.UserID != userID {
+			respondWithError(w, "Wanted post not found", http.StatusNotFound)
+			return
+		}
+		var req UpdateWantedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Status != WantedOpen && req.Status != WantedClosed {
+			respondWithError(w, "status must be open or closed", http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			UPDATE wanted_posts SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING updated_at`,
+			post.ID, req.Status).Scan(&post.UpdatedAt)
+		if err != nil {
+			respondWithError(w, "Error updating wanted post", http.StatusInternalServerError)
+			return
+		}
+		post.Status = req.Status
+		respondWithJSON(w, post, http.StatusOK)
+
+	case "DELETE":
+		if post.UserID != userID {
+			respondWithError(w, "Wanted post not found", http.StatusNotFound)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM wanted_posts WHERE id = $1", post.ID); err != nil {
+			respondWithError(w, "Error deleting wanted post", http.StatusInternalServerError)
+			return
+		}
+		respondWithJSON(w, Response{Message: "Wanted post deleted"}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// wantedAnswersHandler lets sellers answer an open wanted post (POST). The
+// post's owner sees every answer, other users only their own (GET).
+func wantedAnswersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	post, ok := loadWantedPost(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		query := `
+			SELECT a.id, a.wanted_id, a.seller_id, u.name, a.furniture_id, a.message, a.created_at
+			FROM wanted_answers a JOIN users u ON u.id = a.seller_id
+			WHERE a.wanted_id = $1`
+		args := []interface{}{post.ID}
+		if post.UserID != userID {
+			query += " AND a.seller_id = $2"
+			args = append(args, userID)
+		}
+
+		rows, err := db.Query(query+" ORDER BY a.created_at DESC", args...)
+		if err != nil {
+			respondWithError(w, "Error fetching answers", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		answers := []WantedAnswer{}
+		for rows.Next() {
+			var a WantedAnswer
+			if err := rows.Scan(&a.ID, &a.WantedID, &a.SellerID, &a.SellerName, &a.FurnitureID, &a.Message, &a.CreatedAt); err != nil {
+				respondWithError(w, "Error scanning answer data", http.StatusInternalServerError)
+				return
+			}
+			answers = append(answers, a)
+		}
+		if err = rows.Err(); err != nil {
+			respondWithError(w, "Error iterating answer data", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, map[string]interface{}{"answers": answers, "total": len(answers)}, http.StatusOK)
+
+	case "POST":
+		if post.Status != WantedOpen {
+			respondWithError(w, "This wanted post is closed", http.StatusConflict)
+			return
+		}
+		if post.UserID == userID {
+			respondWithError(w, "You cannot answer your own wanted post", http.StatusBadRequest)
+			return
+		}
+
+		var req WantedAnswerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Message = strings.TrimSpace(req.Message)
+		if req.Message == "" && req.FurnitureID == nil {
+			respondWithError(w, "A message or a furnitureId is required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Message) > 1000 {
+			respondWithError(w, "Message must be at most 1000 characters", http.StatusBadRequest)
+			return
+		}
+		if req.FurnitureID != nil {
+			var owns bool
+			err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM furniture WHERE id = $1 AND user_id = $2)", *req.FurnitureID, userID).Scan(&owns)
+			if err != nil {
+				respondWithError(w, "Error fetching furniture", http.StatusInternalServerError)
+				return
+			}
+			if !owns {
+				respondWithError(w, "You can only offer your own listings", http.StatusBadRequest)
+				return
+			}
+		}
+
+		answer := WantedAnswer{WantedID: post.ID, SellerID: userID, FurnitureID: req.FurnitureID, Message: req.Message}
+		err := db.QueryRow(`
+			WITH inserted AS (
+				INSERT INTO wanted_answers (wanted_id, seller_id, furniture_id, message) VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at
+			)
+			SELECT inserted.id, inserted.created_at, u.name FROM inserted, users u WHERE u.id = $2`,
+			post.ID, userID, req.FurnitureID, req.Message).Scan(&answer.ID, &answer.CreatedAt, &answer.SellerName)
+		if err != nil {
+			respondWithError(w, "Error creating answer", http.StatusInternalServerError)
+			return
+		}
+
+		err = Notify(r.Context(), post.UserID, NotificationEvent{
+			Type:  NotificationWanted,
+			Title: "New answer to your wanted post",
+			Body:  fmt.Sprintf("%s answered \"%s\".", answer.SellerName, post.Title),
+			Data: map[string]interface{}{
+				"wantedId":    post.ID,
+				"answerId":    answer.ID,
+				"furnitureId": answer.FurnitureID,
+			},
+		})
+		if err != nil {
+			log.Printf("Error notifying user %d about wanted answer %d: %v", post.UserID, answer.ID, err)
+		}
+
+		respondWithJSON(w, answer, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// wantedMatchesHandler lists the listings matched against a wanted post.
+func wantedMatchesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	post, ok := loadWantedPost(w, r)
+	if !ok {
+		return
+	}
+	if post.UserID != userID {
+		respondWithError(w, "Wanted post not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+furnitureColumns+`, m.created_at
+		FROM furniture JOIN wanted_matches m ON m.furniture_id = furniture.id
+		WHERE m.wanted_id = $1 ORDER BY m.created_at DESC`, post.ID)
+	if err != nil {
+		respondWithError(w, "Error fetching matches", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	matches := []WantedMatch{}
+	for rows.Next() {
+		var match WantedMatch
+		match.Furniture, err = scanFurniture(rows, &match.MatchedAt)
+		if err != nil {
+			respondWithError(w, "Error scanning match data", http.StatusInternalServerError)
+			return
+		}
+		matches = append(matches, match)
+	}
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating match data", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{"matches": matches, "total": len(matches)}, http.StatusOK)
+}
+
+// matchWantedPosts records which open wanted posts a newly created listing
+// satisfies, measuring radius posts on the listing's true coordinates like
+// the radius search. Recording happens in the listing's transaction; the
+// matches are announced by runWantedMatchWorker once it commits.
+func matchWantedPosts(ctx context.Context, tx execer, furnitureID int) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO wanted_matches (wanted_id, furniture_id)
+		SELECT w.id, f.id
+		FROM wanted_posts w, furniture f
+		WHERE f.id = $1 AND w.status = $2
+			AND w.user_id IS DISTINCT FROM f.user_id
+			AND (cardinality(w.tags) = 0 OR f.tags && w.tags)
+			AND (w.category_id IS NULL OR f.category_id IN (
+				WITH RECURSIVE subtree AS (
+					SELECT w.category_id AS id
+					UNION ALL
+					SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+				)
+				SELECT id FROM subtree))
+			AND (w.max_price IS NULL OR `+effectivePriceSQL+` <= w.max_price)
+			AND (CASE
+				WHEN w.radius_km IS NOT NULL THEN f.latitude IS NOT NULL AND `+
+		distanceKmSQL("f.latitude", "f.longitude", "w.latitude", "w.longitude")+` <= w.radius_km
+				WHEN w.city IS NOT NULL THEN f.city = w.city
+				WHEN w.voivodeship IS NOT NULL THEN f.voivodeship = w.voivodeship
+				ELSE TRUE
+			END)
+		ON CONFLICT DO NOTHING`, furnitureID, WantedOpen)
+	return err
+}
+
+func runWantedMatchWorker(ctx context.Context) {
+	ticker := time.NewTicker(wantedPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := notifyWantedMatches(ctx); err != nil {
+			log.Printf("Error notifying wanted matches: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingWantedMatch struct {
+	wantedID       int
+	wantedTitle    string
+	buyerID        int
+	furnitureID    int
+	furnitureTitle string
+	sellerID       *int
+}
+
+// notifyWantedMatches tells the buyer about each new match and the seller
+// that someone is looking for their item.
+func notifyWantedMatches(ctx context.Context) error {
+	claim := func(tx *sql.Tx) ([]pendingWantedMatch, error) {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT m.wanted_id, w.title, w.user_id, m.furniture_id, f.title, f.user_id
+			FROM wanted_matches m
+			JOIN wanted_posts w ON w.id = m.wanted_id
+			JOIN furniture f ON f.id = m.furniture_id
+			WHERE m.notified_at IS NULL
+			ORDER BY m.created_at
+			LIMIT 50
+			FOR UPDATE OF m SKIP LOCKED`)
+		if err != nil {
+			return nil, err
+		}
+		var matches []pendingWantedMatch
+		for rows.Next() {
+			var m pendingWantedMatch
+			if err := rows.Scan(&m.wantedID, &m.wantedTitle, &m.buyerID, &m.furnitureID, &m.furnitureTitle, &m.sellerID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			matches = append(matches, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE wanted_matches SET notified_at = CURRENT_TIMESTAMP WHERE wanted_id = $1 AND furniture_id = $2`,
+				m.wantedID, m.furnitureID); err != nil {
+				return nil, err
+			}
+		}
+		return matches, nil
+	}
+
+	return claimAndNotify(ctx, claim, func(m pendingWantedMatch) error {
+		data := map[string]interface{}{"wantedId": m.wantedID, "furnitureId": m.furnitureID}
+		err := Notify(ctx, m.buyerID, NotificationEvent{
+			Type:  NotificationWanted,
+			Title: "New listing matches your wanted post",
+			Body:  fmt.Sprintf("%s matches \"%s\".", m.furnitureTitle, m.wantedTitle),
+			Data:  data,
+		})
+		if err != nil {
+			return fmt.Errorf("wanted post %d: %w", m.wantedID, err)
+		}
+		if m.sellerID != nil {
+			err := Notify(ctx, *m.sellerID, NotificationEvent{
+				Type:  NotificationWanted,
+				Title: "A buyer is looking for your item",
+				Body:  fmt.Sprintf("Your listing %s matches the wanted post \"%s\".", m.furnitureTitle, m.wantedTitle),
+				Data:  data,
+			})
+			if err != nil {
+				return fmt.Errorf("wanted post %d: %w", m.wantedID, err)
+			}
+		}
+		return nil
+	})
+}
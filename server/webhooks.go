@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook event types partners can subscribe to.
+const (
+	WebhookListingCreated = "listing.created"
+	WebhookListingUpdated = "listing.updated"
+	WebhookListingSold    = "listing.sold"
+	// WebhookReservationCreated is a buyer asking for a listing, with their
+	// message to the seller
+	WebhookReservationCreated = "reservation.created"
+	WebhookTest               = "webhook.test"
+)
+
+const (
+	webhookBatchSize    = 20
+	webhookPollInterval = 5 * time.Second
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 12 * time.Hour
+	webhookMaxAttempts  = 10
+	webhookTimeout      = 10 * time.Second
+	// webhookLease is how long a claimed delivery stays with one worker,
+	// well above webhookTimeout
+	webhookLease = 2 * time.Minute
+)
+
+var webhookEventTypes = []string{
+	WebhookListingCreated,
+	WebhookListingUpdated,
+	WebhookListingSold,
+	WebhookReservationCreated,
+}
+
+var webhookClient = newOutboundClient(webhookTimeout)
+
+type WebhookSubscription struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventTypes"`
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	Active     *bool    `json:"active,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"responseStatus,omitempty"`
+	LastError      *string         `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	Total      int               `json:"total"`
+	Page       int               `json:"page"`
+	Limit      int               `json:"limit"`
+}
+
+type webhookEnvelope struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+func initWebhookTables() error {
+	createSubscriptionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		event_types TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(createSubscriptionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create webhook subscriptions table: %w", err)
+	}
+
+	createDeliveriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+		event_type VARCHAR(50) NOT NULL,
+		payload JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_status INTEGER,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at DESC);
+	ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_sending_idx ON webhook_deliveries (lease_until) WHERE status = 'sending';`
+
+	if _, err := db.Exec(createDeliveriesTableSQL); err != nil {
+		return fmt.Errorf("failed to create webhook deliveries table: %w", err)
+	}
+
+	return nil
+}
+
+// dispatchWebhookEvent queues a delivery for every active subscription of the
+// user that listens to eventType. Pass a transaction to tie the delivery to
+// the business change that triggered it.
+func dispatchWebhookEvent(ctx context.Context, ex execer, userID int, eventType string, data interface{}) error {
+	payload, err := json.Marshal(webhookEnvelope{
+		Event:     eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	_, err = ex.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (subscription_id, event_type, payload)
+		SELECT id, $2, $3 FROM webhook_subscriptions
+		WHERE user_id = $1 AND active AND $2 = ANY(event_types)`,
+		userID, eventType, payload)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+
+	return nil
+}
+
+// webhookSale is the data of a listing.sold event. SKU lets partners who
+// import their stock find the item in their own catalogue.
+type webhookSale struct {
+	FurnitureID int       `json:"furnitureId"`
+	SKU         string    `json:"sku,omitempty"`
+	Title       string    `json:"title"`
+	Price       *float64  `json:"price,omitempty"`
+	SoldVia     string    `json:"soldVia"`
+	SoldAt      time.Time `json:"soldAt"`
+}
+
+// Ways a listing can be sold, reported in listing.sold events.
+const (
+	SoldViaReservation = "reservation"
+	SoldViaAuction     = "auction"
+)
+
+// dispatchListingSold queues listing.sold for the seller's subscriptions.
+// A listing is sold when the seller accepts a reservation or an auction
+// closes with a winner.
+func dispatchListingSold(ctx context.Context, q querier, furnitureID int, soldVia string) error {
+	var sellerID *int
+	sale := webhookSale{FurnitureID: furnitureID, SoldVia: soldVia, SoldAt: time.Now().UTC()}
+	err := q.QueryRowContext(ctx, `
+		SELECT user_id, COALESCE(external_sku, ''), title, `+effectivePriceSQL+` FROM furniture WHERE id = $1`,
+		furnitureID).Scan(&sellerID, &sale.SKU, &sale.Title, &sale.Price)
+	if err != nil || sellerID == nil {
+		return err
+	}
+	return dispatchWebhookEvent(ctx, q, *sellerID, WebhookListingSold, sale)
+}
+
+// dispatchListingUpdated queues listing.updated for the seller's
+// subscriptions with the listing as buyers now see it. Call it in the
+// transaction that changed the listing.
+func dispatchListingUpdated(ctx context.Context, q querier, furnitureID int) error {
+	rows, err := q.QueryContext(ctx, "SELECT "+furnitureColumns+", user_id FROM furniture WHERE id = $1", furnitureID)
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		rows.Close()
+		return rows.Err()
+	}
+	var sellerID *int
+	listing, err := scanFurniture(rows, &sellerID)
+	// The transaction cannot run the insert while the rows are open
+	rows.Close()
+	if err != nil || sellerID == nil {
+		return err
+	}
+	return dispatchWebhookEvent(ctx, q, *sellerID, WebhookListingUpdated, listing)
+}
+
+// webhookReservation is the data of a reservation.created event. BundleID
+// is set when the item was requested as part of a bundle, which creates
+// one reservation per item.
+type webhookReservation struct {
+	ReservationID int       `json:"reservationId"`
+	FurnitureID   int       `json:"furnitureId"`
+	BundleID      *int      `json:"bundleId,omitempty"`
+	SKU           string    `json:"sku,omitempty"`
+	Title         string    `json:"title"`
+	Message       string    `json:"message,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// dispatchReservationCreated queues reservation.created for the seller's
+// subscriptions.
+func dispatchReservationCreated(ctx context.Context, q querier, reservationID int) error {
+	var sellerID *int
+	var reservation webhookReservation
+	err := q.QueryRowContext(ctx, `
+		SELECT r.id, r.furniture_id, r.bundle_id, COALESCE(f.external_sku, ''), f.title, r.message, r.created_at, f.user_id
+		FROM furniture_reservations r JOIN furniture f ON f.id = r.furniture_id
+		WHERE r.id = $1`, reservationID).
+		Scan(&reservation.ReservationID, &reservation.FurnitureID, &reservation.BundleID, &reservation.SKU,
+			&reservation.Title, &reservation.Message, &reservation.CreatedAt, &sellerID)
+	if err != nil || sellerID == nil {
+		return err
+	}
+	return dispatchWebhookEvent(ctx, q, *sellerID, WebhookReservationCreated, reservation)
+}
+
+// signWebhookPayload computes the X-FurnitureHub-Signature value. The
+// timestamp is part of the signed content so receivers can reject replays.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query(`
+			SELECT id, url, event_types, active, created_at
+			FROM webhook_subscriptions WHERE user_id = $1 ORDER BY id`, userID)
+		if err != nil {
+			respondWithError(w, "Error fetching webhooks", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		subscriptions := []WebhookSubscription{}
+		for rows.Next() {
+			var s WebhookSubscription
+			if err := rows.Scan(&s.ID, &s.URL, pq.Array(&s.EventTypes), &s.Active, &s.CreatedAt); err != nil {
+				respondWithError(w, "Error scanning webhook data", http.StatusInternalServerError)
+				return
+			}
+			subscriptions = append(subscriptions, s)
+		}
+
+		if err = rows.Err(); err != nil {
+			respondWithError(w, "Error iterating webhook data", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, map[string]interface{}{"webhooks": subscriptions}, http.StatusOK)
+
+	case "POST":
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if msg := validateWebhookRequest(r.Context(), req); msg != "" {
+			respondWithError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			respondWithError(w, "Error generating webhook secret", http.StatusInternalServerError)
+			return
+		}
+
+		// The secret is only ever returned here; partners must store it.
+		s := WebhookSubscription{URL: req.URL, EventTypes: req.EventTypes, Active: true, Secret: secret}
+		err = db.QueryRow(`
+			INSERT INTO webhook_subscriptions (user_id, url, secret, event_types)
+			VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+			userID, req.URL, secret, pq.Array(req.EventTypes)).Scan(&s.ID, &s.CreatedAt)
+		if err != nil {
+			respondWithError(w, "Error creating webhook", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, s, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid webhook id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if msg := validateWebhookRequest(r.Context(), req); msg != "" {
+			respondWithError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		active := true
+		if req.Active != nil {
+			active = *req.Active
+		}
+
+		s := WebhookSubscription{ID: id, URL: req.URL, EventTypes: req.EventTypes, Active: active}
+		err = db.QueryRow(`
+			UPDATE webhook_subscriptions SET url = $3, event_types = $4, active = $5
+			WHERE id = $1 AND user_id = $2 RETURNING created_at`,
+			id, userID, req.URL, pq.Array(req.EventTypes), active).Scan(&s.CreatedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError(w, "Error updating webhook", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, s, http.StatusOK)
+
+	case "DELETE":
+		result, err := db.Exec("DELETE FROM webhook_subscriptions WHERE id = $1 AND user_id = $2", id, userID)
+		if err != nil {
+			respondWithError(w, "Error deleting webhook", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+
+		respondWithJSON(w, Response{Message: "Webhook deleted"}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid webhook id", http.StatusBadRequest)
+		return
+	}
+
+	if !ownsWebhook(userID, id) {
+		respondWithError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	page, limit := parsePagination(r)
+
+	rows, err := db.Query(`
+		SELECT id, event_type, payload, status, attempts, response_status, last_error,
+			next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE subscription_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`, id, limit, (page-1)*limit)
+	if err != nil {
+		respondWithError(w, "Error fetching webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		var responseStatus sql.NullInt64
+		var lastError sql.NullString
+		var deliveredAt sql.NullTime
+		err := rows.Scan(&d.ID, &d.EventType, &payload, &d.Status, &d.Attempts, &responseStatus, &lastError,
+			&d.NextAttemptAt, &d.CreatedAt, &deliveredAt)
+		if err != nil {
+			respondWithError(w, "Error scanning webhook delivery data", http.StatusInternalServerError)
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		if responseStatus.Valid {
+			status := int(responseStatus.Int64)
+			d.ResponseStatus = &status
+		}
+		if lastError.Valid {
+			d.LastError = &lastError.String
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		respondWithError(w, "Error iterating webhook delivery data", http.StatusInternalServerError)
+		return
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE subscription_id = $1", id).Scan(&total); err != nil {
+		respondWithError(w, "Error counting webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, WebhookDeliveriesResponse{
+		Deliveries: deliveries,
+		Total:      total,
+		Page:       page,
+		Limit:      limit,
+	}, http.StatusOK)
+}
+
+func webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, "Invalid webhook id", http.StatusBadRequest)
+		return
+	}
+
+	if !ownsWebhook(userID, id) {
+		respondWithError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	// Test events bypass the event type filter so any subscription can be checked.
+	payload, err := json.Marshal(webhookEnvelope{
+		Event:     WebhookTest,
+		CreatedAt: time.Now().UTC(),
+		Data:      map[string]interface{}{"message": "This is a test event from FurnitureHub"},
+	})
+	if err != nil {
+		respondWithError(w, "Error encoding test event", http.StatusInternalServerError)
+		return
+	}
+
+	var deliveryID int
+	err = db.QueryRow(`
+		INSERT INTO webhook_deliveries (subscription_id, event_type, payload)
+		VALUES ($1, $2, $3) RETURNING id`, id, WebhookTest, payload).Scan(&deliveryID)
+	if err != nil {
+		respondWithError(w, "Error queuing test event", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, map[string]interface{}{
+		"message":    "Test event queued",
+		"deliveryId": deliveryID,
+	}, http.StatusAccepted)
+}
+
+func validateWebhookRequest(ctx context.Context, req WebhookRequest) string {
+	if err := validateOutboundURL(ctx, req.URL); err != nil {
+		return "Invalid webhook URL: " + err.Error()
+	}
+
+	if len(req.EventTypes) == 0 {
+		return "At least one event type is required"
+	}
+
+	for _, eventType := range req.EventTypes {
+		if !isWebhookEventType(eventType) {
+			return fmt.Sprintf("Unknown event type: %s", eventType)
+		}
+	}
+
+	return ""
+}
+
+func isWebhookEventType(eventType string) bool {
+	for _, t := range webhookEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func ownsWebhook(userID, webhookID int) bool {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1 AND user_id = $2)",
+		webhookID, userID).Scan(&exists)
+	return err == nil && exists
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// runWebhookWorker sends queued deliveries until ctx is done.
+func runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := deliverPendingWebhooks(ctx); err != nil {
+			log.Printf("Error delivering webhooks: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingWebhook struct {
+	id        int
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverPendingWebhooks claims due deliveries and sends them outside any
+// transaction, recording each result on its own like deliverPendingEmails.
+func deliverPendingWebhooks(ctx context.Context) error {
+	pending, err := claimPendingWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		statusCode, sendErr := sendWebhook(ctx, p)
+
+		var responseStatus interface{}
+		if statusCode != 0 {
+			responseStatus = statusCode
+		}
+
+		switch {
+		case sendErr == nil:
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhook_deliveries
+				SET status = 'delivered', lease_until = NULL, response_status = $2, last_error = NULL, delivered_at = CURRENT_TIMESTAMP
+				WHERE id = $1`, p.id, responseStatus)
+		case p.attempts >= webhookMaxAttempts:
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhook_deliveries SET status = 'failed', lease_until = NULL, response_status = $2, last_error = $3
+				WHERE id = $1`, p.id, responseStatus, sendErr.Error())
+		default:
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhook_deliveries
+				SET status = 'pending', lease_until = NULL, response_status = $2, last_error = $3, next_attempt_at = $4
+				WHERE id = $1`, p.id, responseStatus, sendErr.Error(),
+				time.Now().Add(retryBackoff(p.attempts, webhookBaseBackoff, webhookMaxBackoff)))
+		}
+		if err != nil {
+			log.Printf("Error recording webhook delivery %d: %v", p.id, err)
+		}
+	}
+
+	return nil
+}
+
+// claimPendingWebhooks marks a batch of due deliveries as sending for
+// webhookLease, counting the attempt up front as claimPendingEmails does.
+func claimPendingWebhooks(ctx context.Context) ([]pendingWebhook, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH claimed AS (
+			UPDATE webhook_deliveries SET status = 'sending', attempts = attempts + 1, lease_until = $2
+			WHERE id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE (status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP)
+					OR (status = 'sending' AND lease_until <= CURRENT_TIMESTAMP)
+				ORDER BY next_attempt_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED)
+			RETURNING id, subscription_id, event_type, payload, attempts
+		)
+		SELECT c.id, c.event_type, c.payload, c.attempts, s.url, s.secret
+		FROM claimed c JOIN webhook_subscriptions s ON s.id = c.subscription_id`,
+		webhookBatchSize, time.Now().Add(webhookLease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingWebhook
+	for rows.Next() {
+		var p pendingWebhook
+		if err := rows.Scan(&p.id, &p.eventType, &p.payload, &p.attempts, &p.url, &p.secret); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+func sendWebhook(ctx context.Context, p pendingWebhook) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(p.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FurnitureHub-Webhooks/1.0")
+	req.Header.Set("X-FurnitureHub-Event", p.eventType)
+	req.Header.Set("X-FurnitureHub-Delivery", strconv.Itoa(p.id))
+	req.Header.Set("X-FurnitureHub-Timestamp", timestamp)
+	req.Header.Set("X-FurnitureHub-Signature", signWebhookPayload(p.secret, timestamp, p.payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	// The response body is never read or stored, so a webhook cannot be
+	// used to fetch content from the endpoint it points at
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
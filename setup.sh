@@ -60,9 +60,15 @@ DB_NAME=auth_app
 # Server Configuration
 PORT=8080
 JWT_SECRET=your-super-secret-jwt-key-change-this-in-production
+# Keys derived data such as fuzzed public coordinates; unlike JWT_SECRET it
+# must never change once listings exist
+DATA_SECRET=your-long-lived-data-secret-change-this-in-production
 
 # Environment
 ENV=development
+
+# Email Delivery (file writes .eml files to EMAIL_OUTBOX_DIR)
+EMAIL_TRANSPORT=file
 EOF
     echo "✅ Backend .env file created"
 fi